@@ -0,0 +1,125 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrDenied is passed to the Rejected event for connections that were
+// denied by the ACL or by the Accept event.
+var ErrDenied = errors.New("connection denied")
+
+// ACL is an access control list of networks for inbound connections. It's
+// immutable, so it's safe to share between servers and goroutines.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewACL returns a list that allows the networks of allow, or all networks
+// when allow is empty, except for the networks of deny. The networks are
+// in CIDR notation, such as "10.0.0.0/8" or "2001:db8::/32", or are single
+// IP addresses.
+func NewACL(allow, deny []string) (*ACL, error) {
+	var acl ACL
+	var err error
+	if acl.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+func parseNets(nets []string) ([]*net.IPNet, error) {
+	var ipnets []*net.IPNet
+	for _, s := range nets {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ipnets = append(ipnets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return ipnets, nil
+}
+
+// Allowed returns true when the list allows the IP. A nil IP, such as the
+// one of a unix socket, is always allowed.
+func (acl *ACL) Allowed(ip net.IP) bool {
+	if acl == nil || ip == nil {
+		return true
+	}
+	for _, ipnet := range acl.deny {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.allow) == 0 {
+		return true
+	}
+	for _, ipnet := range acl.allow {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetACL replaces the access control list of the server, which starts as
+// the ACL of the events. It's safe to call from any goroutine, and applies
+// to the connections that are accepted after it returns. A nil list allows
+// all connections.
+func (s Server) SetACL(acl *ACL) error {
+	if s.acl == nil {
+		return errors.New("server not running")
+	}
+	s.acl.Store(acl)
+	return nil
+}
+
+// addrIP returns the IP of the address, or nil for addresses without one.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// admit decides whether to keep a new inbound connection, by checking the
+// ACL, the Accept event and then the limits. It returns the limiter key
+// for release, or the reason the connection is rejected.
+func admit(events *Events, acl *atomic.Value, lim *connLimiter, remote net.Addr) (key string, err error) {
+	if !acl.Load().(*ACL).Allowed(addrIP(remote)) {
+		return "", ErrDenied
+	}
+	if events.Accept != nil && !events.Accept(remote) {
+		return "", ErrDenied
+	}
+	if lim != nil {
+		return lim.acquire(remote)
+	}
+	return "", nil
+}
@@ -5,9 +5,19 @@
 package evio
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"os"
+	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +27,8 @@ type Action int
 const (
 	// None indicates that no action should occur following an event.
 	None Action = iota
+	// Detach detaches a connection. Not available for UDP connections.
+	Detach
 	// Close closes the connection.
 	Close
 	// Shutdown shutdowns the server.
@@ -33,16 +45,324 @@ type Options struct {
 	// Default value is false, which means that all input data which is
 	// passed to the Data event will be a uniquely copied []byte slice.
 	ReuseInputBuffer bool
+	// IdleTimeout closes the connection when nothing has been read or
+	// written for the duration.
+	IdleTimeout time.Duration
+	// ReadTimeout closes the connection when nothing has been read for
+	// the duration.
+	ReadTimeout time.Duration
+	// WriteTimeout closes the connection when pending output has not been
+	// written for the duration, such as when the peer stops reading.
+	WriteTimeout time.Duration
+	// WriteHighWater pauses reading from the connection while it has more
+	// than this many bytes of pending output, such as when the peer reads
+	// slower than the connection writes. The default of zero pauses
+	// reading whenever there's pending output.
+	WriteHighWater int
+	// WriteLowWater resumes reading from a paused connection once its
+	// pending output is at or below this many bytes. It's clamped to
+	// WriteHighWater, and the default of zero resumes reading once all
+	// the output has been written.
+	WriteLowWater int
+	// WriteLimit closes the connection with ErrSlowConsumer when it has
+	// more than this many bytes of pending output. Zero means no limit.
+	WriteLimit int
+	// ReadRate limits reading from the connection to this many bytes per
+	// second, with bursts of up to a second of bytes. Reading pauses while
+	// over the rate, so that the peer is slowed down by flow control
+	// instead of being buffered. Zero means no limit.
+	ReadRate int
+	// WriteRate limits writing to the connection to this many bytes per
+	// second, with bursts of up to a second of bytes. Output waits in the
+	// queue while over the rate, and counts toward the water marks and
+	// the WriteLimit. Zero means no limit.
+	WriteRate int
+	// TLSConfig enables TLS for the connection, as the server side for
+	// inbound connections and the client side for outbound ones. The
+	// handshake runs on the loop once Opened returns, the Data event only
+	// sees plaintext, and the output is encrypted before it's queued.
+	// Output of Opened and Write calls waits for the handshake. Conn.TLS
+	// returns the state of the connection once the handshake is complete.
+	TLSConfig *tls.Config
+}
+
+// Errors passed to the Closed event, which tell why the connection closed.
+// An error with a cause, such as the syscall error of a failed read, wraps
+// the cause, and both are matched by errors.Is.
+var (
+	// ErrPeerClosed is for connections that were closed or reset by the
+	// peer. The cause is io.EOF for a clean close.
+	ErrPeerClosed = errors.New("closed by peer")
+	// ErrClosedByHandler is for connections that were closed by a Close
+	// action or by Conn.Close. Conn.CloseWithError passes its own error.
+	ErrClosedByHandler = errors.New("closed by handler")
+	// ErrServerShutdown is for connections that were open when the server
+	// shut down.
+	ErrServerShutdown = errors.New("server shutdown")
+	// ErrWriteFailed is for connections that failed to write.
+	ErrWriteFailed = errors.New("write failed")
+	// ErrDialFailed is for outbound connections that failed to connect.
+	ErrDialFailed = errors.New("dial failed")
+	// ErrTimeout is for connections that were closed by the IdleTimeout,
+	// ReadTimeout or WriteTimeout options.
+	ErrTimeout = errors.New("connection timed out")
+	// ErrSlowConsumer is for connections that were closed by the
+	// WriteLimit option.
+	ErrSlowConsumer = errors.New("slow consumer")
+	// ErrPanic is for connections that were closed after an event
+	// panicked. The cause is the panic value, or wraps it when it's not an
+	// error.
+	ErrPanic = errors.New("event panicked")
+	// ErrTLSHandshake is for connections that failed the TLS handshake.
+	ErrTLSHandshake = errors.New("TLS handshake failed")
+)
+
+// closeError is a close reason that wraps its cause.
+type closeError struct {
+	reason error
+	cause  error
+}
+
+func (e *closeError) Error() string        { return e.reason.Error() + ": " + e.cause.Error() }
+func (e *closeError) Unwrap() error        { return e.cause }
+func (e *closeError) Is(target error) bool { return target == e.reason }
+
+// closeErr returns the close reason, wrapping the cause when there is one.
+func closeErr(reason, cause error) error {
+	if cause == nil {
+		return reason
+	}
+	return &closeError{reason: reason, cause: cause}
+}
+
+// protect calls f, recovering from a panic with the OnPanic event. It
+// returns the action of the event and the panic as an error, which is nil
+// when f didn't panic. The call is counted by the loop stats with the
+// EventStats option, unless st is nil.
+func (events *Events) protect(st *loopStats, c Conn, f func()) (action Action, err error) {
+	if st != nil && events.EventStats {
+		defer st.event(time.Now())
+	}
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		stack := debug.Stack()
+		if err, _ = v.(error); err == nil {
+			err = fmt.Errorf("%v", v)
+		}
+		if c != nil {
+			events.log(slog.LevelError, "event panicked", "loop", c.LoopIndex(),
+				"remote", c.RemoteAddr(), "err", err)
+		} else {
+			events.log(slog.LevelError, "event panicked", "err", err)
+		}
+		action = Close
+		if events.OnPanic != nil {
+			action = events.OnPanic(c, v, stack)
+		}
+	}()
+	f()
+	return None, nil
+}
+
+// panicAction returns the action to take after an event of the
+// connection panicked. Closing is done by CloseWithError, so that the
+// Closed event has the panic.
+func panicAction(c Conn, action Action, err error) Action {
+	if action == Close {
+		if c != nil {
+			c.CloseWithError(closeErr(ErrPanic, err))
+		}
+		return None
+	}
+	return action
+}
+
+// runTimer calls the function of a timer, recovering from a panic like
+// the events do. The connection is nil for server timers. It returns
+// errClosing when the server should shut down.
+func (events *Events) runTimer(st *loopStats, c Conn, f func()) error {
+	if action, err := events.protect(st, c, f); err != nil {
+		if panicAction(c, action, err) == Shutdown {
+			return errClosing
+		}
+	}
+	return nil
+}
+
+// recoverEvents returns the events with callbacks that recover from
+// panics, and are counted by the stats of their loops with the EventStats
+// option. A Close action for an event without a connection is ignored, and
+// a ticker that panicked fires again after its last delay.
+func recoverEvents(events Events, stats []*loopStats) Events {
+	if serving := events.Serving; serving != nil {
+		events.Serving = func(server Server) (action Action) {
+			if pa, err := events.protect(nil, nil, func() { action = serving(server) }); err != nil {
+				action = panicAction(nil, pa, err)
+			}
+			return
+		}
+	}
+	if opened := events.Opened; opened != nil {
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			st := stats[c.LoopIndex()]
+			if pa, err := events.protect(st, c, func() { out, opts, action = opened(c) }); err != nil {
+				action = panicAction(c, pa, err)
+			}
+			return
+		}
+	}
+	if closed := events.Closed; closed != nil {
+		events.Closed = func(c Conn, err error) (action Action) {
+			st := stats[c.LoopIndex()]
+			if pa, perr := events.protect(st, c, func() { action = closed(c, err) }); perr != nil {
+				// already closed
+				action = panicAction(nil, pa, perr)
+			}
+			return
+		}
+	}
+	if detached := events.Detached; detached != nil {
+		events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+			st := stats[c.LoopIndex()]
+			if pa, err := events.protect(st, c, func() { action = detached(c, rwc) }); err != nil {
+				// the connection belongs to rwc
+				action = panicAction(nil, pa, err)
+			}
+			return
+		}
+	}
+	if data := events.Data; data != nil {
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			st := stats[c.LoopIndex()]
+			if pa, err := events.protect(st, c, func() { out, action = data(c, in) }); err != nil {
+				action = panicAction(c, pa, err)
+			}
+			return
+		}
+	}
+	if readEOF := events.ReadEOF; readEOF != nil {
+		events.ReadEOF = func(c Conn) (out []byte, action Action) {
+			st := stats[c.LoopIndex()]
+			if pa, err := events.protect(st, c, func() { out, action = readEOF(c) }); err != nil {
+				action = panicAction(c, pa, err)
+			}
+			return
+		}
+	}
+	if accept := events.Accept; accept != nil {
+		events.Accept = func(remote net.Addr) (ok bool) {
+			// denied when it panics
+			events.protect(nil, nil, func() { ok = accept(remote) })
+			return
+		}
+	}
+	if rejected := events.Rejected; rejected != nil {
+		events.Rejected = func(remote net.Addr, reason error) {
+			events.protect(nil, nil, func() { rejected(remote, reason) })
+		}
+	}
+	if tick := events.Tick; tick != nil {
+		var last time.Duration // only fired by the first loop
+		events.Tick = func() (delay time.Duration, action Action) {
+			pa, err := events.protect(stats[0], nil, func() { delay, action = tick() })
+			if err != nil {
+				return last, panicAction(nil, pa, err)
+			}
+			last = delay
+			return
+		}
+	}
+	if loopTick := events.LoopTick; loopTick != nil {
+		var mu sync.Mutex
+		last := make(map[int]time.Duration)
+		events.LoopTick = func(loopIdx int) (delay time.Duration, action Action) {
+			st := stats[loopIdx]
+			pa, err := events.protect(st, nil, func() { delay, action = loopTick(loopIdx) })
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				return last[loopIdx], panicAction(nil, pa, err)
+			}
+			last[loopIdx] = delay
+			return
+		}
+	}
+	return events
 }
 
 // Server represents a server context which provides information about the
 // running server and has control functions for managing state.
 type Server struct {
-	// The addr parameter is the listening addresses that align
-	// with the addr strings passed to the Serve function.
+	// Addr is the first listening address. It's equal to Addrs[0].
 	Addr net.Addr
+	// The addrs parameter is an array of listening addresses that align
+	// with the addr strings passed to the Serve or ServeAddrs function.
+	Addrs []net.Addr
 	// NumLoops is the number of loops that the server is using.
 	NumLoops int
+
+	dial      func(loopIdx int, network, addr string, ctx interface{}) (Conn, error)
+	afterFunc func(loopIdx int, d time.Duration, f func()) Timer
+	stats     []*loopStats
+	acl       *atomic.Value // *ACL
+}
+
+// Dial connects to the address on the named network and attaches the new
+// outbound connection to one of the server loops, which is picked using
+// the LoadBalance method. It's safe to call from any goroutine.
+//
+// Valid networks are "tcp", "tcp4", "tcp6" and "unix". The address is
+// resolved before Dial returns, so an IP address should be used when
+// calling from an event to avoid blocking the loop. The connect itself
+// is non-blocking.
+//
+// The ctx parameter is the initial context of the connection. The Opened
+// event fires once the connection is established, with Conn.Outbound
+// returning true. Failing to connect fires the Closed event with the
+// connection error, without firing Opened. Once the server has shut down
+// Dial returns ErrServerShutdown.
+func (s Server) Dial(network, addr string, ctx interface{}) (Conn, error) {
+	return s.DialLoop(-1, network, addr, ctx)
+}
+
+// DialLoop is like Dial but attaches the connection to the loop at
+// loopIdx, such as the Conn.LoopIndex of an inbound connection. A
+// negative loopIdx picks the loop using the LoadBalance method.
+func (s Server) DialLoop(loopIdx int, network, addr string, ctx interface{}) (Conn, error) {
+	if s.dial == nil {
+		return nil, errors.New("server not running")
+	}
+	if loopIdx >= s.NumLoops {
+		return nil, errors.New("invalid loop index")
+	}
+	return s.dial(loopIdx, network, addr, ctx)
+}
+
+// AfterFunc calls f on the loop at loopIdx once the duration has elapsed.
+// It's safe to call from any goroutine, as are the methods of the returned
+// Timer. Timers that have not fired when the server shuts down never fire.
+func (s Server) AfterFunc(loopIdx int, d time.Duration, f func()) (Timer, error) {
+	if s.afterFunc == nil {
+		return nil, errors.New("server not running")
+	}
+	if loopIdx < 0 || loopIdx >= s.NumLoops {
+		return nil, errors.New("invalid loop index")
+	}
+	return s.afterFunc(loopIdx, d, f), nil
+}
+
+// Timer is a timer that was created by Conn.AfterFunc or Server.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+	// Reset changes the timer to fire once the duration has elapsed, which
+	// restarts a timer that has fired or been stopped. It returns true if
+	// the timer had been active.
+	Reset(d time.Duration) bool
 }
 
 // Conn is an evio connection.
@@ -51,12 +371,56 @@ type Conn interface {
 	Context() interface{}
 	// SetContext sets a user-defined context.
 	SetContext(interface{})
+	// AddrIndex is the index of server address that was passed to the
+	// Serve or ServeAddrs call. It's -1 for outbound connections.
+	AddrIndex() int
+	// LoopIndex is the index of the loop that owns the connection.
+	LoopIndex() int
+	// Outbound returns true for connections created by Server.Dial.
+	Outbound() bool
 	// LocalAddr is the connection's local socket address.
 	LocalAddr() net.Addr
 	// RemoteAddr is the connection's remote peer address.
 	RemoteAddr() net.Addr
-	// Write writes the data to the remote, async write, no error returned immedidately.
+	// ProxyHeader returns the PROXY protocol header of a connection that
+	// was accepted by a listener with the proxy_protocol option, and nil
+	// for other connections. The LocalAddr and RemoteAddr of the
+	// connection are the addresses of the header, unless it's Local.
+	ProxyHeader() *ProxyHeader
+	// TLS returns the state of a connection with the TLSConfig option once
+	// the handshake is complete, including the negotiated protocol, the
+	// server name and the peer certificates. It's nil before the
+	// handshake and for other connections.
+	TLS() *tls.ConnectionState
+	// Write queues the data to be written to the connection. It never
+	// blocks and is safe to call from any goroutine. The data of Write
+	// calls and the out return values of events are written in call
+	// order, and the data of a single call is never interleaved with
+	// other output. An error is returned once the connection is closed
+	// or detached.
 	Write(data []byte) error
+	// Close closes the connection once all pending output has been
+	// written. It's safe to call from any goroutine, and the Closed event
+	// fires on the loop that owns the connection with ErrClosedByHandler.
+	Close() error
+	// CloseWithError is like Close but the Closed event fires with err.
+	CloseWithError(err error) error
+	// CloseWrite shuts down the writing side of the connection once all
+	// pending output has been written, and later Write calls return an
+	// error. It's safe to call from any goroutine. The connection closes
+	// once the reading side has been shut down by the peer too.
+	CloseWrite() error
+	// Wake triggers a Data event with a nil in parameter for this
+	// connection. It's safe to call from any goroutine, and the event
+	// fires on the loop that owns the connection. Not available for UDP
+	// connections.
+	Wake()
+	// AfterFunc calls f on the loop that owns the connection once the
+	// duration has elapsed. It's safe to call from any goroutine, as are
+	// the methods of the returned Timer. The timer is stopped when the
+	// connection is closed or detached. UDP timers are only stopped by
+	// the server shutting down.
+	AfterFunc(d time.Duration, f func()) Timer
 }
 
 // LoadBalance sets the load balancing method.
@@ -100,16 +464,93 @@ type Events struct {
 	// Closed fires when a connection has closed.
 	// The err parameter is the last known connection error.
 	Closed func(c Conn, err error) (action Action)
+	// Detached fires when a connection has been previously detached.
+	// Once detached it's up to the receiver of this event to manage the
+	// state of the connection. The Closed event will not be called for
+	// this connection.
+	// The conn parameter is a ReadWriteCloser that represents the
+	// underlying socket connection. It can be freely used in goroutines
+	// and should be closed when it's no longer needed. Any input data
+	// that was not yet passed to the Data event is returned by its first
+	// reads, and any output of Write calls that was not yet written is
+	// written by its first read or write.
+	Detached func(c Conn, rwc io.ReadWriteCloser) (action Action)
 	// Data fires when a connection sends the server data.
 	// The in parameter is the incoming data.
 	// Use the out return value to write data to the connection.
 	Data func(c Conn, in []byte) (out []byte, action Action)
+	// ReadEOF fires when the peer shuts down the writing side of the
+	// connection, such as with a half-close. The connection stays open for
+	// writing, and the out and action return values work the same as for
+	// the Data event. When ReadEOF is nil the connection closes on EOF.
+	ReadEOF func(c Conn) (out []byte, action Action)
 	// Tick fires immediately after the server starts and will fire again
 	// following the duration specified by the delay return value.
 	Tick func() (delay time.Duration, action Action)
+	// LoopTick is like Tick but fires on every loop, with the index of the
+	// loop and an independent delay. It runs on the loop's goroutine, so
+	// it may use the state of the loop's connections without locking.
+	LoopTick func(loopIdx int) (delay time.Duration, action Action)
+	// OnPanic fires when an event, or a function of AfterFunc, panics. The
+	// v parameter is the recovered value and stack is the stack trace of
+	// the panic. The action applies to the connection, which is nil for
+	// events without one. A Close action closes the connection and the
+	// Closed event fires with ErrPanic, and a Shutdown action shuts down
+	// the server. When OnPanic is nil the connection is closed, and the
+	// other connections keep being served.
+	OnPanic func(c Conn, v interface{}, stack []byte) (action Action)
+	// EventStats counts the events and the time that was spent in them,
+	// for the Events and EventTime stats of the server. It's off by
+	// default, as it takes two timestamps for every event.
+	EventStats bool
+	// Logger receives records of internal events and errors, such as
+	// failed accepts, failed writes and the reasons loops stop. Nothing is
+	// logged when it's nil.
+	Logger Logger
+	// MaxConns limits the number of inbound connections of all the loops,
+	// and MaxConnsPerIP limits the number from a single remote IP. Zero
+	// means no limit. Connections over a limit are closed right after
+	// they're accepted, without Opened and Closed events.
+	MaxConns      int
+	MaxConnsPerIP int
+	// AcceptRatePerIP limits the number of new inbound connections from a
+	// single remote IP to this many per second, with bursts of up to a
+	// second of connections. Connections over the rate are closed like
+	// the ones over MaxConns.
+	AcceptRatePerIP int
+	// Accept fires right after an inbound connection is accepted, before
+	// anything is allocated for it, and returning false closes it with
+	// ErrDenied. It's called after the ACL check and before the limits.
+	// It runs on the loop, or on the goroutine of the listener for the
+	// "-net" schemes, so it may be called concurrently.
+	Accept func(remote net.Addr) bool
+	// ACL is the access control list that inbound connections are checked
+	// against when the server starts. It can be replaced while the server
+	// runs with Server.SetACL. A nil list allows all connections.
+	ACL *ACL
+	// Rejected fires on a loop when a connection was closed for being over
+	// a limit, for being denied or for sending an invalid PROXY protocol
+	// header. The reason is ErrMaxConns, ErrMaxConnsPerIP, ErrAcceptRate,
+	// ErrDenied or ErrProxyHeader.
+	Rejected func(remote net.Addr, reason error)
+}
+
+// Logger receives structured records with the levels and key-value pairs
+// of log/slog, and is implemented by *slog.Logger. The records use the
+// keys "loop", "fd", "remote", "addr" and "err" when the values are known,
+// where addr is the listening address.
+type Logger interface {
+	Log(ctx context.Context, level slog.Level, msg string, args ...interface{})
 }
 
-// Serve starts handling events for the specified addresses.
+// log sends a record to the Logger, if there is one.
+func (events *Events) log(level slog.Level, msg string, args ...interface{}) {
+	if events.Logger != nil {
+		events.Logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// Serve starts handling events for the specified address.
 //
 // Addresses should use a scheme prefix and be formatted
 // like `tcp://192.168.0.10:9851` or `unix://socket`.
@@ -117,44 +558,88 @@ type Events struct {
 //  tcp   - bind to both IPv4 and IPv6
 //  tcp4  - IPv4
 //  tcp6  - IPv6
+//  udp   - bind to both IPv4 and IPv6
+//  udp4  - IPv4
+//  udp6  - IPv6
 //  unix  - Unix Domain Socket
 //
 // The "tcp" network scheme is assumed when one is not specified.
+//
+// The Data event fires once for every datagram received on a udp address.
+// The Conn passed to the event represents the sender of the datagram and
+// the out return value is sent back to the sender as a single datagram.
 func Serve(addr string, events Events) error {
-	var stdlib bool
-	var ln listener
-	var stdlibt bool
+	return ServeAddrs(events, addr)
+}
 
-	ln.network, ln.addr, ln.opts, stdlibt = parseAddr(addr)
-	if stdlibt {
-		stdlib = true
+// ServeAddrs starts handling events for the specified addresses.
+// All of the addresses share the same event loops, and the Conn.AddrIndex
+// of each connection tells which address accepted it.
+//
+// The addresses follow the same format as the addr parameter of Serve.
+func ServeAddrs(events Events, addrs ...string) error {
+	if len(addrs) == 0 {
+		return errors.New("no addresses")
 	}
-	if ln.network == "unix" {
-		os.RemoveAll(ln.addr)
+	var lns []*listener
+	defer func() {
+		for _, ln := range lns {
+			ln.close()
+		}
+	}()
+	var stdlib bool
+	for _, addr := range addrs {
+		var ln listener
+		var stdlibt bool
+		ln.network, ln.addr, ln.opts, stdlibt = parseAddr(addr)
+		if stdlibt {
+			stdlib = true
+		}
+		if ln.network == "unix" {
+			os.RemoveAll(ln.addr)
+		}
+		var err error
+		if strings.HasPrefix(ln.network, "udp") {
+			if ln.opts.reusePort {
+				ln.pconn, err = reuseportListenPacket(ln.network, ln.addr)
+			} else {
+				ln.pconn, err = net.ListenPacket(ln.network, ln.addr)
+			}
+		} else {
+			if ln.opts.reusePort {
+				ln.ln, err = reuseportListen(ln.network, ln.addr)
+			} else {
+				ln.ln, err = net.Listen(ln.network, ln.addr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if ln.pconn != nil {
+			ln.lnaddr = ln.pconn.LocalAddr()
+		} else {
+			ln.lnaddr = ln.ln.Addr()
+		}
+		lns = append(lns, &ln)
 	}
-
-	var err error
-	if ln.opts.reusePort {
-		ln.ln, err = reuseportListen(ln.network, ln.addr)
-	} else {
-		ln.ln, err = net.Listen(ln.network, ln.addr)
+	if events.NumLoops <= 0 {
+		if events.NumLoops == 0 {
+			events.NumLoops = 1
+		} else {
+			events.NumLoops = runtime.NumCPU()
+		}
 	}
-	if err != nil {
-		return err
+	stats := newLoopStats(events.NumLoops)
+	events = recoverEvents(events, stats)
+	if stdlib {
+		return stdserve(events, lns, stats)
 	}
-	ln.lnaddr = ln.ln.Addr()
-	if !stdlib {
+	for _, ln := range lns {
 		if err := ln.system(); err != nil {
 			return err
 		}
 	}
-
-	defer ln.close()
-
-	if stdlib {
-		return stdserve(events, &ln)
-	}
-	return serve(events, &ln)
+	return serve(events, lns, stats)
 }
 
 // InputStream is a helper type for managing input streams from inside
@@ -185,6 +670,7 @@ func (is *InputStream) End(data []byte) {
 
 type listener struct {
 	ln      net.Listener
+	pconn   net.PacketConn
 	lnaddr  net.Addr
 	opts    addrOpts
 	f       *os.File
@@ -195,6 +681,7 @@ type listener struct {
 
 type addrOpts struct {
 	reusePort bool
+	proxy     int // PROXY protocol versions
 }
 
 func parseAddr(addr string) (network, address string, opts addrOpts, stdlib bool) {
@@ -224,6 +711,8 @@ func parseAddr(addr string) (network, address string, opts addrOpts, stdlib bool
 							opts.reusePort = true
 						}
 					}
+				case "proxy_protocol":
+					opts.proxy = parseProxyVersions(kv[1])
 				}
 			}
 		}
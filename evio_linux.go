@@ -5,9 +5,13 @@
 package evio
 
 import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
 	"net"
 	"os"
-	"runtime"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -18,113 +22,446 @@ import (
 	reuseport "github.com/kavu/go_reuseport"
 )
 
-const writeEventBuf = 128
-
 type conn struct {
-	fd         int              // file descriptor
-	out        []byte           // write buffer
-	sa         syscall.Sockaddr // remote socket address
-	reuse      bool             // should reuse input buffer
-	opened     bool             // connection opened event fired
-	action     Action           // next user action
-	ctx        interface{}      // user-defined context
-	localAddr  net.Addr         // local addre
-	remoteAddr net.Addr         // remote addr
-	loop       *loop            // connected loop
+	fd             int                 // file descriptor
+	out            []byte              // write buffer
+	sa             syscall.Sockaddr    // remote socket address
+	reuse          bool                // should reuse input buffer
+	udp            bool                // udp sender, fd is the listener
+	opened         bool                // connection opened event fired
+	action         Action              // next user action
+	ctx            interface{}         // user-defined context
+	addrIndex      int                 // index of listening address
+	outbound       bool                // created by Server.Dial
+	closeErr       error               // error for the Closed event
+	queued         int                 // len(out) as counted by the loop stats
+	limited        bool                // counted by the server limiter
+	limitKey       string              // limiter key of the remote IP
+	wmu            sync.Mutex          // guards pending, wqueued, wclosed and wshut
+	pending        []byte              // output of Write calls, taken by the loop
+	wqueued        bool                // queued on the loop writes
+	wclosed        bool                // closed or detached, no more writes
+	wshut          bool                // CloseWrite was called, no more writes
+	closeWrite     bool                // shut down writing once the output is written
+	writeShut      bool                // writing was shut down
+	readEOF        bool                // reading was shut down by the peer
+	timed          bool                // has timeouts
+	idleTime       time.Duration       // idle timeout
+	readTime       time.Duration       // read timeout
+	writeTime      time.Duration       // write timeout
+	timer          *internal.Timer     // timeout timer
+	deadline       time.Time           // when the timer fires, zero when stopped
+	readAt         time.Time           // last read, or opened
+	activeAt       time.Time           // last read or write, or opened
+	writeAt        time.Time           // last write, or output queued
+	timers         map[*looptimer]bool // active AfterFunc timers
+	interest       int                 // poll interest, read and/or write
+	paused         bool                // reads paused by the high water mark
+	highWater      int                 // pause reads above this much output
+	lowWater       int                 // resume reads at this much output
+	writeLimit     int                 // close above this much output
+	readRate       *tokenBucket        // ReadRate, or nil
+	writeRate      *tokenBucket        // WriteRate, or nil
+	readThrottled  bool                // reads paused by the read rate
+	writeThrottled bool                // writes paused by the write rate
+	proxy          *ProxyHeader        // PROXY protocol header
+	proxyIn        []byte              // input of a PROXY protocol listener, until the header is complete
+	tls            *tlsConn            // TLS engine, or nil
+	localAddr      net.Addr            // local addre
+	remoteAddr     net.Addr            // remote addr
+	loop           *loop               // connected loop
 }
 
+// poll interests of a connection
+const (
+	interestRead = 1 << iota
+	interestWrite
+)
+
+// epoll flags that let a connection make progress
+const (
+	readEvents  = syscall.EPOLLIN | syscall.EPOLLERR | syscall.EPOLLHUP
+	writeEvents = syscall.EPOLLOUT | syscall.EPOLLERR | syscall.EPOLLHUP
+)
+
 func (c *conn) Context() interface{}       { return c.ctx }
 func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *conn) AddrIndex() int             { return c.addrIndex }
+func (c *conn) LoopIndex() int             { return c.loop.idx }
+func (c *conn) Outbound() bool             { return c.outbound }
 func (c *conn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *conn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *conn) ProxyHeader() *ProxyHeader  { return c.proxy }
+func (c *conn) TLS() *tls.ConnectionState {
+	if c.tls == nil {
+		return nil
+	}
+	return c.tls.connState()
+}
 
 func (c *conn) Write(data []byte) error {
-	n, err := syscall.Write(c.fd, data)
-	if err != nil {
-		if err == syscall.EAGAIN {
-			return c.willWrite(data)
+	if c.udp {
+		if err := syscall.Sendto(c.fd, data, 0, c.sa); err != nil {
+			return err
 		}
+		c.loop.stats.write(len(data))
+		return nil
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	c.wmu.Lock()
+	if c.wclosed || c.wshut {
+		c.wmu.Unlock()
+		return errConnClosed
+	}
+	c.pending = append(c.pending, data...)
+	queue := !c.wqueued
+	c.wqueued = true
+	c.wmu.Unlock()
+	if !queue {
+		return nil
+	}
+	return c.loop.poll.Trigger(func() error {
+		return loopWritePending(c.loop.s, c.loop, c)
+	})
+}
 
-		return err
+// appendOut moves the output of Write calls, and then the out value of an
+// event, to the write buffer. It's called for every event, which keeps all
+// output in call order.
+func (c *conn) appendOut(out []byte) {
+	empty := len(c.out) == 0
+	c.wmu.Lock()
+	if c.tls != nil && !c.writeShut {
+		c.tls.write(c.pending)
+	} else {
+		c.out = append(c.out, c.pending...)
+	}
+	c.pending = c.pending[:0]
+	c.wqueued = false
+	c.wmu.Unlock()
+	if c.writeShut {
+		// nowhere to write
+		c.out = c.out[:0]
+		return
+	}
+	if c.tls != nil {
+		// encrypted, with the output of the handshake
+		c.tls.write(out)
+		c.out = c.tls.appendOut(c.out)
+	} else {
+		c.out = append(c.out, out...)
+	}
+	if c.timed && empty && len(c.out) != 0 {
+		c.writeAt = time.Now()
+		loopArmTimer(c.loop, c)
+	}
+}
+
+// stopTimers stops the timeout timer and the AfterFunc timers of a closed
+// or detached connection.
+func (c *conn) stopTimers() {
+	if c.timer != nil {
+		c.timer.Stop()
 	}
+	for t := range c.timers {
+		t.cancel()
+	}
+	c.timers = nil
+}
 
-	if n < len(data) {
-		return c.willWrite(data[n:])
+// timeoutDeadline returns the time that the connection times out, or zero
+// when it has no timeouts.
+func (c *conn) timeoutDeadline() time.Time {
+	var deadline time.Time
+	earlier := func(t time.Time) {
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	if c.idleTime > 0 {
+		earlier(c.activeAt.Add(c.idleTime))
 	}
+	if c.readTime > 0 && !c.readEOF {
+		earlier(c.readAt.Add(c.readTime))
+	}
+	if c.writeTime > 0 && len(c.out) != 0 {
+		earlier(c.writeAt.Add(c.writeTime))
+	}
+	return deadline
+}
 
-	return nil
+// closeWrites stops accepting Write calls and returns the output that was
+// not yet taken by the loop.
+func (c *conn) closeWrites() []byte {
+	c.wmu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.wclosed = true
+	c.wmu.Unlock()
+	return pending
 }
 
-func (c *conn) willWrite(data []byte) error {
-	c.loop.wch <- writeEvent{
-		c:    c,
-		data: data,
+func (c *conn) Wake() {
+	if c.udp {
+		return
 	}
+	l := c.loop
+	l.poll.Trigger(func() error {
+		if l.fdconns[c.fd] != c || !c.opened || c.action != None {
+			// closed, detached or closing
+			return nil
+		}
+		return loopWake(l.s, l, c)
+	})
+}
 
-	return c.loop.poll.FireEvent(internal.EventWrite)
+func (c *conn) CloseWrite() error {
+	if c.udp {
+		return nil
+	}
+	c.wmu.Lock()
+	c.wshut = true
+	c.wmu.Unlock()
+	l := c.loop
+	return l.poll.Trigger(func() error {
+		return loopCloseWriteReq(l.s, l, c)
+	})
+}
+
+func (c *conn) Close() error {
+	return c.CloseWithError(nil)
+}
+
+func (c *conn) CloseWithError(err error) error {
+	if c.udp {
+		return nil
+	}
+	l := c.loop
+	return l.poll.Trigger(func() error {
+		return loopCloseReq(l.s, l, c, err)
+	})
+}
+
+func (c *conn) AfterFunc(d time.Duration, f func()) Timer {
+	t := &looptimer{l: c.loop, f: f}
+	if !c.udp {
+		t.c = c
+	}
+	t.Reset(d)
+	return t
 }
 
-type writeEvent struct {
-	c    *conn
-	data []byte
+// looptimer is a timer of Conn.AfterFunc or Server.AfterFunc. Its state
+// may change on any goroutine, and the loop matches the wheel timer to the
+// state in a task.
+type looptimer struct {
+	l      *loop
+	c      *conn           // owner connection, nil for loop timers
+	f      func()          // timer function
+	mu     sync.Mutex      // guards active and when
+	active bool            // waiting to fire
+	when   time.Time       // when to fire
+	wt     *internal.Timer // wheel timer, for the loop only
+}
+
+func (t *looptimer) Stop() bool {
+	t.mu.Lock()
+	active := t.active
+	t.active = false
+	t.mu.Unlock()
+	if active {
+		t.l.poll.Trigger(t.schedule)
+	}
+	return active
+}
+
+func (t *looptimer) Reset(d time.Duration) bool {
+	t.mu.Lock()
+	active := t.active
+	t.active = true
+	t.when = time.Now().Add(d)
+	t.mu.Unlock()
+	t.l.poll.Trigger(t.schedule)
+	return active
+}
+
+// schedule matches the wheel timer to the state of the timer.
+func (t *looptimer) schedule() error {
+	l, c := t.l, t.c
+	t.mu.Lock()
+	active, when := t.active, t.when
+	t.mu.Unlock()
+	if active && c != nil {
+		// the dial may still be queued for the connection
+		loopRegisterDials(l.s, l)
+		if l.fdconns[c.fd] != c {
+			// closed or detached
+			t.cancel()
+			return nil
+		}
+	}
+	if !active {
+		if t.wt != nil {
+			t.wt.Stop()
+		}
+		if c != nil {
+			delete(c.timers, t)
+		}
+		return nil
+	}
+	if t.wt == nil {
+		t.wt = l.poll.AfterFunc(time.Until(when), t.fire)
+	} else {
+		t.wt.Reset(time.Until(when))
+	}
+	if c != nil {
+		if c.timers == nil {
+			c.timers = make(map[*looptimer]bool)
+		}
+		c.timers[t] = true
+	}
+	return nil
+}
+
+// cancel stops the timer of a closed or detached connection.
+func (t *looptimer) cancel() {
+	t.mu.Lock()
+	t.active = false
+	t.mu.Unlock()
+	if t.wt != nil {
+		t.wt.Stop()
+	}
+}
+
+func (t *looptimer) fire() error {
+	t.mu.Lock()
+	if !t.active || time.Now().Before(t.when) {
+		// stopped or reset, and a task will schedule it again
+		t.mu.Unlock()
+		return nil
+	}
+	t.active = false
+	t.mu.Unlock()
+	if t.c == nil {
+		return t.l.s.events.runTimer(t.l.stats, nil, t.f)
+	}
+	delete(t.c.timers, t)
+	return t.l.s.events.runTimer(t.l.stats, t.c, t.f)
 }
 
 type server struct {
-	events   Events             // user events
-	loops    []*loop            // all the loops
-	ln       *listener          // all the listeners
-	wg       sync.WaitGroup     // loop close waitgroup
-	cond     *sync.Cond         // shutdown signaler
-	balance  LoadBalance        // load balancing method
-	accepted uintptr            // accept counter
-	tch      chan time.Duration // ticker channel
+	events   Events         // user events
+	loops    []*loop        // all the loops
+	lns      []*listener    // all the listeners
+	wg       sync.WaitGroup // loop close waitgroup
+	cond     *sync.Cond     // shutdown signaler
+	shutdown bool           // shutdown was signaled
+	balance  LoadBalance    // load balancing method
+	accepted uintptr        // accept counter
+	limiter  *connLimiter   // MaxConns and MaxConnsPerIP, or nil
+	acl      atomic.Value   // *ACL, replaced by Server.SetACL
 }
 
 type loop struct {
-	idx     int             // loop index in the server loops list
-	poll    *internal.Poll  // epoll or kqueue
-	packet  []byte          // read packet buffer
-	fdconns map[int]*conn   // loop connections fd -> conn
-	count   int32           // connection count
-	wch     chan writeEvent // write event channel
+	idx     int            // loop index in the server loops list
+	s       *server        // owner server
+	poll    *internal.Poll // epoll or kqueue
+	packet  []byte         // read packet buffer
+	fdconns map[int]*conn  // loop connections fd -> conn
+	proxies map[int]*conn  // connections waiting for a PROXY protocol header
+	count   int32          // connection count
+	mu      sync.Mutex     // guards dials and closed
+	dials   []*conn        // outbound connections waiting to attach
+	closed  bool           // shut down, no more dials
+	stats   *loopStats     // counters of the loop
 }
 
 // waitForShutdown waits for a signal to shutdown
 func (s *server) waitForShutdown() {
 	s.cond.L.Lock()
-	s.cond.Wait()
+	for !s.shutdown {
+		s.cond.Wait()
+	}
 	s.cond.L.Unlock()
 }
 
 // signalShutdown signals a shutdown an begins server closing
 func (s *server) signalShutdown() {
 	s.cond.L.Lock()
+	s.shutdown = true
 	s.cond.Signal()
 	s.cond.L.Unlock()
 }
 
-func serve(events Events, listener *listener) error {
-	// figure out the correct number of loops/goroutines to use.
+func serve(events Events, listeners []*listener, stats []*loopStats) error {
+	// the number of loops/goroutines was set by ServeAddrs.
 	numLoops := events.NumLoops
-	if numLoops <= 0 {
-		if numLoops == 0 {
-			numLoops = 1
-		} else {
-			numLoops = runtime.NumCPU()
-		}
-	}
 
 	s := &server{}
 	s.events = events
-	s.ln = listener
+	s.lns = listeners
 	s.cond = sync.NewCond(&sync.Mutex{})
 	s.balance = events.LoadBalance
-	s.tch = make(chan time.Duration)
+	s.limiter = newConnLimiter(events)
+	s.acl.Store(events.ACL)
+
+	// create loops locally and bind the listeners.
+	for i := 0; i < numLoops; i++ {
+		l := &loop{
+			idx:     i,
+			s:       s,
+			poll:    internal.OpenPoll(),
+			packet:  make([]byte, 0xFFFF),
+			fdconns: make(map[int]*conn),
+			proxies: make(map[int]*conn),
+			stats:   stats[i],
+		}
+		s.loops = append(s.loops, l)
+		for _, ln := range listeners {
+			if err := l.poll.AddRead(ln.fd); err != nil {
+				for _, l := range s.loops {
+					l.poll.Close()
+				}
+				return err
+			}
+		}
+	}
+
+	defer func() {
+		// close loops and all outstanding connections
+		for _, l := range s.loops {
+			l.mu.Lock()
+			l.closed = true
+			l.mu.Unlock()
+			loopRegisterDials(s, l)
+			for _, c := range l.fdconns {
+				loopCloseConn(s, l, c, ErrServerShutdown)
+			}
+			for _, c := range l.proxies {
+				// never opened
+				if c.limited {
+					s.limiter.release(c.limitKey)
+				}
+				syscall.Close(c.fd)
+			}
+			l.poll.Close()
+		}
+	}()
 
 	if s.events.Serving != nil {
 		var svr Server
 		svr.NumLoops = numLoops
-		svr.Addr = listener.lnaddr
+		svr.Addrs = make([]net.Addr, len(listeners))
+		for i, ln := range listeners {
+			svr.Addrs[i] = ln.lnaddr
+		}
+		svr.Addr = svr.Addrs[0]
+		svr.dial = s.dial
+		svr.afterFunc = s.afterFunc
+		svr.stats = stats
+		svr.acl = &s.acl
 		action := s.events.Serving(svr)
 		switch action {
 		case None:
@@ -139,33 +476,13 @@ func serve(events Events, listener *listener) error {
 
 		// notify all loops to close by closing all listeners
 		for _, l := range s.loops {
-			l.poll.FireEvent(internal.EventClose)
+			l.poll.Trigger(func() error { return errClosing })
 		}
 
 		// wait on all loops to complete reading events
 		s.wg.Wait()
-
-		// close loops and all outstanding connections
-		for _, l := range s.loops {
-			for _, c := range l.fdconns {
-				loopCloseConn(s, l, c, nil)
-			}
-			l.poll.Close()
-		}
 	}()
 
-	// create loops locally and bind the listeners.
-	for i := 0; i < numLoops; i++ {
-		l := &loop{
-			idx:     i,
-			poll:    internal.OpenPoll(),
-			packet:  make([]byte, 0xFFFF),
-			fdconns: make(map[int]*conn),
-			wch:     make(chan writeEvent, writeEventBuf),
-		}
-		l.poll.AddRead(listener.fd)
-		s.loops = append(s.loops, l)
-	}
 	// start loops in background
 	s.wg.Add(len(s.loops))
 	for _, l := range s.loops {
@@ -174,7 +491,156 @@ func serve(events Events, listener *listener) error {
 	return nil
 }
 
+// dial creates a non-blocking outbound connection and queues it onto a loop.
+func (s *server) dial(loopIdx int, network, addr string, ctx interface{}) (Conn, error) {
+	sa, err := dialSockaddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	var domain int
+	switch sa.(type) {
+	case *syscall.SockaddrInet4:
+		domain = syscall.AF_INET
+	case *syscall.SockaddrInet6:
+		domain = syscall.AF_INET6
+	case *syscall.SockaddrUnix:
+		domain = syscall.AF_UNIX
+	}
+	fd, err := syscall.Socket(domain,
+		syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Connect(fd, sa); err != nil && err != syscall.EINPROGRESS {
+		syscall.Close(fd)
+		return nil, err
+	}
+	var l *loop
+	if loopIdx >= 0 {
+		l = s.loops[loopIdx]
+	} else {
+		l = s.pickLoop()
+	}
+	c := &conn{fd: fd, sa: sa, addrIndex: -1, outbound: true, ctx: ctx, loop: l}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		syscall.Close(fd)
+		return nil, ErrServerShutdown
+	}
+	l.dials = append(l.dials, c)
+	l.mu.Unlock()
+	err = l.poll.Trigger(func() error {
+		loopRegisterDials(s, l)
+		return nil
+	})
+	if err != nil {
+		// the dial is closed here, unless the loop took it already
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, dc := range l.dials {
+			if dc == c {
+				l.dials = append(l.dials[:i], l.dials[i+1:]...)
+				syscall.Close(fd)
+				return nil, ErrServerShutdown
+			}
+		}
+	}
+	return c, nil
+}
+
+// afterFunc creates a loop timer.
+func (s *server) afterFunc(loopIdx int, d time.Duration, f func()) Timer {
+	t := &looptimer{l: s.loops[loopIdx], f: f}
+	t.Reset(d)
+	return t
+}
+
+// pickLoop returns a loop for a new outbound connection using the load
+// balancing method.
+func (s *server) pickLoop() *loop {
+	switch s.balance {
+	case LeastConnections:
+		l := s.loops[0]
+		for _, lp := range s.loops[1:] {
+			if atomic.LoadInt32(&lp.count) < atomic.LoadInt32(&l.count) {
+				l = lp
+			}
+		}
+		return l
+	case RoundRobin:
+		idx := int(atomic.AddUintptr(&s.accepted, 1)-1) % len(s.loops)
+		return s.loops[idx]
+	default:
+		return s.loops[rand.Intn(len(s.loops))]
+	}
+}
+
+// dialSockaddr resolves the address on the named network.
+func dialSockaddr(network, addr string) (syscall.Sockaddr, error) {
+	switch network {
+	case "unix":
+		return &syscall.SockaddrUnix{Name: addr}, nil
+	case "tcp", "tcp4", "tcp6":
+		taddr, err := net.ResolveTCPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip4 := taddr.IP.To4(); ip4 != nil && network != "tcp6" {
+			sa := &syscall.SockaddrInet4{Port: taddr.Port}
+			copy(sa.Addr[:], ip4)
+			return sa, nil
+		}
+		if taddr.IP == nil {
+			taddr.IP = net.IPv6loopback
+		}
+		sa := &syscall.SockaddrInet6{Port: taddr.Port}
+		copy(sa.Addr[:], taddr.IP.To16())
+		if taddr.Zone != "" {
+			if ifi, err := net.InterfaceByName(taddr.Zone); err == nil {
+				sa.ZoneId = uint32(ifi.Index)
+			}
+		}
+		return sa, nil
+	}
+	return nil, net.UnknownNetworkError(network)
+}
+
+// loopRegisterDials attaches the queued outbound connections to the loop.
+func loopRegisterDials(s *server, l *loop) {
+	l.mu.Lock()
+	dials := l.dials
+	l.dials = nil
+	l.mu.Unlock()
+	for _, c := range dials {
+		l.fdconns[c.fd] = c
+		c.interest = interestRead | interestWrite
+		atomic.AddInt32(&l.count, 1)
+		l.stats.opened(false)
+		if err := l.poll.AddReadWrite(c.fd); err != nil {
+			logConn(s, l, c, slog.LevelError, "poll failed", err)
+			loopCloseConn(s, l, c, closeErr(ErrDialFailed, err))
+		}
+	}
+}
+
 func loopCloseConn(s *server, l *loop, c *conn, err error) error {
+	logConn(s, l, c, slog.LevelDebug, "connection closed", err)
+	l.stats.close()
+	l.stats.queue(-c.queued)
+	if c.limited {
+		s.limiter.release(c.limitKey)
+	}
+	c.closeWrites()
+	c.stopTimers()
+	if c.tls != nil {
+		if len(c.out) == 0 && !c.writeShut && c.tls.closeNotify() {
+			// the close_notify alert, if it can be written without
+			// blocking
+			syscall.Write(c.fd, c.tls.appendOut(nil))
+		}
+		c.tls.close()
+	}
 	atomic.AddInt32(&l.count, -1)
 	delete(l.fdconns, c.fd)
 	syscall.Close(c.fd)
@@ -188,6 +654,46 @@ func loopCloseConn(s *server, l *loop, c *conn, err error) error {
 	return nil
 }
 
+func loopDetachConn(s *server, l *loop, c *conn) error {
+	if s.events.Detached == nil {
+		return loopCloseConn(s, l, c, ErrClosedByHandler)
+	}
+	if err := l.poll.ModDetach(c.fd); err != nil {
+		logConn(s, l, c, slog.LevelWarn, "poll failed", err)
+	}
+	l.stats.close()
+	l.stats.queue(-c.queued)
+	if c.limited {
+		s.limiter.release(c.limitKey)
+	}
+	c.stopTimers()
+	atomic.AddInt32(&l.count, -1)
+	delete(l.fdconns, c.fd)
+	if err := syscall.SetNonblock(c.fd, false); err != nil {
+		logConn(s, l, c, slog.LevelError, "detach failed", err)
+		return err
+	}
+	dc := &detachedConn{fd: c.fd}
+	var rwc io.ReadWriteCloser = dc
+	pending := c.closeWrites()
+	if c.tls != nil {
+		// encrypted on the loop, and written as ciphertext
+		c.tls.write(pending)
+		pending = c.tls.appendOut(nil)
+		c.tls.detach(dc)
+		rwc = c.tls
+	}
+	// written by the first read or write of rwc, which may block, so
+	// that the loop never blocks on a slow peer.
+	dc.pending = pending
+	switch s.events.Detached(c, rwc) {
+	case None:
+	case Shutdown:
+		return errClosing
+	}
+	return nil
+}
+
 func loopRun(s *server, l *loop) {
 	defer func() {
 		s.signalShutdown()
@@ -195,25 +701,49 @@ func loopRun(s *server, l *loop) {
 	}()
 
 	if l.idx == 0 && s.events.Tick != nil {
-		go loopTicker(s, l)
+		// the first tick fires right away
+		l.poll.Trigger(func() error { return loopTick(s, l) })
+	}
+	if s.events.LoopTick != nil {
+		l.poll.Trigger(func() error { return loopLoopTick(s, l) })
 	}
 
-	l.poll.Wait(eventHandler{
+	err := l.poll.Wait(eventHandler{
 		s: s,
 		l: l,
 	})
+	if err == errClosing {
+		s.events.log(slog.LevelInfo, "loop stopped", "loop", l.idx)
+	} else {
+		s.events.log(slog.LevelError, "loop stopped", "loop", l.idx, "err", err)
+	}
 }
 
-func loopTicker(s *server, l *loop) {
-	for {
-		if err := l.poll.FireEvent(internal.EventTick); err != nil {
-			break
-		}
-		time.Sleep(<-s.tch)
+// loopTick fires the Tick event and schedules the next tick.
+func loopTick(s *server, l *loop) error {
+	delay, action := s.events.Tick()
+	switch action {
+	case None:
+	case Shutdown:
+		return errClosing
+	}
+	l.poll.AfterFunc(delay, func() error { return loopTick(s, l) })
+	return nil
+}
+
+// loopLoopTick fires the LoopTick event and schedules the next tick.
+func loopLoopTick(s *server, l *loop) error {
+	delay, action := s.events.LoopTick(l.idx)
+	switch action {
+	case None:
+	case Shutdown:
+		return errClosing
 	}
+	l.poll.AfterFunc(delay, func() error { return loopLoopTick(s, l) })
+	return nil
 }
 
-func loopAccept(s *server, l *loop) error {
+func loopAccept(s *server, l *loop, i int) error {
 	if len(s.loops) > 1 {
 		switch s.balance {
 		case LeastConnections:
@@ -233,98 +763,519 @@ func loopAccept(s *server, l *loop) error {
 			atomic.AddUintptr(&s.accepted, 1)
 		}
 	}
-	nfd, sa, err := syscall.Accept(s.ln.fd)
+	nfd, sa, err := syscall.Accept(s.lns[i].fd)
 	if err != nil {
 		if err == syscall.EAGAIN {
 			return nil
 		}
+		s.events.log(slog.LevelError, "accept failed", "loop", l.idx,
+			"addr", s.lns[i].lnaddr, "err", err)
 		return err
 	}
+	remote := internal.SockaddrToAddr(sa, false)
+	key, err := admit(&s.events, &s.acl, s.limiter, remote)
+	if err != nil {
+		syscall.Close(nfd)
+		s.events.log(slog.LevelInfo, "connection rejected", "loop", l.idx,
+			"fd", nfd, "remote", remote, "err", err)
+		if s.events.Rejected != nil {
+			s.events.Rejected(remote, err)
+		}
+		return nil
+	}
+	c := &conn{fd: nfd, sa: sa, addrIndex: i, loop: l}
+	c.localAddr, c.remoteAddr = s.lns[i].lnaddr, remote
+	c.limited, c.limitKey = s.limiter != nil, key
 	if err := syscall.SetNonblock(nfd, true); err != nil {
-		return err
+		// drop the connection and keep accepting
+		logConn(s, l, c, slog.LevelError, "accept failed", err)
+		syscall.Close(nfd)
+		if c.limited {
+			s.limiter.release(c.limitKey)
+		}
+		return nil
+	}
+	proxy := s.lns[i].opts.proxy != 0
+	if proxy {
+		// opened once the header has been read
+		err = l.poll.AddRead(c.fd)
+	} else {
+		err = l.poll.AddReadWrite(c.fd)
+	}
+	if err != nil {
+		// drop the connection and keep accepting
+		logConn(s, l, c, slog.LevelError, "poll failed", err)
+		syscall.Close(c.fd)
+		if c.limited {
+			s.limiter.release(c.limitKey)
+		}
+		return nil
+	}
+	atomic.AddInt32(&l.count, 1)
+	if proxy {
+		l.proxies[c.fd] = c
+		c.interest = interestRead
+		c.timer = l.poll.AfterFunc(proxyHeaderTimeout, func() error {
+			if l.proxies[c.fd] != c {
+				// opened or rejected
+				return nil
+			}
+			return loopRejectProxy(s, l, c, ErrTimeout)
+		})
+		return nil
 	}
+	l.fdconns[c.fd] = c
+	c.interest = interestRead | interestWrite
+	l.stats.opened(true)
 
-	c := &conn{fd: nfd, sa: sa, loop: l}
+	return nil
+}
+
+// loopReadProxy reads the PROXY protocol header of a connection, which is
+// opened once the header is complete. The input that follows the header
+// is passed to the Data event.
+func loopReadProxy(s *server, l *loop, c *conn) error {
+	n, err := syscall.Read(c.fd, l.packet)
+	if n == 0 || err != nil {
+		if err == syscall.EAGAIN {
+			atomic.AddUint64(&l.stats.eagain, 1)
+			return nil
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return loopRejectProxy(s, l, c, err)
+	}
+	l.stats.read(n)
+	c.proxyIn = append(c.proxyIn, l.packet[:n]...)
+	hdr, hlen, err := parseProxyHeader(c.proxyIn, s.lns[c.addrIndex].opts.proxy)
+	if err != nil {
+		return loopRejectProxy(s, l, c, err)
+	}
+	if hdr == nil {
+		// incomplete
+		return nil
+	}
+	in := c.proxyIn[hlen:]
+	c.proxyIn = nil
+	c.proxy = hdr
+	c.timer.Stop()
+	c.timer = nil
+	if !hdr.Local {
+		c.localAddr, c.remoteAddr = hdr.Destination, hdr.Source
+	}
+	delete(l.proxies, c.fd)
 	l.fdconns[c.fd] = c
-	l.poll.AddReadWrite(c.fd)
-	atomic.AddInt32(&l.count, 1)
+	l.stats.opened(true)
+	if err := loopOpened(s, l, c); err != nil {
+		return err
+	}
+	if len(in) == 0 || l.fdconns[c.fd] != c || c.action != None ||
+		s.events.Data == nil {
+		return nil
+	}
+	out, action := s.events.Data(c, in)
+	c.appendOut(out)
+	c.action = action
+	return loopUpdate(s, l, c)
+}
+
+// loopRejectProxy closes a connection that failed to send a PROXY protocol
+// header.
+func loopRejectProxy(s *server, l *loop, c *conn, err error) error {
+	err = closeErr(ErrProxyHeader, err)
+	logConn(s, l, c, slog.LevelInfo, "connection rejected", err)
+	c.timer.Stop()
+	delete(l.proxies, c.fd)
+	atomic.AddInt32(&l.count, -1)
+	if c.limited {
+		s.limiter.release(c.limitKey)
+	}
+	syscall.Close(c.fd)
+	if s.events.Rejected != nil {
+		s.events.Rejected(c.remoteAddr, err)
+	}
+	return nil
+}
 
+func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
+	n, sa, err := syscall.Recvfrom(fd, l.packet, 0)
+	if err != nil || sa == nil {
+		if err == syscall.EAGAIN {
+			atomic.AddUint64(&l.stats.eagain, 1)
+		}
+		return nil
+	}
+	l.stats.read(n)
+	if s.events.Data != nil {
+		c := &conn{fd: fd, sa: sa, udp: true, addrIndex: lnidx, loop: l}
+		c.localAddr = s.lns[lnidx].lnaddr
+		c.remoteAddr = internal.SockaddrToAddr(sa, true)
+		in := append([]byte{}, l.packet[:n]...)
+		out, action := s.events.Data(c, in)
+		if len(out) > 0 {
+			if err := syscall.Sendto(fd, out, 0, sa); err != nil {
+				logConn(s, l, c, slog.LevelDebug, "write failed", err)
+			} else {
+				l.stats.write(len(out))
+			}
+		}
+		switch action {
+		case Shutdown:
+			return errClosing
+		}
+	}
 	return nil
 }
 
 func loopOpened(s *server, l *loop, c *conn) error {
+	if c.outbound {
+		// the connect has completed, successfully or not.
+		errno, err := syscall.GetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err == nil && errno != 0 {
+			err = syscall.Errno(errno)
+		}
+		if err != nil {
+			return loopCloseConn(s, l, c, closeErr(ErrDialFailed, err))
+		}
+		lsa, _ := syscall.Getsockname(c.fd)
+		c.localAddr = internal.SockaddrToAddr(lsa, false)
+	}
 	c.opened = true
-	c.localAddr = s.ln.lnaddr
-	c.remoteAddr = internal.SockaddrToAddr(c.sa)
+	if c.remoteAddr == nil {
+		c.remoteAddr = internal.SockaddrToAddr(c.sa, false)
+	}
 	if s.events.Opened != nil {
 		out, opts, action := s.events.Opened(c)
-		if len(out) > 0 {
-			c.out = append([]byte(nil), out...)
+		if opts.IdleTimeout > 0 || opts.ReadTimeout > 0 || opts.WriteTimeout > 0 {
+			c.timed = true
+			c.idleTime = opts.IdleTimeout
+			c.readTime = opts.ReadTimeout
+			c.writeTime = opts.WriteTimeout
+			c.readAt = time.Now()
+			c.activeAt = c.readAt
+			loopArmTimer(l, c)
+		}
+		c.highWater = opts.WriteHighWater
+		c.lowWater = min(opts.WriteLowWater, opts.WriteHighWater)
+		c.writeLimit = opts.WriteLimit
+		if opts.ReadRate > 0 {
+			c.readRate = newTokenBucket(opts.ReadRate, time.Now())
+		}
+		if opts.WriteRate > 0 {
+			c.writeRate = newTokenBucket(opts.WriteRate, time.Now())
+		}
+		if opts.TLSConfig != nil {
+			c.tls = newTLSConn(opts.TLSConfig, c.outbound, func() {
+				l.poll.Trigger(func() error { return loopTLS(s, l, c) })
+			})
 		}
+		c.appendOut(out)
 		c.action = action
 		c.reuse = opts.ReuseInputBuffer
 		if opts.TCPKeepAlive > 0 {
-			if _, ok := s.ln.ln.(*net.TCPListener); ok {
+			if _, ok := c.remoteAddr.(*net.TCPAddr); ok {
 				if err := internal.SetKeepAlive(c.fd, int(opts.TCPKeepAlive/time.Second)); err != nil {
+					logConn(s, l, c, slog.LevelError, "keepalive failed", err)
 					return err
 				}
 			}
 		}
 	}
 
-	if len(c.out) == 0 && c.action == None {
-		l.poll.ModRead(c.fd)
-	}
-
-	return nil
+	return loopUpdate(s, l, c)
 }
 
 func loopWrite(s *server, l *loop, c *conn) error {
-	n, err := syscall.Write(c.fd, c.out)
+	out := c.out
+	if c.writeRate != nil && !c.writeThrottled {
+		c.writeRate.refill(time.Now())
+		if n := c.writeRate.available(); n < len(out) {
+			out = out[:n]
+		}
+	}
+	n, err := syscall.Write(c.fd, out)
 	if err != nil {
 		if err == syscall.EAGAIN {
+			atomic.AddUint64(&l.stats.eagain, 1)
 			return nil
 		}
-		return loopCloseConn(s, l, c, err)
+		return loopCloseConn(s, l, c, closeErr(ErrWriteFailed, err))
+	}
+	l.stats.write(n)
+	if c.writeRate != nil {
+		c.writeRate.take(n)
+		if d := c.writeRate.wait(); d > 0 && !c.writeThrottled {
+			loopThrottle(s, l, c, false, d)
+		}
 	}
 
+	if c.timed {
+		c.activeAt = time.Now()
+		c.writeAt = c.activeAt
+	}
 	if n == len(c.out) {
 		c.out = c.out[:0]
 	} else {
 		c.out = append(c.out[:0], c.out[n:]...)
 	}
-	if len(c.out) == 0 && c.action == None {
-		l.poll.ModRead(c.fd)
+	return loopUpdate(s, l, c)
+}
+
+func loopWake(s *server, l *loop, c *conn) error {
+	if s.events.Data == nil {
+		return nil
 	}
+	atomic.AddUint64(&l.stats.wakeups, 1)
+	out, action := s.events.Data(c, nil)
+	c.appendOut(out)
+	c.action = action
+	return loopUpdate(s, l, c)
+}
 
+// loopCloseReq closes a connection for Conn.Close.
+func loopCloseReq(s *server, l *loop, c *conn, err error) error {
+	if err == nil {
+		err = ErrClosedByHandler
+	}
+	// the dial may still be queued for the connection
+	loopRegisterDials(s, l)
+	if l.fdconns[c.fd] != c {
+		// closed or detached
+		return nil
+	}
+	if !c.opened {
+		return loopCloseConn(s, l, c, err)
+	}
+	if c.action == None || c.action == Detach {
+		c.action = Close
+		c.closeErr = err
+	}
+	return loopUpdate(s, l, c)
+}
+
+// loopWritePending takes the output of Write calls for the connection.
+func loopWritePending(s *server, l *loop, c *conn) error {
+	if l.fdconns[c.fd] != c {
+		// closed or detached
+		return nil
+	}
+	if !c.opened {
+		// written once opened, which may enable TLS
+		return nil
+	}
+	c.appendOut(nil)
+	return loopUpdate(s, l, c)
+}
+
+// loopCloseWriteReq shuts down writing for Conn.CloseWrite.
+func loopCloseWriteReq(s *server, l *loop, c *conn) error {
+	// the dial may still be queued for the connection
+	loopRegisterDials(s, l)
+	if l.fdconns[c.fd] != c {
+		// closed or detached
+		return nil
+	}
+	c.closeWrite = true
+	if !c.opened {
+		// shut down once opened
+		return nil
+	}
+	return loopUpdate(s, l, c)
+}
+
+// loopUpdate applies the write limits of the connection and sets its poll
+// interest. The connection is read while it has no pending action and
+// isn't paused by the high water mark, and it's written while it has
+// output or a pending action.
+func loopUpdate(s *server, l *loop, c *conn) error {
+	if c.writeLimit > 0 && len(c.out) > c.writeLimit {
+		return loopCloseConn(s, l, c, ErrSlowConsumer)
+	}
+	if c.closeWrite && !c.writeShut && len(c.out) == 0 && c.tls != nil && c.tls.closeNotify() {
+		// the close_notify alert is written before the shutdown
+		c.out = c.tls.appendOut(c.out)
+	}
+	if c.closeWrite && !c.writeShut && len(c.out) == 0 {
+		c.writeShut = true
+		if err := syscall.Shutdown(c.fd, syscall.SHUT_WR); err != nil {
+			return loopCloseConn(s, l, c, closeErr(ErrWriteFailed, err))
+		}
+	}
+	if c.readEOF && c.writeShut && c.action == None {
+		// both sides are shut down
+		return loopCloseConn(s, l, c, closeErr(ErrPeerClosed, io.EOF))
+	}
+	if len(c.out) > c.highWater {
+		c.paused = true
+	} else if len(c.out) <= c.lowWater {
+		c.paused = false
+	}
+	var interest int
+	if c.action == None && !c.paused && !c.readEOF && !c.readThrottled {
+		interest |= interestRead
+	}
+	if (len(c.out) != 0 || c.action != None) && !c.writeThrottled {
+		interest |= interestWrite
+	}
+	if len(c.out) != c.queued {
+		l.stats.queue(len(c.out) - c.queued)
+		c.queued = len(c.out)
+	}
+	if interest != c.interest {
+		var err error
+		switch interest {
+		case 0:
+			err = l.poll.ModNone(c.fd)
+		case interestRead:
+			err = l.poll.ModRead(c.fd)
+		case interestWrite:
+			err = l.poll.ModWrite(c.fd)
+		default:
+			err = l.poll.ModReadWrite(c.fd)
+		}
+		if err != nil {
+			logConn(s, l, c, slog.LevelError, "poll failed", err)
+			return loopCloseConn(s, l, c, err)
+		}
+		c.interest = interest
+	}
 	return nil
 }
 
+// logConn logs a record about the connection.
+func logConn(s *server, l *loop, c *conn, level slog.Level, msg string, err error) {
+	if s.events.Logger == nil {
+		return
+	}
+	remote := c.remoteAddr
+	if remote == nil && c.sa != nil {
+		remote = internal.SockaddrToAddr(c.sa, c.udp)
+	}
+	args := []interface{}{"loop", l.idx, "fd", c.fd, "remote", remote}
+	if err != nil {
+		args = append(args, "err", err)
+	}
+	s.events.log(level, msg, args...)
+}
+
+// loopThrottle pauses reading or writing the connection until its token
+// bucket has a whole token again.
+func loopThrottle(s *server, l *loop, c *conn, read bool, d time.Duration) {
+	if read {
+		c.readThrottled = true
+	} else {
+		c.writeThrottled = true
+	}
+	l.poll.AfterFunc(d, func() error {
+		if l.fdconns[c.fd] != c {
+			// closed or detached
+			return nil
+		}
+		if read {
+			c.readThrottled = false
+		} else {
+			c.writeThrottled = false
+		}
+		return loopUpdate(s, l, c)
+	})
+}
+
+// loopArmTimer schedules the timeout timer of the connection, unless it's
+// already scheduled to fire before the connection times out. The timer
+// checks the timeouts again when it fires, so that reads and writes only
+// need to update the times.
+func loopArmTimer(l *loop, c *conn) {
+	deadline := c.timeoutDeadline()
+	if deadline.IsZero() || (!c.deadline.IsZero() && !deadline.Before(c.deadline)) {
+		return
+	}
+	c.deadline = deadline
+	d := time.Until(deadline)
+	if c.timer == nil {
+		c.timer = l.poll.AfterFunc(d, func() error {
+			return loopTimeout(l.s, l, c)
+		})
+	} else {
+		c.timer.Reset(d)
+	}
+}
+
+// loopTimeout closes the connection with ErrTimeout when it timed out.
+func loopTimeout(s *server, l *loop, c *conn) error {
+	c.deadline = time.Time{}
+	if l.fdconns[c.fd] != c {
+		// closed or detached
+		return nil
+	}
+	if deadline := c.timeoutDeadline(); deadline.IsZero() || time.Now().Before(deadline) {
+		loopArmTimer(l, c)
+		return nil
+	}
+	return loopCloseConn(s, l, c, ErrTimeout)
+}
+
 func loopAction(s *server, l *loop, c *conn) error {
 	switch c.action {
 	default:
 		c.action = None
 	case Close:
-		return loopCloseConn(s, l, c, nil)
+		if c.closeErr == nil {
+			// returned by an event
+			return loopCloseConn(s, l, c, ErrClosedByHandler)
+		}
+		return loopCloseConn(s, l, c, c.closeErr)
 	case Shutdown:
 		return errClosing
+	case Detach:
+		return loopDetachConn(s, l, c)
 	}
-
-	if len(c.out) == 0 && c.action == None {
-		l.poll.ModRead(c.fd)
-	}
-
-	return nil
+	return loopUpdate(s, l, c)
 }
 
 func loopRead(s *server, l *loop, c *conn) error {
 	var in []byte
-	n, err := syscall.Read(c.fd, l.packet)
+	packet := l.packet
+	if c.readRate != nil && !c.readThrottled {
+		c.readRate.refill(time.Now())
+		if n := c.readRate.available(); n < len(packet) {
+			packet = packet[:n]
+		}
+	}
+	n, err := syscall.Read(c.fd, packet)
 	if n == 0 || err != nil {
 		if err == syscall.EAGAIN {
+			atomic.AddUint64(&l.stats.eagain, 1)
 			return nil
 		}
-		return loopCloseConn(s, l, c, err)
+		if err == nil {
+			if c.tls != nil && !c.readEOF {
+				// reported by the engine once it has processed the
+				// rest of the input
+				c.readEOF = true
+				c.tls.feedEOF()
+				return loopUpdate(s, l, c)
+			}
+			if !c.readEOF && s.events.ReadEOF != nil {
+				return loopReadEOF(s, l, c)
+			}
+			err = io.EOF
+		}
+		return loopCloseConn(s, l, c, closeErr(ErrPeerClosed, err))
+	}
+	l.stats.read(n)
+	if c.readRate != nil {
+		c.readRate.take(n)
+		if d := c.readRate.wait(); d > 0 && !c.readThrottled {
+			loopThrottle(s, l, c, true, d)
+		}
+	}
+	if c.timed {
+		c.readAt = time.Now()
+		c.activeAt = c.readAt
+	}
+	if c.tls != nil {
+		return loopReadTLS(s, l, c, l.packet[:n])
 	}
 	in = l.packet[:n]
 	if !c.reuse {
@@ -332,17 +1283,70 @@ func loopRead(s *server, l *loop, c *conn) error {
 	}
 	if s.events.Data != nil {
 		out, action := s.events.Data(c, in)
+		c.appendOut(out)
 		c.action = action
-		if len(out) > 0 {
-			c.out = append([]byte(nil), out...)
-		}
 	}
+	return loopUpdate(s, l, c)
+}
 
-	if len(c.out) != 0 || c.action != None {
-		l.poll.ModReadWrite(c.fd)
+// loopReadTLS passes ciphertext to the TLS engine of the connection, which
+// wakes the loop with loopTLS once it has processed it.
+func loopReadTLS(s *server, l *loop, c *conn, data []byte) error {
+	c.tls.feed(data)
+	return loopUpdate(s, l, c)
+}
+
+// loopTLS writes the output of the TLS engine of the connection, such as
+// the handshake, and passes its plaintext to the Data event. A connection
+// that failed the handshake is closed once the alert has been written, if
+// it can be written without blocking.
+func loopTLS(s *server, l *loop, c *conn) error {
+	if l.fdconns[c.fd] != c {
+		// closed or detached
+		return nil
+	}
+	if c.action != None {
+		// no more Data events, and the plaintext is left to Detach
+		c.appendOut(nil)
+		return loopUpdate(s, l, c)
 	}
+	in, err := c.tls.read()
+	c.appendOut(nil)
+	if len(in) > 0 && s.events.Data != nil {
+		out, action := s.events.Data(c, in)
+		c.appendOut(out)
+		c.action = action
+	}
+	if err == errTLSEOF {
+		// the peer shut down the socket without a close_notify alert
+		switch {
+		case c.action != None:
+			return loopUpdate(s, l, c)
+		case s.events.ReadEOF != nil:
+			return loopReadEOF(s, l, c)
+		}
+		err = io.EOF
+	}
+	if err != nil {
+		if len(c.out) > 0 {
+			syscall.Write(c.fd, c.out)
+		}
+		if !errors.Is(err, ErrTLSHandshake) {
+			// a close_notify alert is io.EOF
+			err = closeErr(ErrPeerClosed, err)
+		}
+		return loopCloseConn(s, l, c, err)
+	}
+	return loopUpdate(s, l, c)
+}
 
-	return nil
+// loopReadEOF fires the ReadEOF event once the peer shuts down writing.
+func loopReadEOF(s *server, l *loop, c *conn) error {
+	c.readEOF = true
+	out, action := s.events.ReadEOF(c)
+	c.appendOut(out)
+	c.action = action
+	return loopUpdate(s, l, c)
 }
 
 func (ln *listener) close() {
@@ -355,6 +1359,9 @@ func (ln *listener) close() {
 	if ln.ln != nil {
 		ln.ln.Close()
 	}
+	if ln.pconn != nil {
+		ln.pconn.Close()
+	}
 	if ln.network == "unix" {
 		os.RemoveAll(ln.addr)
 	}
@@ -365,6 +1372,11 @@ func (ln *listener) close() {
 func (ln *listener) system() error {
 	var err error
 	switch netln := ln.ln.(type) {
+	case nil:
+		switch pconn := ln.pconn.(type) {
+		case *net.UDPConn:
+			ln.f, err = pconn.File()
+		}
 	case *net.TCPListener:
 		ln.f, err = netln.File()
 	case *net.UnixListener:
@@ -383,49 +1395,109 @@ type eventHandler struct {
 	l *loop
 }
 
-func (h eventHandler) OnEvent(event uint64) error {
-	switch event {
-	case internal.EventClose:
-		return errClosing
-	case internal.EventTick:
-		delay, action := h.s.events.Tick()
-		switch action {
-		case None:
-		case Shutdown:
-			return errClosing
-		}
-		h.s.tch <- delay
-	case internal.EventWrite:
-		select {
-		case wevent := <-h.l.wch:
-			wevent.c.out = append(wevent.c.out, wevent.data...)
-			h.l.poll.ModReadWrite(wevent.c.fd)
-		default:
-			// if nothing, continue
-		}
-	}
-
-	return nil
-}
-
-func (h eventHandler) OnFdEvent(fd int) error {
+func (h eventHandler) OnFdEvent(fd int, events uint32) error {
 	c := h.l.fdconns[fd]
 	if c == nil {
-		return loopAccept(h.s, h.l)
+		if c := h.l.proxies[fd]; c != nil {
+			return loopReadProxy(h.s, h.l, c)
+		}
+		for i, ln := range h.s.lns {
+			if ln.fd == fd {
+				if ln.pconn != nil {
+					return loopUDPRead(h.s, h.l, i, fd)
+				}
+				return loopAccept(h.s, h.l, i)
+			}
+		}
+		return nil
 	}
 
 	switch {
 	case !c.opened:
 		return loopOpened(h.s, h.l, c)
-	case len(c.out) != 0:
+	case len(c.out) != 0 && events&writeEvents != 0 && !c.writeThrottled:
 		return loopWrite(h.s, h.l, c)
-	case c.action != None:
+	case len(c.out) == 0 && c.action != None:
 		return loopAction(h.s, h.l, c)
-	default:
+	case c.interest&interestRead != 0 && events&readEvents != 0:
+		return loopRead(h.s, h.l, c)
+	case events&(syscall.EPOLLERR|syscall.EPOLLHUP) != 0:
+		// the peer closed a half-closed, paused or throttled connection.
+		// the output of a connection that's over its write rate is not
+		// written, and the read fails or sees the EOF.
 		return loopRead(h.s, h.l, c)
 	}
+	return nil
+}
+
+func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
+	return reuseport.ListenPacket(proto, addr)
 }
 
 func reuseportListen(proto, addr string) (l net.Listener, err error) {
 	return reuseport.Listen(proto, addr)
 }
+
+type detachedConn struct {
+	fd      int
+	mu      sync.Mutex // guards pending
+	pending []byte     // output of Write calls that was not yet written
+}
+
+// flush writes the output that was pending when the connection was
+// detached, before anything else is read or written.
+func (c *detachedConn) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.pending) > 0 {
+		n, err := syscall.Write(c.fd, c.pending)
+		if err != nil {
+			return err
+		}
+		c.pending = c.pending[n:]
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *detachedConn) Close() error {
+	c.flush()
+	err := syscall.Close(c.fd)
+	if err != nil {
+		return err
+	}
+	c.fd = -1
+	return nil
+}
+
+func (c *detachedConn) Read(p []byte) (n int, err error) {
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	n, err = syscall.Read(c.fd, p)
+	if err != nil {
+		return n, err
+	}
+	if n == 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *detachedConn) Write(p []byte) (n int, err error) {
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	for len(p) > 0 {
+		nn, err := syscall.Write(c.fd, p)
+		if err != nil {
+			return n, err
+		}
+		n += nn
+		p = p[nn:]
+	}
+	return n, nil
+}
@@ -16,6 +16,9 @@ func (ln *listener) close() {
 	if ln.ln != nil {
 		ln.ln.Close()
 	}
+	if ln.pconn != nil {
+		ln.pconn.Close()
+	}
 	if ln.network == "unix" {
 		os.RemoveAll(ln.addr)
 	}
@@ -25,8 +28,8 @@ func (ln *listener) system() error {
 	return nil
 }
 
-func serve(events Events, listener *listener) error {
-	return stdserve(events, listener)
+func serve(events Events, listeners []*listener, stats []*loopStats) error {
+	return stdserve(events, listeners, stats)
 }
 
 func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
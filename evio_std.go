@@ -5,10 +5,11 @@
 package evio
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
+	"log/slog"
 	"net"
-	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,41 +17,450 @@ import (
 
 var errClosing = errors.New("closing")
 var errCloseConns = errors.New("close conns")
+var errConnClosed = errors.New("connection closed")
 
 type stdserver struct {
-	events   Events         // user events
-	loops    []*stdloop     // all the loops
-	ln       *listener      // all the listeners
-	loopwg   sync.WaitGroup // loop close waitgroup
-	lnwg     sync.WaitGroup // listener close waitgroup
-	cond     *sync.Cond     // shutdown signaler
-	serr     error          // signal error
-	accepted uintptr        // accept counter
+	events   Events            // user events
+	loops    []*stdloop        // all the loops
+	lns      []*listener       // all the listeners
+	loopwg   sync.WaitGroup    // loop close waitgroup
+	lnwg     sync.WaitGroup    // listener close waitgroup
+	cond     *sync.Cond        // shutdown signaler
+	serr     error             // signal error
+	shutdown bool              // shutdown was signaled
+	accepted uintptr           // accept counter
+	limiter  *connLimiter      // MaxConns and MaxConnsPerIP, or nil
+	acl      atomic.Value      // *ACL, replaced by Server.SetACL
+	proxies  map[*stdconn]bool // connections reading a PROXY protocol header
 }
 
 type stdloop struct {
-	idx   int               // loop index
-	ch    chan interface{}  // command channel
-	conns map[*stdconn]bool // track all the conns bound to this loop
+	idx    int               // loop index
+	ch     chan interface{}  // command channel
+	conns  map[*stdconn]bool // track all the conns bound to this loop
+	mu     sync.Mutex        // guards wakes, closes and timers
+	wakes  []*stdconn        // connections waiting for a wake event
+	ending int               // connections waiting for their writers to end
+	closes []stdcloseReq     // connections waiting to close
+	timers []*stdtimer       // expired timers waiting to fire
+	pendch chan struct{}     // wake and close notification channel
+	done   chan struct{}     // closed once the loop has stopped receiving
+	stats  *loopStats        // counters of the loop
 }
 
 type stdconn struct {
-	localAddr  net.Addr
-	remoteAddr net.Addr
-	conn       net.Conn    // original connection
-	ctx        interface{} // user-defined context
-	loop       *stdloop    // owner loop
-	donein     []byte      // extra data for done connection
-	done       int32       // 0: attached, 1: closed
+	writeAt       int64 // last write in unix nanoseconds, for the idle timeout
+	addrIndex     int
+	outbound      bool
+	limited       bool   // counted by the server limiter
+	limitKey      string // limiter key of the remote IP
+	localAddr     net.Addr
+	remoteAddr    net.Addr
+	conn          net.Conn             // original connection
+	pconn         net.PacketConn       // udp listener, for udp senders only
+	ctx           interface{}          // user-defined context
+	loop          *stdloop             // owner loop
+	donein        []byte               // extra data for done connection
+	closeReq      bool                 // Close was called before opening
+	closeErr      error                // error for the Closed event
+	wmu           sync.Mutex           // guards the writer and reader state
+	wcond         *sync.Cond           // signals the reader to resume
+	wbuf          []byte               // queued output
+	wsize         int                  // size of the queued and unwritten output
+	paused        bool                 // reads paused by the high water mark
+	wclosed       bool                 // closed or detached, no more writes
+	wshut         bool                 // CloseWrite was called, no more writes
+	shutReq       bool                 // shut down writing once the output is written
+	writeShut     bool                 // writing was shut down
+	closeWriteReq bool                 // CloseWrite was called before opening
+	werr          error                // last write error
+	rerr          error                // error that stopped the reader
+	wch           chan struct{}        // writer notification channel
+	timers        map[*stdtimer]bool   // active AfterFunc timers
+	done          int32                // 0: attached, 1: closed, 2: detached
+	idleTime      time.Duration        // idle timeout
+	readTime      time.Duration        // read timeout
+	writeTime     time.Duration        // write timeout
+	highWater     int                  // pause reads above this much output
+	lowWater      int                  // resume reads at this much output
+	writeLimit    int                  // close above this much output
+	readRate      *tokenBucket         // ReadRate, used by the reader
+	writeRate     *tokenBucket         // WriteRate, used by the writer
+	proxy         *ProxyHeader         // PROXY protocol header
+	proxyIn       []byte               // input that followed the PROXY protocol header
+	tlsState      *tls.ConnectionState // set by the reader once the TLS handshake is complete
 }
 
 func (c *stdconn) Context() interface{}       { return c.ctx }
 func (c *stdconn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *stdconn) AddrIndex() int             { return c.addrIndex }
+func (c *stdconn) LoopIndex() int             { return c.loop.idx }
+func (c *stdconn) Outbound() bool             { return c.outbound }
 func (c *stdconn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *stdconn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *stdconn) ProxyHeader() *ProxyHeader  { return c.proxy }
+func (c *stdconn) TLS() *tls.ConnectionState {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.tlsState
+}
+func (c *stdconn) Wake() {
+	if c.pconn != nil {
+		return
+	}
+	l := c.loop
+	l.mu.Lock()
+	l.wakes = append(l.wakes, c)
+	l.mu.Unlock()
+	select {
+	case l.pendch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *stdconn) Close() error {
+	return c.CloseWithError(nil)
+}
+
+func (c *stdconn) CloseWithError(err error) error {
+	if c.pconn != nil {
+		return nil
+	}
+	l := c.loop
+	l.mu.Lock()
+	l.closes = append(l.closes, stdcloseReq{c, err, false})
+	l.mu.Unlock()
+	select {
+	case l.pendch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *stdconn) AfterFunc(d time.Duration, f func()) Timer {
+	t := &stdtimer{l: c.loop, f: f}
+	if c.pconn == nil {
+		t.c = c
+	}
+	t.Reset(d)
+	return t
+}
+
+// stdtimer is a timer of Conn.AfterFunc or Server.AfterFunc. It expires
+// on a time.Timer goroutine and fires on the loop.
+type stdtimer struct {
+	l      *stdloop
+	c      *stdconn    // owner connection, nil for loop timers
+	f      func()      // timer function
+	mu     sync.Mutex  // guards active, when and t
+	active bool        // waiting to fire
+	when   time.Time   // when to fire
+	t      *time.Timer // runs expire
+}
+
+func (t *stdtimer) Stop() bool {
+	t.mu.Lock()
+	active := t.active
+	t.active = false
+	if t.t != nil {
+		t.t.Stop()
+	}
+	t.mu.Unlock()
+	if t.c != nil {
+		t.c.wmu.Lock()
+		delete(t.c.timers, t)
+		t.c.wmu.Unlock()
+	}
+	return active
+}
+
+func (t *stdtimer) Reset(d time.Duration) bool {
+	if c := t.c; c != nil {
+		c.wmu.Lock()
+		if c.wclosed {
+			// closed or detached
+			c.wmu.Unlock()
+			return t.Stop()
+		}
+		if c.timers == nil {
+			c.timers = make(map[*stdtimer]bool)
+		}
+		c.timers[t] = true
+		c.wmu.Unlock()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := t.active
+	t.active = true
+	t.when = time.Now().Add(d)
+	if t.t == nil {
+		t.t = time.AfterFunc(d, t.expire)
+	} else {
+		t.t.Reset(d)
+	}
+	return active
+}
+
+// expire queues the timer to fire on the loop.
+func (t *stdtimer) expire() {
+	l := t.l
+	l.mu.Lock()
+	l.timers = append(l.timers, t)
+	l.mu.Unlock()
+	select {
+	case l.pendch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *stdconn) CloseWrite() error {
+	if c.pconn != nil {
+		return nil
+	}
+	c.wmu.Lock()
+	c.wshut = true
+	c.wmu.Unlock()
+	// the loop shuts down writing after the output of the current event
+	l := c.loop
+	l.mu.Lock()
+	l.closes = append(l.closes, stdcloseReq{c, nil, true})
+	l.mu.Unlock()
+	select {
+	case l.pendch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+type stdcloseReq struct {
+	c     *stdconn
+	err   error
+	write bool // CloseWrite
+}
+
 func (c *stdconn) Write(data []byte) error {
-	_, err := c.conn.Write(data)
-	return err
+	if c.pconn != nil {
+		n, err := c.pconn.WriteTo(data, c.remoteAddr)
+		if n > 0 {
+			c.loop.stats.write(n)
+		}
+		return err
+	}
+	c.wmu.Lock()
+	shut := c.wshut
+	c.wmu.Unlock()
+	if shut {
+		return errConnClosed
+	}
+	return c.queue(data)
+}
+
+// queue queues the data for the writer. The out values of events are
+// queued even after CloseWrite was called during the event.
+func (c *stdconn) queue(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	c.wmu.Lock()
+	if c.wclosed {
+		c.wmu.Unlock()
+		return errConnClosed
+	}
+	c.wbuf = append(c.wbuf, data...)
+	c.wsize += len(data)
+	c.loop.stats.queue(len(data))
+	if c.wsize > c.highWater {
+		c.paused = true
+	}
+	if c.writeLimit > 0 && c.wsize > c.writeLimit && c.werr == nil {
+		// the writer closes the connection
+		c.werr = ErrSlowConsumer
+	}
+	c.wmu.Unlock()
+	select {
+	case c.wch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// closeWrites stops accepting Write calls, and has the writer end once it
+// has written the queued output.
+func (c *stdconn) closeWrites() {
+	c.wmu.Lock()
+	c.wclosed = true
+	timers := c.timers
+	c.timers = nil
+	c.wcond.Broadcast()
+	c.wmu.Unlock()
+	for t := range timers {
+		t.Stop()
+	}
+	select {
+	case c.wch <- struct{}{}:
+	default:
+	}
+}
+
+// stdend is a connection whose writer has ended.
+type stdend struct {
+	c *stdconn
+}
+
+// stdconnWriter writes the queued output of the connection in call order,
+// so that Write never blocks. Once the connection is closed or detached
+// and all output has been written, it closes the connection, unless it's
+// handed to the Detached event, and passes it back to the loop. The loop
+// never waits for a slow peer.
+func stdconnWriter(s *stdserver, c *stdconn) {
+	var buf []byte
+	var failed bool
+	for {
+		<-c.wch
+		c.wmu.Lock()
+		buf, c.wbuf = c.wbuf, buf[:0]
+		closed, shut, err := c.wclosed, c.shutReq && !c.writeShut, c.werr
+		dropped := c.writeShut // nowhere to write
+		c.wmu.Unlock()
+		if len(buf) > 0 && err == nil {
+			if !dropped {
+				if err = c.write(buf); err != nil && err != ErrTimeout {
+					err = closeErr(ErrWriteFailed, err)
+				}
+			}
+			c.wmu.Lock()
+			if err != nil {
+				c.werr = err
+			}
+			c.wsize -= len(buf)
+			if c.paused && c.wsize <= c.lowWater {
+				c.paused = false
+				c.wcond.Broadcast()
+			}
+			c.wmu.Unlock()
+		}
+		if len(buf) > 0 {
+			c.loop.stats.queue(-len(buf))
+		}
+		if shut && err == nil {
+			if conn, ok := c.conn.(interface{ CloseWrite() error }); ok {
+				if err = conn.CloseWrite(); err != nil {
+					err = closeErr(ErrWriteFailed, err)
+				}
+			}
+			c.wmu.Lock()
+			c.writeShut = true
+			if err != nil {
+				c.werr = err
+			}
+			c.wcond.Broadcast()
+			c.wmu.Unlock()
+		}
+		if err != nil && !failed {
+			// fail the reader, which closes the connection
+			failed = true
+			c.resumeReads()
+			c.conn.Close()
+		}
+		if closed {
+			if c.writeTime > 0 {
+				c.conn.SetWriteDeadline(time.Time{})
+			}
+			if atomic.LoadInt32(&c.done) != 2 || s.events.Detached == nil {
+				c.conn.Close()
+			}
+			c.loop.ch <- &stdend{c}
+			return
+		}
+	}
+}
+
+// write writes the output, failing with ErrTimeout when a chunk of it is
+// not written within the write timeout.
+func (c *stdconn) write(buf []byte) error {
+	for len(buf) > 0 {
+		chunk := buf
+		if c.writeRate != nil {
+			c.wmu.Lock()
+			closing := c.wclosed
+			c.wmu.Unlock()
+			if !closing {
+				// the output is flushed without pacing once closing,
+				// so that the rate doesn't hold up the Closed event.
+				c.writeRate.refill(time.Now())
+				if d := c.writeRate.wait(); d > 0 {
+					time.Sleep(d)
+					c.writeRate.refill(time.Now())
+				}
+				if n := c.writeRate.available(); n < len(chunk) {
+					chunk = chunk[:n]
+				}
+			}
+		}
+		if c.writeTime > 0 {
+			if len(chunk) > 0xFFFF {
+				chunk = chunk[:0xFFFF]
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTime))
+		}
+		n, err := c.conn.Write(chunk)
+		if n > 0 {
+			c.loop.stats.write(n)
+			if c.writeRate != nil {
+				c.writeRate.take(n)
+			}
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return ErrTimeout
+			}
+			return err
+		}
+		if c.idleTime > 0 {
+			atomic.StoreInt64(&c.writeAt, time.Now().UnixNano())
+		}
+		buf = buf[len(chunk):]
+	}
+	return nil
+}
+
+// closeWrite has the writer shut down writing once the queued output is
+// written.
+func (c *stdconn) closeWrite() {
+	c.wmu.Lock()
+	c.shutReq = true
+	c.wmu.Unlock()
+	select {
+	case c.wch <- struct{}{}:
+	default:
+	}
+}
+
+// resumeReads wakes a paused reader, which then sees that the connection
+// is closing or failed.
+func (c *stdconn) resumeReads() {
+	c.wmu.Lock()
+	c.wcond.Broadcast()
+	c.wmu.Unlock()
+}
+
+// readDeadline returns the read deadline for the idle and read timeouts,
+// or zero when the connection has neither.
+func (c *stdconn) readDeadline(readAt time.Time) time.Time {
+	var deadline time.Time
+	if c.readTime > 0 {
+		deadline = readAt.Add(c.readTime)
+	}
+	if c.idleTime > 0 {
+		activeAt := readAt
+		if writeAt := atomic.LoadInt64(&c.writeAt); writeAt > readAt.UnixNano() {
+			activeAt = time.Unix(0, writeAt)
+		}
+		if t := activeAt.Add(c.idleTime); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return deadline
 }
 
 type stdin struct {
@@ -58,15 +468,28 @@ type stdin struct {
 	in []byte
 }
 
+type stdeof struct {
+	c *stdconn
+}
+
 type stderr struct {
 	c   *stdconn
 	err error
 }
 
+// stdreject is a connection that was closed for being over a limit, for
+// being denied or for an invalid PROXY protocol header.
+type stdreject struct {
+	remote net.Addr
+	err    error
+}
+
 // waitForShutdown waits for a signal to shutdown
 func (s *stdserver) waitForShutdown() error {
 	s.cond.L.Lock()
-	s.cond.Wait()
+	for !s.shutdown {
+		s.cond.Wait()
+	}
 	err := s.serr
 	s.cond.L.Unlock()
 	return err
@@ -75,43 +498,61 @@ func (s *stdserver) waitForShutdown() error {
 // signalShutdown signals a shutdown an begins server closing
 func (s *stdserver) signalShutdown(err error) {
 	s.cond.L.Lock()
-	s.serr = err
+	if !s.shutdown {
+		s.serr = err
+		s.shutdown = true
+		for c := range s.proxies {
+			// stop reading the header
+			c.conn.Close()
+		}
+	}
 	s.cond.Signal()
 	s.cond.L.Unlock()
 }
 
-func stdserve(events Events, listener *listener) error {
-	numLoops := events.NumLoops
-	if numLoops <= 0 {
-		if numLoops == 0 {
-			numLoops = 1
-		} else {
-			numLoops = runtime.NumCPU()
-		}
-	}
+func stdserve(events Events, listeners []*listener, stats []*loopStats) error {
+	numLoops := events.NumLoops // set by ServeAddrs
 
 	s := &stdserver{}
 	s.events = events
-	s.ln = listener
+	s.lns = listeners
 	s.cond = sync.NewCond(&sync.Mutex{})
+	s.limiter = newConnLimiter(events)
+	s.acl.Store(events.ACL)
+	s.proxies = make(map[*stdconn]bool)
 
+	for i := 0; i < numLoops; i++ {
+		s.loops = append(s.loops, &stdloop{
+			idx:    i,
+			ch:     make(chan interface{}),
+			conns:  make(map[*stdconn]bool),
+			pendch: make(chan struct{}, 1),
+			done:   make(chan struct{}),
+			stats:  stats[i],
+		})
+	}
 	if events.Serving != nil {
 		var svr Server
 		svr.NumLoops = numLoops
-		svr.Addr = listener.lnaddr
+		svr.Addrs = make([]net.Addr, len(listeners))
+		for i, ln := range listeners {
+			svr.Addrs[i] = ln.lnaddr
+		}
+		svr.Addr = svr.Addrs[0]
+		svr.dial = s.dial
+		svr.afterFunc = s.afterFunc
+		svr.stats = stats
+		svr.acl = &s.acl
 		action := events.Serving(svr)
 		switch action {
 		case Shutdown:
+			// the loops never ran
+			for _, l := range s.loops {
+				close(l.done)
+			}
 			return nil
 		}
 	}
-	for i := 0; i < numLoops; i++ {
-		s.loops = append(s.loops, &stdloop{
-			idx:   i,
-			ch:    make(chan interface{}),
-			conns: make(map[*stdconn]bool),
-		})
-	}
 	var ferr error
 	defer func() {
 		// wait on a signal for shutdown
@@ -125,8 +566,10 @@ func stdserve(events Events, listener *listener) error {
 		// wait on all loops to main loop channel events
 		s.loopwg.Wait()
 
-		// shutdown the listener
-		s.ln.close()
+		// shutdown all listeners
+		for i := 0; i < len(s.lns); i++ {
+			s.lns[i].close()
+		}
 
 		// wait on all listeners to complete
 		s.lnwg.Wait()
@@ -143,18 +586,44 @@ func stdserve(events Events, listener *listener) error {
 	for i := 0; i < numLoops; i++ {
 		go stdloopRun(s, s.loops[i])
 	}
-	s.lnwg.Add(1)
-	go stdlistenerRun(s, listener)
+	s.lnwg.Add(len(listeners))
+	for i := 0; i < len(listeners); i++ {
+		go stdlistenerRun(s, listeners[i], i)
+	}
 	return ferr
 }
 
-func stdlistenerRun(s *stdserver, ln *listener) {
+func stdlistenerRun(s *stdserver, ln *listener, lnidx int) {
 	var ferr error
 	defer func() {
+		s.cond.L.Lock()
+		shutdown := s.shutdown
+		s.cond.L.Unlock()
+		if !shutdown {
+			// not closed by the shutdown
+			s.events.log(slog.LevelError, "accept failed", "addr", ln.lnaddr,
+				"err", ferr)
+		}
 		s.signalShutdown(ferr)
 		s.lnwg.Done()
 	}()
+	var packet [0xFFFF]byte
 	for {
+		if ln.pconn != nil {
+			// udp
+			n, addr, err := ln.pconn.ReadFrom(packet[:])
+			if err != nil {
+				ferr = err
+				return
+			}
+			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+			c := &stdconn{pconn: ln.pconn, loop: l, addrIndex: lnidx}
+			c.localAddr = ln.lnaddr
+			c.remoteAddr = addr
+			l.stats.read(n)
+			l.ch <- &stdin{c, append([]byte{}, packet[:n]...)}
+			continue
+		}
 		// tcp
 		conn, err := ln.ln.Accept()
 		if err != nil {
@@ -162,52 +631,250 @@ func stdlistenerRun(s *stdserver, ln *listener) {
 			return
 		}
 		l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
-		c := &stdconn{conn: conn, loop: l}
+		key, err := admit(&s.events, &s.acl, s.limiter, conn.RemoteAddr())
+		if err != nil {
+			conn.Close()
+			l.ch <- &stdreject{conn.RemoteAddr(), err}
+			continue
+		}
+		c := &stdconn{conn: conn, loop: l, addrIndex: lnidx,
+			wch: make(chan struct{}, 1)}
+		c.wcond = sync.NewCond(&c.wmu)
+		c.limited, c.limitKey = s.limiter != nil, key
+		if ln.opts.proxy != 0 {
+			s.cond.L.Lock()
+			if s.shutdown {
+				s.cond.L.Unlock()
+				conn.Close()
+				if c.limited {
+					s.limiter.release(c.limitKey)
+				}
+				continue
+			}
+			s.proxies[c] = true
+			s.lnwg.Add(1)
+			s.cond.L.Unlock()
+			go stdproxyRun(s, l, ln, c)
+			continue
+		}
 		l.ch <- c
-		go func(c *stdconn) {
-			var packet [0xFFFF]byte
-			for {
-				n, err := c.conn.Read(packet[:])
-				if err != nil {
-					c.conn.SetReadDeadline(time.Time{})
-					l.ch <- &stderr{c, err}
-					return
+	}
+}
+
+// stdproxyRun reads the PROXY protocol header of an accepted connection,
+// and then passes the connection to its loop.
+func stdproxyRun(s *stdserver, l *stdloop, ln *listener, c *stdconn) {
+	defer s.lnwg.Done()
+	var hdr *ProxyHeader
+	var buf []byte
+	var hlen int
+	var err error
+	packet := make([]byte, 4096)
+	c.conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	for hdr == nil && err == nil {
+		var n int
+		n, err = c.conn.Read(packet)
+		if n > 0 {
+			l.stats.read(n)
+			buf = append(buf, packet[:n]...)
+			hdr, hlen, err = parseProxyHeader(buf, ln.opts.proxy)
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = ErrTimeout
+		}
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	s.cond.L.Lock()
+	delete(s.proxies, c)
+	shutdown := s.shutdown
+	s.cond.L.Unlock()
+	if err != nil || shutdown {
+		c.conn.Close()
+		if c.limited {
+			s.limiter.release(c.limitKey)
+		}
+		if !shutdown {
+			l.ch <- &stdreject{c.conn.RemoteAddr(), closeErr(ErrProxyHeader, err)}
+		}
+		return
+	}
+	c.proxy = hdr
+	c.proxyIn = buf[hlen:]
+	if !hdr.Local {
+		c.localAddr, c.remoteAddr = hdr.Destination, hdr.Source
+	}
+	l.ch <- c
+}
+
+// stdconnRun reads from the connection and passes the input to the loop.
+func stdconnRun(s *stdserver, l *stdloop, c *stdconn) {
+	var packet [0xFFFF]byte
+	timed := c.idleTime > 0 || c.readTime > 0
+	readAt := time.Now()
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		if timed {
+			c.conn.SetReadDeadline(c.readDeadline(readAt))
+		}
+		if err := tc.Handshake(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = ErrTimeout
+			} else {
+				err = closeErr(ErrTLSHandshake, err)
+			}
+			l.ch <- &stderr{c, err}
+			return
+		}
+		state := tc.ConnectionState()
+		c.wmu.Lock()
+		c.tlsState = &state
+		c.wmu.Unlock()
+	}
+	for {
+		c.wmu.Lock()
+		for c.paused && c.werr == nil && !c.wclosed && atomic.LoadInt32(&c.done) == 0 {
+			// wait for the writer to drain the output
+			c.wcond.Wait()
+		}
+		c.wmu.Unlock()
+		buf := packet[:]
+		if c.readRate != nil {
+			c.readRate.refill(time.Now())
+			if d := c.readRate.wait(); d > 0 && atomic.LoadInt32(&c.done) == 0 {
+				// over the read rate
+				time.Sleep(d)
+				c.readRate.refill(time.Now())
+			}
+			if n := c.readRate.available(); n > 0 && n < len(buf) {
+				buf = buf[:n]
+			}
+		}
+		if timed {
+			c.conn.SetReadDeadline(c.readDeadline(readAt))
+			if atomic.LoadInt32(&c.done) != 0 {
+				// the loop is closing or detaching the connection, and
+				// the deadline above may have replaced its deadline.
+				c.conn.SetReadDeadline(time.Now())
+			}
+		}
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && timed &&
+				atomic.LoadInt32(&c.done) == 0 {
+				if time.Now().Before(c.readDeadline(readAt)) {
+					// written to since the deadline was set
+					continue
+				}
+				err = ErrTimeout
+			}
+			c.conn.SetReadDeadline(time.Time{})
+			if err == io.EOF && s.events.ReadEOF != nil && atomic.LoadInt32(&c.done) == 0 {
+				l.ch <- &stdeof{c}
+				// wait for the connection to close, detach or shut down
+				// writing too.
+				c.wmu.Lock()
+				for !c.writeShut && c.werr == nil && atomic.LoadInt32(&c.done) == 0 {
+					c.wcond.Wait()
 				}
-				l.ch <- &stdin{c, append([]byte{}, packet[:n]...)}
+				c.wmu.Unlock()
 			}
-		}(c)
+			l.ch <- &stderr{c, err}
+			return
+		}
+		l.stats.read(n)
+		if c.readRate != nil {
+			c.readRate.take(n)
+		}
+		if timed {
+			readAt = time.Now()
+		}
+		l.ch <- &stdin{c, append([]byte{}, packet[:n]...)}
+	}
+}
+
+// dial creates an outbound connection in the background and passes it to
+// a loop once connected.
+func (s *stdserver) dial(loopIdx int, network, addr string, ctx interface{}) (Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		taddr, err := net.ResolveTCPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = taddr.String()
+	case "unix":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	var l *stdloop
+	if loopIdx >= 0 {
+		l = s.loops[loopIdx]
+	} else {
+		l = s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
 	}
+	select {
+	case <-l.done:
+		return nil, ErrServerShutdown
+	default:
+	}
+	c := &stdconn{addrIndex: -1, outbound: true, ctx: ctx, loop: l,
+		wch: make(chan struct{}, 1)}
+	c.wcond = sync.NewCond(&c.wmu)
+	go func() {
+		conn, err := net.Dial(network, addr)
+		var v interface{} = c
+		if err != nil {
+			v = &stderr{c, err}
+		} else {
+			c.conn = conn
+		}
+		select {
+		case l.ch <- v:
+		case <-l.done:
+			// the server has shut down
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+	return c, nil
+}
+
+// afterFunc creates a loop timer.
+func (s *stdserver) afterFunc(loopIdx int, d time.Duration, f func()) Timer {
+	t := &stdtimer{l: s.loops[loopIdx], f: f}
+	t.Reset(d)
+	return t
 }
 
 func stdloopRun(s *stdserver, l *stdloop) {
 	var err error
-	tick := make(chan bool)
-	tock := make(chan time.Duration)
+	var ticker *time.Timer
+	var tick <-chan time.Time
+	if l.idx == 0 && s.events.Tick != nil {
+		// the first tick fires right away
+		ticker = time.NewTimer(0)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var loopTicker *time.Timer
+	var loopTick <-chan time.Time
+	if s.events.LoopTick != nil {
+		loopTicker = time.NewTimer(0)
+		defer loopTicker.Stop()
+		loopTick = loopTicker.C
+	}
 	defer func() {
-		if l.idx == 0 && s.events.Tick != nil {
-			close(tock)
-			go func() {
-				for range tick {
-				}
-			}()
+		if err == errClosing {
+			s.events.log(slog.LevelInfo, "loop stopped", "loop", l.idx)
+		} else {
+			s.events.log(slog.LevelError, "loop stopped", "loop", l.idx, "err", err)
 		}
 		s.signalShutdown(err)
 		s.loopwg.Done()
 		stdloopEgress(s, l)
 		s.loopwg.Done()
 	}()
-	if l.idx == 0 && s.events.Tick != nil {
-		go func() {
-			for {
-				tick <- true
-				delay, ok := <-tock
-				if !ok {
-					break
-				}
-				time.Sleep(delay)
-			}
-		}()
-	}
 	for {
 		select {
 		case <-tick:
@@ -216,7 +883,16 @@ func stdloopRun(s *stdserver, l *stdloop) {
 			case Shutdown:
 				err = errClosing
 			}
-			tock <- delay
+			ticker.Reset(delay)
+		case <-loopTick:
+			delay, action := s.events.LoopTick(l.idx)
+			switch action {
+			case Shutdown:
+				err = errClosing
+			}
+			loopTicker.Reset(delay)
+		case <-l.pendch:
+			err = stdloopPending(s, l)
 		case v := <-l.ch:
 			switch v := v.(type) {
 			case error:
@@ -224,9 +900,23 @@ func stdloopRun(s *stdserver, l *stdloop) {
 			case *stdconn:
 				err = stdloopAccept(s, l, v)
 			case *stdin:
-				err = stdloopRead(s, l, v.c, v.in)
+				if v.c.pconn != nil {
+					err = stdloopUDPRead(s, l, v.c, v.in)
+				} else {
+					err = stdloopRead(s, l, v.c, v.in)
+				}
+			case *stdeof:
+				err = stdloopReadEOF(s, l, v.c)
 			case *stderr:
 				err = stdloopError(s, l, v.c, v.err)
+			case *stdend:
+				err = stdloopEnd(s, l, v.c)
+			case *stdreject:
+				s.events.log(slog.LevelInfo, "connection rejected", "loop", l.idx,
+					"remote", v.remote, "err", v.err)
+				if s.events.Rejected != nil {
+					s.events.Rejected(v.remote, v.err)
+				}
 			}
 		}
 		if err != nil {
@@ -236,6 +926,7 @@ func stdloopRun(s *stdserver, l *stdloop) {
 }
 
 func stdloopEgress(s *stdserver, l *stdloop) {
+	defer close(l.done)
 	var closed bool
 loop:
 	for v := range l.ch {
@@ -244,37 +935,102 @@ loop:
 			if v == errCloseConns {
 				closed = true
 				for c := range l.conns {
-					stdloopClose(s, l, c)
+					if atomic.LoadInt32(&c.done) == 0 {
+						c.closeErr = ErrServerShutdown
+						stdloopClose(s, l, c)
+					}
 				}
 			}
+		case *stdconn:
+			// accepted or dialed after the loop stopped
+			v.wmu.Lock()
+			v.wclosed = true
+			v.wmu.Unlock()
+			v.conn.Close()
+			if v.limited {
+				s.limiter.release(v.limitKey)
+			}
+			if v.outbound {
+				stdloopClosed(s, l, v, ErrServerShutdown)
+			}
 		case *stderr:
 			stdloopError(s, l, v.c, v.err)
+		case *stdend:
+			stdloopEnd(s, l, v.c)
 		}
-		if len(l.conns) == 0 && closed {
+		if len(l.conns) == 0 && l.ending == 0 && closed {
 			break loop
 		}
 	}
 }
 
+// stdloopError starts closing or detaching a connection whose reader has
+// stopped. The writer ends once the queued output has been written, and
+// stdloopEnd finishes the connection.
 func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 	delete(l.conns, c)
-	closeEvent := true
+	if c.conn == nil {
+		// failed to dial
+		c.wmu.Lock()
+		c.wclosed = true
+		c.wmu.Unlock()
+		return stdloopClosed(s, l, c, closeErr(ErrDialFailed, err))
+	}
+	c.rerr = err
+	l.ending++
+	c.closeWrites()
+	return nil
+}
+
+// stdloopEnd fires the Closed or Detached event of a connection whose
+// writer has ended.
+func stdloopEnd(s *stdserver, l *stdloop, c *stdconn) error {
+	l.ending--
+	l.stats.close()
+	if c.limited {
+		s.limiter.release(c.limitKey)
+	}
+	c.wmu.Lock()
+	werr := c.werr
+	c.wmu.Unlock()
+	err := c.rerr
+	switch {
+	case atomic.LoadInt32(&c.done) != 0:
+	case errors.Is(err, ErrTLSHandshake):
+		// the writer fails the handshake too
+	case werr != nil:
+		// the writer failed the reader
+		err = werr
+	case err != ErrTimeout:
+		err = closeErr(ErrPeerClosed, err)
+	}
 	switch atomic.LoadInt32(&c.done) {
-	case 0: // read error
-		c.conn.Close()
-		if err == io.EOF {
-			err = nil
-		}
 	case 1: // closed
-		c.conn.Close()
-		err = nil
+		err = c.closeErr
+		if err == nil {
+			err = ErrClosedByHandler
+		}
+	case 2: // detached
+		if s.events.Detached == nil {
+			err = ErrClosedByHandler
+			break
+		}
+		switch s.events.Detached(c, &stddetachedConn{c.conn, c.donein}) {
+		case Shutdown:
+			return errClosing
+		}
+		return nil
 	}
-	if closeEvent {
-		if s.events.Closed != nil {
-			switch s.events.Closed(c, err) {
-			case Shutdown:
-				return errClosing
-			}
+	return stdloopClosed(s, l, c, err)
+}
+
+// stdloopClosed fires the Closed event.
+func stdloopClosed(s *stdserver, l *stdloop, c *stdconn, err error) error {
+	stdconnLog(s, l, c, slog.LevelDebug, "connection closed", err)
+	if s.events.Closed != nil {
+		switch s.events.Closed(c, err) {
+		case Shutdown:
+			return errClosing
 		}
 	}
 	return nil
@@ -288,12 +1044,12 @@ func stdloopRead(s *stdserver, l *stdloop, c *stdconn, in []byte) error {
 	}
 	if s.events.Data != nil {
 		out, action := s.events.Data(c, in)
-		if len(out) > 0 {
-			c.conn.Write(out)
-		}
+		c.queue(out)
 		switch action {
 		case Shutdown:
 			return errClosing
+		case Detach:
+			return stdloopDetach(s, l, c)
 		case Close:
 			return stdloopClose(s, l, c)
 		}
@@ -301,31 +1057,234 @@ func stdloopRead(s *stdserver, l *stdloop, c *stdconn, in []byte) error {
 	return nil
 }
 
+func stdloopReadEOF(s *stdserver, l *stdloop, c *stdconn) error {
+	if !l.conns[c] || atomic.LoadInt32(&c.done) != 0 {
+		// closed, detached or closing
+		return nil
+	}
+	out, action := s.events.ReadEOF(c)
+	c.queue(out)
+	switch action {
+	case Shutdown:
+		return errClosing
+	case Detach:
+		return stdloopDetach(s, l, c)
+	case Close:
+		return stdloopClose(s, l, c)
+	}
+	return nil
+}
+
+// stdconnLog logs a record about the connection.
+func stdconnLog(s *stdserver, l *stdloop, c *stdconn, level slog.Level, msg string, err error) {
+	if s.events.Logger == nil {
+		return
+	}
+	args := []interface{}{"loop", l.idx, "remote", c.remoteAddr}
+	if c.remoteAddr == nil && c.conn != nil {
+		args[3] = c.conn.RemoteAddr()
+	}
+	if err != nil {
+		args = append(args, "err", err)
+	}
+	s.events.log(level, msg, args...)
+}
+
+func stdloopUDPRead(s *stdserver, l *stdloop, c *stdconn, in []byte) error {
+	if s.events.Data != nil {
+		out, action := s.events.Data(c, in)
+		if len(out) > 0 {
+			if n, err := c.pconn.WriteTo(out, c.remoteAddr); err != nil {
+				stdconnLog(s, l, c, slog.LevelDebug, "write failed", err)
+			} else {
+				l.stats.write(n)
+			}
+		}
+		switch action {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+type stddetachedConn struct {
+	conn net.Conn // original conn
+	in   []byte   // extra input data
+}
+
+func (c *stddetachedConn) Read(p []byte) (n int, err error) {
+	if len(c.in) > 0 {
+		n = copy(p, c.in)
+		c.in = c.in[n:]
+		return n, nil
+	}
+	return c.conn.Read(p)
+}
+
+func (c *stddetachedConn) Write(p []byte) (n int, err error) {
+	return c.conn.Write(p)
+}
+
+func (c *stddetachedConn) Close() error {
+	return c.conn.Close()
+}
+
+func stdloopDetach(s *stdserver, l *stdloop, c *stdconn) error {
+	atomic.StoreInt32(&c.done, 2)
+	c.resumeReads()
+	c.conn.SetReadDeadline(time.Now())
+	return nil
+}
+
+// stdloopPending handles the wakes, closes and timers queued by other
+// goroutines.
+func stdloopPending(s *stdserver, l *stdloop) error {
+	l.mu.Lock()
+	wakes, closes, timers := l.wakes, l.closes, l.timers
+	l.wakes, l.closes, l.timers = nil, nil, nil
+	l.mu.Unlock()
+	for _, req := range closes {
+		c := req.c
+		if req.write {
+			if !l.conns[c] {
+				// not yet opened, or already closed
+				c.closeWriteReq = true
+			} else {
+				c.closeWrite()
+			}
+			continue
+		}
+		if !l.conns[c] {
+			// not yet opened, or already closed
+			c.closeReq, c.closeErr = true, req.err
+			continue
+		}
+		if atomic.LoadInt32(&c.done) == 0 {
+			c.closeErr = req.err
+			stdloopClose(s, l, c)
+		}
+	}
+	for _, c := range wakes {
+		if !l.conns[c] || atomic.LoadInt32(&c.done) != 0 {
+			// closed, detached or closing
+			continue
+		}
+		atomic.AddUint64(&l.stats.wakeups, 1)
+		if err := stdloopRead(s, l, c, nil); err != nil {
+			return err
+		}
+	}
+	for _, t := range timers {
+		t.mu.Lock()
+		if !t.active || time.Now().Before(t.when) {
+			// stopped or reset
+			t.mu.Unlock()
+			continue
+		}
+		t.active = false
+		t.mu.Unlock()
+		if c := t.c; c != nil {
+			c.wmu.Lock()
+			delete(c.timers, t)
+			closed := c.wclosed
+			c.wmu.Unlock()
+			if closed || atomic.LoadInt32(&c.done) != 0 {
+				// closed, detached or closing
+				continue
+			}
+			if err := s.events.runTimer(l.stats, c, t.f); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.events.runTimer(l.stats, nil, t.f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func stdloopClose(s *stdserver, l *stdloop, c *stdconn) error {
 	atomic.StoreInt32(&c.done, 1)
+	c.resumeReads()
 	c.conn.SetReadDeadline(time.Now())
 	return nil
 }
 
 func stdloopAccept(s *stdserver, l *stdloop, c *stdconn) error {
 	l.conns[c] = true
-	c.localAddr = s.ln.lnaddr
-	c.remoteAddr = c.conn.RemoteAddr()
+	l.stats.opened(!c.outbound)
+	err := stdloopOpened(s, l, c)
+	// the writer and reader start once the options are set
+	go stdconnWriter(s, c)
+	go stdconnRun(s, l, c)
+	if c.closeWriteReq {
+		c.closeWrite()
+	}
+	if err == nil && len(c.proxyIn) > 0 && atomic.LoadInt32(&c.done) == 0 {
+		// read with the PROXY protocol header
+		in := c.proxyIn
+		c.proxyIn = nil
+		err = stdloopRead(s, l, c, in)
+	}
+	return err
+}
+
+func stdloopOpened(s *stdserver, l *stdloop, c *stdconn) error {
+	if c.closeReq {
+		return stdloopClose(s, l, c)
+	}
+	if c.outbound {
+		c.localAddr = c.conn.LocalAddr()
+	} else if c.localAddr == nil {
+		c.localAddr = s.lns[c.addrIndex].lnaddr
+	}
+	if c.remoteAddr == nil {
+		c.remoteAddr = c.conn.RemoteAddr()
+	}
 
 	if s.events.Opened != nil {
 		out, opts, action := s.events.Opened(c)
-		if len(out) > 0 {
-			c.conn.Write(out)
+		c.wmu.Lock()
+		c.highWater = opts.WriteHighWater
+		c.lowWater = min(opts.WriteLowWater, opts.WriteHighWater)
+		c.writeLimit = opts.WriteLimit
+		if opts.ReadRate > 0 {
+			c.readRate = newTokenBucket(opts.ReadRate, time.Now())
 		}
+		if opts.WriteRate > 0 {
+			c.writeRate = newTokenBucket(opts.WriteRate, time.Now())
+		}
+		c.wmu.Unlock()
+		c.queue(out)
 		if opts.TCPKeepAlive > 0 {
-			if c, ok := c.conn.(*net.TCPConn); ok {
-				c.SetKeepAlive(true)
-				c.SetKeepAlivePeriod(opts.TCPKeepAlive)
+			if conn, ok := c.conn.(*net.TCPConn); ok {
+				err := conn.SetKeepAlive(true)
+				if err == nil {
+					err = conn.SetKeepAlivePeriod(opts.TCPKeepAlive)
+				}
+				if err != nil {
+					stdconnLog(s, l, c, slog.LevelWarn, "keepalive failed", err)
+				}
+			}
+		}
+		c.idleTime = opts.IdleTimeout
+		c.readTime = opts.ReadTimeout
+		c.writeTime = opts.WriteTimeout
+		if opts.TLSConfig != nil {
+			// the reader handshakes before reading
+			if c.outbound {
+				c.conn = tls.Client(c.conn, opts.TLSConfig)
+			} else {
+				c.conn = tls.Server(c.conn, opts.TLSConfig)
 			}
 		}
 		switch action {
 		case Shutdown:
 			return errClosing
+		case Detach:
+			return stdloopDetach(s, l, c)
 		case Close:
 			return stdloopClose(s, l, c)
 		}
@@ -8,13 +8,24 @@ package evio
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/big"
 	"math/rand"
 	"net"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -385,3 +396,1683 @@ func TestReuseport(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestMultipleAddresses(t *testing.T) {
+	testMultipleAddresses(t, false)
+	testMultipleAddresses(t, true)
+}
+
+func testMultipleAddresses(t *testing.T, stdlib bool) {
+	var ssuf string
+	if stdlib {
+		ssuf = "-net"
+	}
+	var events Events
+	var srv Server
+	var opened int32
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			for _, na := range [][2]string{{"tcp", ":20001"}, {"unix", "socket3"}} {
+				c, err := net.Dial(na[0], na[1])
+				must(err)
+				defer c.Close()
+			}
+			time.Sleep(time.Second / 5)
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if c.LocalAddr() != srv.Addrs[c.AddrIndex()] {
+			t.Errorf("expected '%v', got '%v'", srv.Addrs[c.AddrIndex()], c.LocalAddr())
+			action = Shutdown
+		}
+		if atomic.AddInt32(&opened, 1) == 2 {
+			action = Shutdown
+		}
+		return
+	}
+	must(ServeAddrs(events, "tcp"+ssuf+"://:20001", "unix"+ssuf+"://socket3"))
+	if len(srv.Addrs) != 2 || srv.Addr != srv.Addrs[0] {
+		t.Fatalf("expected 2 addresses, got %v", srv.Addrs)
+	}
+	if srv.Addrs[1].Network() != "unix" {
+		t.Fatalf("expected unix, got '%v'", srv.Addrs[1].Network())
+	}
+}
+
+func TestUDP(t *testing.T) {
+	testUDP(t, "udp", ":20002")
+	testUDP(t, "udp-net", ":20003")
+}
+
+func testUDP(t *testing.T, network, addr string) {
+	var events Events
+	var n int
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("udp", addr)
+			must(err)
+			defer c.Close()
+			packet := make([]byte, 64)
+			for i := 0; i < 3; i++ {
+				c.Write([]byte("ping"))
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.Read(packet)
+				must(err)
+				if string(packet[:n]) != c.LocalAddr().String()+":pong" {
+					panic("bad reply")
+				}
+			}
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if _, ok := c.RemoteAddr().(*net.UDPAddr); !ok {
+			t.Errorf("expected *net.UDPAddr, got %T", c.RemoteAddr())
+			return nil, Shutdown
+		}
+		n++
+		if string(in) == "shutdown" {
+			action = Shutdown
+			return
+		}
+		out = []byte(c.RemoteAddr().String() + ":pong")
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+	if n != 4 {
+		t.Fatalf("expected 4 packets, got %d", n)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	testDetach(t, "tcp", ":20004")
+	testDetach(t, "tcp-net", ":20005")
+}
+
+func testDetach(t *testing.T, network, addr string) {
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			rd := bufio.NewReader(c)
+			c.Write([]byte("detach\r\nhello\r\n"))
+			for _, expect := range []string{"detaching\r\n", "hello\r\n"} {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != expect {
+					panic("expected " + expect + ", got " + line)
+				}
+			}
+			c.Write([]byte("world\r\n"))
+			line, err := rd.ReadString('\n')
+			must(err)
+			if line != "world\r\n" {
+				panic("expected world, got " + line)
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if !strings.HasPrefix(string(in), "detach\r\n") {
+			t.Errorf("expected detach, got '%s'", in)
+			return nil, Shutdown
+		}
+		c.SetContext(in[len("detach\r\n"):])
+		return []byte("detaching\r\n"), Detach
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		t.Errorf("closed fired for a detached connection")
+		return Shutdown
+	}
+	done := make(chan bool)
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		go func() {
+			defer close(done)
+			defer rwc.Close()
+			// echo the remaining input from the Data event and then
+			// everything that the detached connection reads.
+			rwc.Write(c.Context().([]byte))
+			rd := bufio.NewReader(rwc)
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				rwc.Write([]byte(line))
+			}
+		}()
+		return Shutdown
+	}
+	must(Serve(network+"://"+addr, events))
+	<-done
+}
+
+func TestWake(t *testing.T) {
+	testWake(t, "tcp", ":20006")
+	testWake(t, "tcp-net", ":20007")
+}
+
+func testWake(t *testing.T, network, addr string) {
+	var events Events
+	var wakes int
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("wake\r\n"))
+			rd := bufio.NewReader(c)
+			for i := 0; i < 10; i++ {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != "woken\r\n" {
+					panic("expected woken, got " + line)
+				}
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			wakes++
+			out = []byte("woken\r\n")
+			if wakes == 10 {
+				action = Shutdown
+			}
+			return
+		}
+		for i := 0; i < 10; i++ {
+			go func() {
+				time.Sleep(time.Millisecond * 10)
+				c.Wake()
+			}()
+		}
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+	if wakes != 10 {
+		t.Fatalf("expected 10 wakes, got %d", wakes)
+	}
+}
+
+func TestDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:20010")
+	must(err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	testDial(t, "tcp", ":20008")
+	testDial(t, "tcp-net", ":20009")
+}
+
+func testDial(t *testing.T, network, addr string) {
+	var events Events
+	var mu sync.Mutex // the connections are on different loops
+	var failed, opened, echoed bool
+	events.NumLoops = 2
+	events.Serving = func(srv Server) (action Action) {
+		if _, err := srv.DialLoop(1, "tcp", "127.0.0.1:20010", "echo"); err != nil {
+			t.Error(err)
+			return Shutdown
+		}
+		if _, err := srv.Dial("tcp", "127.0.0.1:20011", "refused"); err != nil {
+			t.Error(err)
+			return Shutdown
+		}
+		if _, err := srv.Dial("tulip", "howdy", nil); err == nil {
+			t.Error("expected error")
+			return Shutdown
+		}
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		switch {
+		case !c.Outbound() || c.AddrIndex() != -1:
+			t.Errorf("expected outbound connection")
+			action = Shutdown
+		case c.Context() != "echo" || c.LoopIndex() != 1:
+			t.Errorf("unexpected connection %v on loop %d", c.Context(), c.LoopIndex())
+			action = Shutdown
+		case c.RemoteAddr().String() != "127.0.0.1:20010":
+			t.Errorf("expected 127.0.0.1:20010, got %v", c.RemoteAddr())
+			action = Shutdown
+		}
+		opened = true
+		out = []byte("hello")
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if c.Context() == "refused" {
+			if !errors.Is(err, ErrDialFailed) || !errors.Is(err, syscall.ECONNREFUSED) {
+				t.Errorf("expected '%v', got '%v'", ErrDialFailed, err)
+				return Shutdown
+			}
+			mu.Lock()
+			failed = true
+			if echoed {
+				action = Shutdown
+			}
+			mu.Unlock()
+		}
+		return
+	}
+	var in []byte
+	events.Data = func(c Conn, data []byte) (out []byte, action Action) {
+		in = append(in, data...)
+		if string(in) == "hello" {
+			mu.Lock()
+			echoed = true
+			if failed {
+				action = Shutdown
+			}
+			mu.Unlock()
+		}
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+	if !opened || !failed {
+		t.Fatalf("expected opened and failed, got %v and %v", opened, failed)
+	}
+}
+
+func TestDialShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:20066")
+	must(err)
+	defer ln.Close()
+	testDialShutdown(t, "tcp", ":20067", ln.Addr().String())
+	testDialShutdown(t, "tcp-net", ":20068", ln.Addr().String())
+}
+
+func testDialShutdown(t *testing.T, network, addr, target string) {
+	goroutines := runtime.NumGoroutine()
+	var srv Server
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		// dialed as the server shuts down
+		if _, err := srv.Dial("tcp", target, nil); err != nil {
+			t.Error(err)
+		}
+		return Shutdown
+	}
+	must(Serve(network+"://"+addr, events))
+	if c, err := srv.Dial("tcp", target, nil); c != nil || err != ErrServerShutdown {
+		t.Fatalf("%s: expected '%v', got %v '%v'", network, ErrServerShutdown, c, err)
+	}
+	// the dial of Serving doesn't leak its goroutine
+	for start := time.Now(); runtime.NumGoroutine() > goroutines; time.Sleep(time.Millisecond * 10) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("%s: expected %d goroutines, got %d", network, goroutines, runtime.NumGoroutine())
+		}
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	testConnClose(t, "tcp", ":20012")
+	testConnClose(t, "tcp-net", ":20013")
+}
+
+func testConnClose(t *testing.T, network, addr string) {
+	var events Events
+	var closeErr = fmt.Errorf("kicked")
+	var closed error
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			data, err := io.ReadAll(c)
+			must(err)
+			if string(data) != "welcome\r\n" {
+				panic("expected welcome, got " + string(data))
+			}
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		go c.CloseWithError(closeErr)
+		out = []byte("welcome\r\n")
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed = err
+		return Shutdown
+	}
+	must(Serve(network+"://"+addr, events))
+	if closed != closeErr {
+		t.Fatalf("expected '%v', got '%v'", closeErr, closed)
+	}
+}
+
+func TestCloseSlowPeer(t *testing.T) {
+	testCloseSlowPeer(t, "tcp", ":20064")
+	testCloseSlowPeer(t, "tcp-net", ":20065")
+}
+
+func testCloseSlowPeer(t *testing.T, network, addr string) {
+	var events Events
+	var closing, ticks int32
+	done := make(chan bool)
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// never reads the output
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			<-done
+			c.Close()
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		atomic.StoreInt32(&closing, 1)
+		return make([]byte, 16*1024*1024), opts, Close
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		// the loop keeps running while the output is written
+		if atomic.LoadInt32(&closing) == 1 && atomic.AddInt32(&ticks, 1) == 5 {
+			close(done)
+			action = Shutdown
+		}
+		return time.Millisecond * 10, action
+	}
+	must(Serve(network+"://"+addr, events))
+}
+
+func TestWriteOrder(t *testing.T) {
+	testWriteOrder(t, "tcp", ":20014")
+	testWriteOrder(t, "tcp-net", ":20015")
+}
+
+func testWriteOrder(t *testing.T, network, addr string) {
+	const writers, lines = 8, 500
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("start\r\n"))
+			rd := bufio.NewReader(c)
+			line, err := rd.ReadString('\n')
+			must(err)
+			if line != "first\r\n" {
+				panic("expected first, got " + line)
+			}
+			// the writers may run before the second line is returned
+			var next [writers]int
+			var second bool
+			for i := 0; i < writers*lines+1; i++ {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line == "second\r\n" && !second {
+					second = true
+					continue
+				}
+				var w, n int
+				if _, err := fmt.Sscanf(line, "%d:%d\r\n", &w, &n); err != nil {
+					panic("bad line " + line)
+				}
+				if n != next[w] {
+					panic(fmt.Sprintf("writer %d: expected %d, got %d", w, next[w], n))
+				}
+				next[w]++
+			}
+			c.Write([]byte("done\r\n"))
+			io.ReadAll(c)
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "start\r\n":
+			must(c.Write([]byte("first\r\n")))
+			for w := 0; w < writers; w++ {
+				go func(w int) {
+					for n := 0; n < lines; n++ {
+						must(c.Write([]byte(fmt.Sprintf("%d:%d\r\n", w, n))))
+					}
+				}(w)
+			}
+			out = []byte("second\r\n")
+		case "done\r\n":
+			action = Shutdown
+		}
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+}
+
+func TestTimeouts(t *testing.T) {
+	testTimeouts(t, "tcp", []string{":20016", ":20017", ":20018"})
+	testTimeouts(t, "tcp-net", []string{":20019", ":20020", ":20021"})
+}
+
+func testTimeouts(t *testing.T, network string, addrs []string) {
+	const timeout = time.Millisecond * 200
+	var events Events
+	var opened [3]time.Time
+	var closed [3]time.Duration
+	var errs [3]error
+	var nclosed int
+	events.Serving = func(srv Server) (action Action) {
+		for i, addr := range addrs {
+			go func(i int, addr string) {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				switch i {
+				case 0:
+					// keep the idle connection active for a while
+					for j := 0; j < 8; j++ {
+						c.Write([]byte("ping\r\n"))
+						time.Sleep(timeout / 4)
+					}
+					io.ReadAll(c)
+				case 1:
+					io.ReadAll(c)
+				case 2:
+					// never read the output
+					time.Sleep(timeout * 4)
+				}
+			}(i, addr)
+		}
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opened[c.AddrIndex()] = time.Now()
+		switch c.AddrIndex() {
+		case 0:
+			opts.IdleTimeout = timeout
+		case 1:
+			opts.ReadTimeout = timeout
+		case 2:
+			opts.WriteTimeout = timeout
+			out = make([]byte, 16*1024*1024)
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed[c.AddrIndex()] = time.Since(opened[c.AddrIndex()])
+		errs[c.AddrIndex()] = err
+		nclosed++
+		if nclosed == len(addrs) {
+			action = Shutdown
+		}
+		return
+	}
+	var urls []string
+	for _, addr := range addrs {
+		urls = append(urls, network+"://"+addr)
+	}
+	must(ServeAddrs(events, urls...))
+	for i := range addrs {
+		if errs[i] != ErrTimeout {
+			t.Fatalf("%s %d: expected '%v', got '%v'", network, i, ErrTimeout, errs[i])
+		}
+		if closed[i] < timeout || closed[i] > timeout*5 {
+			t.Fatalf("%s %d: closed after %s", network, i, closed[i])
+		}
+	}
+	if closed[0] < timeout*2 {
+		t.Fatalf("%s: idle connection closed while active, after %s", network, closed[0])
+	}
+}
+
+func TestAfterFunc(t *testing.T) {
+	testAfterFunc(t, "tcp", ":20022")
+	testAfterFunc(t, "tcp-net", ":20023")
+}
+
+func testAfterFunc(t *testing.T, network, addr string) {
+	var events Events
+	var loopFired, stoppedFired, cancelFired bool
+	var cancel Timer
+	events.Serving = func(srv Server) (action Action) {
+		if _, err := srv.AfterFunc(1, time.Millisecond, func() {}); err == nil {
+			t.Error("expected error")
+			return Shutdown
+		}
+		_, err := srv.AfterFunc(0, time.Millisecond*50, func() { loopFired = true })
+		must(err)
+		stopped, err := srv.AfterFunc(0, time.Millisecond*50, func() { stoppedFired = true })
+		must(err)
+		if !stopped.Stop() {
+			t.Error("expected stop")
+			return Shutdown
+		}
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			rd := bufio.NewReader(c)
+			for _, expect := range []string{"reset\r\n", "timer\r\n"} {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != expect {
+					panic("expected " + expect + ", got " + line)
+				}
+			}
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.AfterFunc(time.Millisecond*100, func() { c.Write([]byte("timer\r\n")) })
+		reset := c.AfterFunc(time.Second, func() { c.Write([]byte("reset\r\n")) })
+		if !reset.Reset(time.Millisecond * 20) {
+			t.Error("expected active timer")
+			action = Shutdown
+		}
+		cancel = c.AfterFunc(time.Second, func() { cancelFired = true })
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if cancel.Stop() {
+			t.Error("expected the timer to stop with the connection")
+		}
+		return Shutdown
+	}
+	must(Serve(network+"://"+addr, events))
+	if !loopFired || stoppedFired || cancelFired {
+		t.Fatalf("expected only the loop timer, got %v, %v and %v",
+			loopFired, stoppedFired, cancelFired)
+	}
+}
+
+func TestLoopTick(t *testing.T) {
+	testLoopTick(t, "tcp", ":20024")
+	testLoopTick(t, "tcp-net", ":20025")
+}
+
+func testLoopTick(t *testing.T, network, addr string) {
+	const nloops = 4
+	var events Events
+	var counts [nloops]int
+	var ticks int32
+	events.NumLoops = nloops
+	events.Tick = func() (delay time.Duration, action Action) {
+		atomic.AddInt32(&ticks, 1)
+		return time.Millisecond * 10, None
+	}
+	events.LoopTick = func(loopIdx int) (delay time.Duration, action Action) {
+		// every loop has its own count and delay
+		counts[loopIdx]++
+		if loopIdx == 0 && counts[loopIdx] == 20 {
+			action = Shutdown
+		}
+		delay = time.Millisecond * 5 * time.Duration(loopIdx+1)
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+	for i := 0; i < nloops; i++ {
+		if counts[i] == 0 {
+			t.Fatalf("%s: loop %d did not tick", network, i)
+		}
+	}
+	if counts[nloops-1] >= counts[0] {
+		t.Fatalf("%s: expected fewer ticks on loop %d, got %v", network, nloops-1, counts)
+	}
+	if atomic.LoadInt32(&ticks) == 0 {
+		t.Fatalf("%s: expected global ticks", network)
+	}
+}
+
+func TestWriteWaterMarks(t *testing.T) {
+	testWriteWaterMarks(t, "tcp", []string{":20026", ":20027"})
+	testWriteWaterMarks(t, "tcp-net", []string{":20028", ":20029"})
+}
+
+func testWriteWaterMarks(t *testing.T, network string, addrs []string) {
+	const lines, size = 50, 1024 * 1024
+	var events Events
+	var served [2]int32
+	var errs [2]error
+	var nclosed int
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// pauses and resumes
+			c, err := net.Dial("tcp", addrs[0])
+			must(err)
+			defer c.Close()
+			// a small buffer keeps the output from fitting in the socket
+			must(c.(*net.TCPConn).SetReadBuffer(64 * 1024))
+			for i := 0; i < lines; i++ {
+				c.Write([]byte("go\r\n"))
+				time.Sleep(time.Millisecond * 2)
+			}
+			time.Sleep(time.Millisecond * 200)
+			if n := atomic.LoadInt32(&served[0]); n == lines {
+				panic("expected paused reads")
+			}
+			n, err := io.CopyN(io.Discard, c, lines*size)
+			must(err)
+			if n != lines*size {
+				panic("expected all output")
+			}
+		}()
+		go func() {
+			// never reads, and hits the limit
+			c, err := net.Dial("tcp", addrs[1])
+			must(err)
+			defer c.Close()
+			for i := 0; i < lines; i++ {
+				c.Write([]byte("go\r\n"))
+			}
+			io.ReadAll(c)
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		switch c.AddrIndex() {
+		case 0:
+			opts.WriteHighWater = 64 * 1024
+			opts.WriteLowWater = 16 * 1024
+		case 1:
+			opts.WriteHighWater = lines * size
+			opts.WriteLimit = 4 * size
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		for n := bytes.Count(in, []byte("\n")); n > 0; n-- {
+			atomic.AddInt32(&served[c.AddrIndex()], 1)
+			out = append(out, make([]byte, size)...)
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		errs[c.AddrIndex()] = err
+		nclosed++
+		if nclosed == len(addrs) {
+			action = Shutdown
+		}
+		return
+	}
+	must(ServeAddrs(events, network+"://"+addrs[0], network+"://"+addrs[1]))
+	if served[0] != lines {
+		t.Fatalf("%s: expected %d lines, got %d", network, lines, served[0])
+	}
+	if errs[1] != ErrSlowConsumer {
+		t.Fatalf("%s: expected '%v', got '%v'", network, ErrSlowConsumer, errs[1])
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	testHalfClose(t, "tcp", []string{":20030", ":20031"})
+	testHalfClose(t, "tcp-net", []string{":20032", ":20033"})
+}
+
+func testHalfClose(t *testing.T, network string, addrs []string) {
+	var events Events
+	var errs [2]error
+	var nclosed int
+	var bye bool
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// the client shuts down writing and waits for the response
+			c, err := net.Dial("tcp", addrs[0])
+			must(err)
+			defer c.Close()
+			c.Write([]byte("hello"))
+			must(c.(*net.TCPConn).CloseWrite())
+			data, err := io.ReadAll(c)
+			must(err)
+			if string(data) != "HELLO" {
+				panic("expected HELLO, got " + string(data))
+			}
+		}()
+		go func() {
+			// the server shuts down writing and keeps reading
+			c, err := net.Dial("tcp", addrs[1])
+			must(err)
+			defer c.Close()
+			data, err := io.ReadAll(c)
+			must(err)
+			if string(data) != "welcome" {
+				panic("expected welcome, got " + string(data))
+			}
+			c.Write([]byte("bye"))
+			must(c.(*net.TCPConn).CloseWrite())
+			io.ReadAll(c)
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.SetContext([]byte{})
+		if c.AddrIndex() == 1 {
+			out = []byte("welcome")
+			c.CloseWrite()
+			if c.Write([]byte("late")) == nil {
+				t.Error("expected write error")
+				action = Shutdown
+			}
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		c.SetContext(append(c.Context().([]byte), in...))
+		if c.AddrIndex() == 1 && string(c.Context().([]byte)) == "bye" {
+			bye = true
+		}
+		return
+	}
+	events.ReadEOF = func(c Conn) (out []byte, action Action) {
+		if c.AddrIndex() == 0 {
+			out = bytes.ToUpper(c.Context().([]byte))
+			c.CloseWrite()
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		errs[c.AddrIndex()] = err
+		nclosed++
+		if nclosed == len(addrs) {
+			action = Shutdown
+		}
+		return
+	}
+	must(ServeAddrs(events, network+"://"+addrs[0], network+"://"+addrs[1]))
+	for i, err := range errs {
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Fatalf("%s %d: expected '%v', got '%v'", network, i, ErrPeerClosed, err)
+		}
+	}
+	if !bye {
+		t.Fatalf("%s: expected reads after CloseWrite", network)
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	testCloseReasons(t, "tcp", ":20034")
+	testCloseReasons(t, "tcp-net", ":20035")
+}
+
+func testCloseReasons(t *testing.T, network, addr string) {
+	var events Events
+	errs := make(map[string]error)
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			stay, err := net.Dial("tcp", addr)
+			must(err)
+			defer stay.Close()
+			rd := bufio.NewReader(stay)
+			fmt.Fprintf(stay, "stay\n")
+			_, err = rd.ReadString('\n')
+			must(err)
+
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			fmt.Fprintf(c, "close\n")
+			_, err = io.ReadAll(c)
+			must(err)
+			c.Close()
+
+			c, err = net.Dial("tcp", addr)
+			must(err)
+			fmt.Fprintf(c, "bye\n")
+			_, err = bufio.NewReader(c).ReadString('\n')
+			must(err)
+			c.Close()
+
+			// the server closes the connection on shutdown
+			io.ReadAll(rd)
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		name := strings.TrimSpace(string(in))
+		c.SetContext(name)
+		if name == "close" {
+			return nil, Close
+		}
+		return []byte("ok\n"), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		name, _ := c.Context().(string)
+		errs[name] = err
+		if name == "bye" {
+			action = Shutdown
+		}
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+	if err := errs["close"]; err != ErrClosedByHandler {
+		t.Fatalf("%s: expected '%v', got '%v'", network, ErrClosedByHandler, err)
+	}
+	if err := errs["bye"]; !errors.Is(err, ErrPeerClosed) || !errors.Is(err, io.EOF) {
+		t.Fatalf("%s: expected '%v', got '%v'", network, ErrPeerClosed, err)
+	}
+	if err := errs["stay"]; err != ErrServerShutdown {
+		t.Fatalf("%s: expected '%v', got '%v'", network, ErrServerShutdown, err)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	testPanic(t, "tcp", ":20036", false)
+	testPanic(t, "tcp-net", ":20037", false)
+	testPanic(t, "tcp", ":20038", true)
+	testPanic(t, "tcp-net", ":20039", true)
+}
+
+func testPanic(t *testing.T, network, addr string, handler bool) {
+	var events Events
+	var finished int32
+	var mu sync.Mutex
+	var panics []interface{}
+	errs := make(map[string]error)
+	events.NumLoops = 2
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// the connections after the ones that panicked are served,
+			// with or without an OnPanic event
+			for _, name := range []string{"panic", "timer", "echo"} {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				fmt.Fprintf(c, "%s\n", name)
+				data, err := io.ReadAll(c)
+				must(err)
+				c.Close()
+				if name == "echo" && string(data) != "echo\n" {
+					panic("expected echo, got " + string(data))
+				}
+			}
+			atomic.StoreInt32(&finished, 1)
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&finished) == 1 {
+			if handler {
+				panic("tick")
+			}
+			return 0, Shutdown
+		}
+		return time.Millisecond * 10, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		name := strings.TrimSpace(string(in))
+		c.SetContext(name)
+		switch name {
+		case "panic":
+			panic("boom")
+		case "timer":
+			c.AfterFunc(0, func() { panic("timer") })
+			return
+		}
+		return in, Close
+	}
+	if handler {
+		events.OnPanic = func(c Conn, v interface{}, stack []byte) (action Action) {
+			if !bytes.Contains(stack, []byte("testPanic")) {
+				t.Errorf("expected stack of the panic, got %s", stack)
+				return Shutdown
+			}
+			mu.Lock()
+			panics = append(panics, v)
+			mu.Unlock()
+			if c == nil {
+				return Shutdown
+			}
+			return Close
+		}
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		mu.Lock()
+		errs[c.Context().(string)] = err
+		mu.Unlock()
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+	for _, name := range []string{"panic", "timer"} {
+		if err := errs[name]; !errors.Is(err, ErrPanic) {
+			t.Fatalf("%s %s: expected '%v', got '%v'", network, name, ErrPanic, err)
+		}
+	}
+	if errs["panic"].Error() != "event panicked: boom" {
+		t.Fatalf("%s: expected the panic value, got '%v'", network, errs["panic"])
+	}
+	if err := errs["echo"]; err != ErrClosedByHandler {
+		t.Fatalf("%s: expected '%v', got '%v'", network, ErrClosedByHandler, err)
+	}
+	if handler && fmt.Sprint(panics) != "[boom timer tick]" {
+		t.Fatalf("%s: expected [boom timer tick], got %v", network, panics)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	testLogger(t, "tcp", ":20040")
+	testLogger(t, "tcp-net", ":20041")
+}
+
+func testLogger(t *testing.T, network, addr string) {
+	var events Events
+	var buf bytes.Buffer
+	events.Logger = slog.New(slog.NewTextHandler(&buf,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			c.Close()
+		}()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	must(Serve(network+"://"+addr, events))
+	logs := buf.String()
+	for _, s := range []string{
+		`level=DEBUG msg="connection closed" loop=0`,
+		`remote=127.0.0.1:`,
+		`err="closed by peer: EOF"`,
+		`level=INFO msg="loop stopped" loop=0`,
+	} {
+		if !strings.Contains(logs, s) {
+			t.Fatalf("%s: expected %s in logs, got\n%s", network, s, logs)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	testStats(t, "tcp", ":20042")
+	testStats(t, "tcp-net", ":20043")
+}
+
+func testStats(t *testing.T, network, addr string) {
+	var events Events
+	var srv Server
+	events.EventStats = true
+	events.Serving = func(srvin Server) (action Action) {
+		srv = srvin
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			fmt.Fprintf(c, "hello")
+			data := make([]byte, 9)
+			_, err = io.ReadFull(c, data)
+			must(err)
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.Wake()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			return []byte("wake"), None
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	must(Serve(network+"://"+addr, events))
+	stats := srv.Stats()
+	if len(stats.Loops) != 1 {
+		t.Fatalf("%s: expected 1 loop, got %d", network, len(stats.Loops))
+	}
+	if stats.Accepted != 1 || stats.Closed != 1 || stats.Active != 0 {
+		t.Fatalf("%s: expected 1 accepted, 1 closed and 0 active, got %d, %d and %d",
+			network, stats.Accepted, stats.Closed, stats.Active)
+	}
+	if stats.BytesIn != 5 || stats.BytesOut != 9 || stats.QueuedBytes != 0 {
+		t.Fatalf("%s: expected 5 in, 9 out and 0 queued, got %d, %d and %d",
+			network, stats.BytesIn, stats.BytesOut, stats.QueuedBytes)
+	}
+	if stats.Reads == 0 || stats.Writes == 0 {
+		t.Fatalf("%s: expected reads and writes", network)
+	}
+	// Serving is not counted, it doesn't run on a loop
+	if stats.Wakeups != 1 || stats.Events != 4 {
+		t.Fatalf("%s: expected 1 wakeup and 4 events, got %d and %d",
+			network, stats.Wakeups, stats.Events)
+	}
+	var buf bytes.Buffer
+	must(stats.WritePrometheus(&buf))
+	for _, s := range []string{
+		"# TYPE evio_connections_accepted_total counter\n",
+		"evio_connections_accepted_total{loop=\"0\"} 1\n",
+		"evio_written_bytes_total{loop=\"0\"} 9\n",
+		"evio_connections_active{loop=\"0\"} 0\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%s: expected %q in\n%s", network, s, buf.String())
+		}
+	}
+}
+
+// BenchmarkEvents measures the cost of recovering from panics and of the
+// event stats, against calling the event directly.
+func BenchmarkEvents(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		events Events
+		wrap   bool
+	}{
+		{"Direct", Events{}, false},
+		{"Recover", Events{}, true},
+		{"EventStats", Events{EventStats: true}, true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			events := bc.events
+			events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+				return in, None
+			}
+			if bc.wrap {
+				events = recoverEvents(events, newLoopStats(1))
+			}
+			c := &stdconn{loop: &stdloop{}}
+			in := []byte("ping")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				events.Data(c, in)
+			}
+		})
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	testMaxConns(t, "tcp", ":20044")
+	testMaxConns(t, "tcp-net", ":20045")
+}
+
+func testMaxConns(t *testing.T, network, addr string) {
+	var events Events
+	events.NumLoops = 2
+	events.MaxConns = 3
+	events.MaxConnsPerIP = 2
+	rejected := make(chan error, 10)
+	closed := make(chan bool, 10)
+	dial := func(ip string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		c, err := d.Dial("tcp", "127.0.0.1"+addr)
+		must(err)
+		return c
+	}
+	echo := func(c net.Conn) {
+		fmt.Fprintf(c, "hi")
+		data := make([]byte, 2)
+		_, err := io.ReadFull(c, data)
+		must(err)
+	}
+	reject := func(c net.Conn, reason error) {
+		defer c.Close()
+		if err := <-rejected; err != reason {
+			panic(fmt.Sprintf("expected '%v', got '%v'", reason, err))
+		}
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			panic("expected closed connection")
+		}
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			a1, a2 := dial("127.0.0.1"), dial("127.0.0.1")
+			echo(a1)
+			echo(a2)
+			reject(dial("127.0.0.1"), ErrMaxConnsPerIP)
+			b1 := dial("127.0.0.2")
+			echo(b1)
+			reject(dial("127.0.0.2"), ErrMaxConns)
+			a1.Close()
+			<-closed
+			a3 := dial("127.0.0.1")
+			echo(a3)
+			fmt.Fprintf(a3, "quit")
+		}()
+		return
+	}
+	events.Rejected = func(remote net.Addr, reason error) {
+		rejected <- reason
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed <- true
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+}
+
+func TestRateLimits(t *testing.T) {
+	testRateLimits(t, "tcp", ":20046")
+	testRateLimits(t, "tcp-net", ":20047")
+}
+
+func testRateLimits(t *testing.T, network, addr string) {
+	const rate, size = 50000, 100000
+	var events Events
+	var nopened int
+	var readStart time.Time
+	var readTime, writeTime time.Duration
+	var nread int
+	var done int32
+	rejected := make(chan error, 1)
+	events.AcceptRatePerIP = 2
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			a, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer a.Close()
+			b, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer b.Close()
+			c, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c.Close()
+			if err := <-rejected; err != ErrAcceptRate {
+				panic(fmt.Sprintf("expected '%v', got '%v'", ErrAcceptRate, err))
+			}
+			go func() {
+				_, err := b.Write(make([]byte, size))
+				must(err)
+			}()
+			start := time.Now()
+			_, err = io.ReadFull(a, make([]byte, size))
+			must(err)
+			writeTime = time.Since(start)
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	events.Rejected = func(remote net.Addr, reason error) {
+		rejected <- reason
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		nopened++
+		if nopened == 1 {
+			opts.WriteRate = rate
+			out = make([]byte, size)
+		} else {
+			opts.ReadRate = rate
+			readStart = time.Now()
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if len(in) > rate {
+			t.Errorf("%s: expected reads of at most %d bytes, got %d", network, rate, len(in))
+			return nil, Shutdown
+		}
+		if nread += len(in); nread == size {
+			readTime = time.Since(readStart)
+		}
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 && nread == size {
+			return 0, Shutdown
+		}
+		return time.Millisecond * 10, None
+	}
+	must(Serve(network+"://"+addr, events))
+	// a second of bytes is the burst, and the rest takes another second.
+	for _, d := range []time.Duration{readTime, writeTime} {
+		if d < time.Second*8/10 || d > time.Second*3 {
+			t.Fatalf("%s: expected about a second, got %s and %s", network, readTime, writeTime)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.2.3.4"})
+	must(err)
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":        true,
+		"10.1.2.3":        false,
+		"10.2.3.4":        false,
+		"10.2.3.5":        true,
+		"11.0.0.1":        false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::ffff:10.0.0.1": true,
+	} {
+		if acl.Allowed(net.ParseIP(ip)) != allowed {
+			t.Fatalf("expected %v for %s", allowed, ip)
+		}
+	}
+	if !acl.Allowed(nil) || !(*ACL)(nil).Allowed(net.ParseIP("1.2.3.4")) {
+		t.Fatal("expected allowed")
+	}
+	if _, err := NewACL([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := NewACL(nil, []string{"localhost"}); err == nil {
+		t.Fatal("expected error")
+	}
+	testACL(t, "tcp", ":20048")
+	testACL(t, "tcp-net", ":20049")
+}
+
+func testACL(t *testing.T, network, addr string) {
+	var events Events
+	var err error
+	events.ACL, err = NewACL(nil, []string{"127.0.0.2"})
+	must(err)
+	rejected := make(chan error, 10)
+	dial := func(ip string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		c, err := d.Dial("tcp", "127.0.0.1"+addr)
+		must(err)
+		return c
+	}
+	echo := func(c net.Conn) {
+		defer c.Close()
+		fmt.Fprintf(c, "hi")
+		data := make([]byte, 2)
+		_, err := io.ReadFull(c, data)
+		must(err)
+	}
+	reject := func(c net.Conn) {
+		defer c.Close()
+		if err := <-rejected; err != ErrDenied {
+			panic(fmt.Sprintf("expected '%v', got '%v'", ErrDenied, err))
+		}
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			panic("expected closed connection")
+		}
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			echo(dial("127.0.0.1"))
+			reject(dial("127.0.0.2"))
+			reject(dial("127.0.0.3")) // denied by Accept
+			acl, err := NewACL([]string{"127.0.0.2/32"}, nil)
+			must(err)
+			must(srv.SetACL(acl))
+			reject(dial("127.0.0.1"))
+			echo(dial("127.0.0.2"))
+			must(srv.SetACL(nil))
+			c := dial("127.0.0.1")
+			fmt.Fprintf(c, "quit")
+			c.Read(make([]byte, 1))
+			c.Close()
+		}()
+		return
+	}
+	events.Accept = func(remote net.Addr) bool {
+		return !remote.(*net.TCPAddr).IP.Equal(net.ParseIP("127.0.0.3"))
+	}
+	events.Rejected = func(remote net.Addr, reason error) {
+		rejected <- reason
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(network+"://"+addr, events))
+}
+
+func proxyV2Header(cmd, fam byte, addrs []byte, tlvs ...ProxyTLV) []byte {
+	body := append([]byte{}, addrs...)
+	for _, tlv := range tlvs {
+		body = append(body, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		body = append(body, tlv.Value...)
+	}
+	hdr := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20|cmd, fam, byte(len(body)>>8), byte(len(body)))
+	return append(hdr, body...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	v4 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0x57, 0x08, 0xAE}
+	tlv := ProxyTLV{Type: 0x02, Value: []byte("example.com")}
+	for _, tc := range []struct {
+		in       string
+		versions int
+		n        int
+		src, dst string
+		local    bool
+		tlvs     int
+		err      bool
+	}{
+		{in: "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\nhi", versions: proxyV1,
+			n: 38, src: "1.2.3.4:1111", dst: "5.6.7.8:2222"},
+		{in: "PROXY TCP6 2001:db8::1 2001:db8::2 1111 2222\r\n", versions: proxyV1 | proxyV2,
+			n: 46, src: "[2001:db8::1]:1111", dst: "[2001:db8::2]:2222"},
+		{in: "PROXY UNKNOWN\r\n", versions: proxyV1, n: 15, local: true},
+		{in: "PROXY TCP4 1.2.3.4 5.6.7.8 1111", versions: proxyV1},
+		{in: "PRO", versions: proxyV1},
+		{in: "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n", versions: proxyV2, err: true},
+		{in: "PROXY TCP4 2001:db8::1 5.6.7.8 1111 2222\r\n", versions: proxyV1, err: true},
+		{in: "PROXY TCP4 1.2.3.4 5.6.7.8 1111 65536\r\n", versions: proxyV1, err: true},
+		{in: "PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n", versions: proxyV1, err: true},
+		{in: "PROXY " + strings.Repeat("X", 110), versions: proxyV1, err: true},
+		{in: "GET / HTTP/1.1\r\n", versions: proxyV1 | proxyV2, err: true},
+		{in: string(proxyV2Header(1, 0x11, v4, tlv)), versions: proxyV2,
+			n: 42, src: "1.2.3.4:1111", dst: "5.6.7.8:2222", tlvs: 1},
+		{in: string(proxyV2Header(0, 0x11, v4)), versions: proxyV2, n: 28, local: true},
+		{in: string(proxyV2Header(1, 0x00, nil)), versions: proxyV2, n: 16, local: true},
+		{in: string(proxyV2Header(1, 0x11, v4, tlv)[:30]), versions: proxyV2},
+		{in: "\r\n\r\n\x00", versions: proxyV2},
+		{in: string(proxyV2Header(1, 0x11, v4[:8])), versions: proxyV2, err: true},
+		{in: string(proxyV2Header(2, 0x11, v4)), versions: proxyV2, err: true},
+		{in: string(proxyV2Header(1, 0x11, append(v4, 0x02, 0x00))), versions: proxyV2, err: true},
+	} {
+		h, n, err := parseProxyHeader([]byte(tc.in), tc.versions)
+		if (err != nil) != tc.err {
+			t.Fatalf("%q: unexpected error: %v", tc.in, err)
+		}
+		if n != tc.n {
+			t.Fatalf("%q: expected length %d, got %d", tc.in, tc.n, n)
+		}
+		if tc.err || tc.n == 0 {
+			if h != nil {
+				t.Fatalf("%q: expected no header", tc.in)
+			}
+			continue
+		}
+		if h.Local != tc.local || len(h.TLVs) != tc.tlvs {
+			t.Fatalf("%q: unexpected header %+v", tc.in, h)
+		}
+		if !tc.local && (h.Source.String() != tc.src || h.Destination.String() != tc.dst) {
+			t.Fatalf("%q: unexpected addresses %v %v", tc.in, h.Source, h.Destination)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	defer func(d time.Duration) { proxyHeaderTimeout = d }(proxyHeaderTimeout)
+	proxyHeaderTimeout = time.Millisecond * 200
+	testProxyProtocol(t, "tcp", ":20050")
+	testProxyProtocol(t, "tcp-net", ":20051")
+}
+
+func testProxyProtocol(t *testing.T, network, addr string) {
+	var events Events
+	rejected := make(chan error, 1)
+	dial := func(header []byte, parts ...string) net.Conn {
+		c, err := net.Dial("tcp", "127.0.0.1"+addr)
+		must(err)
+		// split the header over two writes
+		c.Write(header[:len(header)/2])
+		time.Sleep(time.Millisecond * 10)
+		c.Write(header[len(header)/2:])
+		for _, part := range parts {
+			c.Write([]byte(part))
+		}
+		return c
+	}
+	echo := func(c net.Conn, expect string) {
+		defer c.Close()
+		data := make([]byte, len(expect))
+		_, err := io.ReadFull(c, data)
+		must(err)
+		if string(data) != expect {
+			panic(fmt.Sprintf("expected '%s', got '%s'", expect, data))
+		}
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			echo(dial([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\nhi")),
+				"1.2.3.4:1111 5.6.7.8:2222 0 hi")
+			v6 := append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...)
+			hdr := proxyV2Header(1, 0x21, append(v6, 0x04, 0x57, 0x08, 0xAE),
+				ProxyTLV{Type: 0x02, Value: []byte("example.com")})
+			echo(dial(hdr, "hi"), "[2001:db8::1]:1111 [2001:db8::2]:2222 1 hi")
+			echo(dial(proxyV2Header(0, 0x00, nil), "hi"), "local 0 hi")
+			c := dial([]byte("GET / HTTP/1.1\r\n\r\n"))
+			if err := <-rejected; !errors.Is(err, ErrProxyHeader) {
+				panic(fmt.Sprintf("expected '%v', got '%v'", ErrProxyHeader, err))
+			}
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				panic("expected closed connection")
+			}
+			c.Close()
+			// never sends the header
+			c = dial(nil)
+			start := time.Now()
+			if err := <-rejected; !errors.Is(err, ErrProxyHeader) || !errors.Is(err, ErrTimeout) {
+				panic(fmt.Sprintf("expected '%v', got '%v'", ErrTimeout, err))
+			}
+			if d := time.Since(start); d < time.Millisecond*150 {
+				panic(fmt.Sprintf("expected a timeout after 200ms, got %s", d))
+			}
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				panic("expected closed connection")
+			}
+			c.Close()
+			c = dial([]byte("PROXY UNKNOWN\r\n"), "quit")
+			c.Read(make([]byte, 1))
+			c.Close()
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		h := c.ProxyHeader()
+		if h == nil {
+			panic("expected header")
+		}
+		if h.Local {
+			out = []byte("local ")
+		} else {
+			out = []byte(c.RemoteAddr().String() + " " + c.LocalAddr().String() + " ")
+		}
+		out = append(out, byte('0'+len(h.TLVs)), ' ')
+		return
+	}
+	events.Rejected = func(remote net.Addr, reason error) {
+		rejected <- reason
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(network+"://"+addr+"?proxy_protocol=v1,v2", events))
+}
+
+func testCert(name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	must(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	must(err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLS(t *testing.T) {
+	testTLS(t, "tcp", ":20052")
+	testTLS(t, "tcp-net", ":20053")
+}
+
+// errNoCloseNotify is the end of a closeNotifyConn.
+var errNoCloseNotify = errors.New("closed without close_notify")
+
+// closeNotifyConn is the net.Conn of a TLS client that only reads io.EOF
+// after a close_notify alert.
+type closeNotifyConn struct{ net.Conn }
+
+func (c closeNotifyConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err == io.EOF {
+		err = errNoCloseNotify
+	}
+	return n, err
+}
+
+func testTLS(t *testing.T, network, addr string) {
+	serverCert, clientCert := testCert("example.com"), testCert("client")
+	getCert, unblock := make(chan bool), make(chan bool)
+	serverConfig := &tls.Config{
+		NextProtos: []string{"x"},
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "blocked.example.com" {
+				getCert <- true
+				<-unblock
+				return &serverCert, nil
+			}
+			if hello.ServerName != "example.com" {
+				return nil, errors.New("unknown server name")
+			}
+			return &serverCert, nil
+		},
+	}
+	clientConfig := &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{"x"},
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	}
+	var events Events
+	handshakeErr := make(chan error, 1)
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// a handshake that waits in GetCertificate doesn't hold up
+			// the loop
+			blocked := make(chan error, 1)
+			go func() {
+				config := clientConfig.Clone()
+				config.ServerName = "blocked.example.com"
+				c, err := tls.Dial("tcp", "127.0.0.1"+addr, config)
+				if err == nil {
+					c.Close()
+				}
+				blocked <- err
+			}()
+			<-getCert
+
+			c, err := tls.Dial("tcp", "127.0.0.1"+addr, clientConfig)
+			must(err)
+			rd := bufio.NewReader(c)
+			line, err := rd.ReadString('\n')
+			must(err)
+			if line != "hello\n" {
+				panic(fmt.Sprintf("expected 'hello', got '%s'", line))
+			}
+			fmt.Fprintf(c, "info\n")
+			line, err = rd.ReadString('\n')
+			must(err)
+			if line != "example.com x 1\n" {
+				panic(fmt.Sprintf("expected 'example.com x 1', got '%s'", line))
+			}
+			data := bytes.Repeat([]byte("0123456789"), 100000)
+			go c.Write(data)
+			echo := make([]byte, len(data))
+			_, err = io.ReadFull(rd, echo)
+			must(err)
+			if !bytes.Equal(echo, data) {
+				panic("mismatch")
+			}
+			fmt.Fprintf(c, "detach\n")
+			line, err = rd.ReadString('\n')
+			must(err)
+			fmt.Fprintf(c, "abc\n")
+			line, err = rd.ReadString('\n')
+			must(err)
+			if line != "detached abc\n" {
+				panic(fmt.Sprintf("expected 'detached abc', got '%s'", line))
+			}
+			c.Close()
+			close(unblock)
+			must(<-blocked)
+
+			// a close of the server sends a close_notify alert
+			raw, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			c = tls.Client(closeNotifyConn{raw}, clientConfig)
+			rd = bufio.NewReader(c)
+			_, err = rd.ReadString('\n')
+			must(err)
+			fmt.Fprintf(c, "close\n")
+			if _, err := rd.ReadByte(); err != io.EOF {
+				panic(fmt.Sprintf("expected EOF, got %v", err))
+			}
+			c.Close()
+
+			// not a TLS client
+			raw, err = net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			fmt.Fprintf(raw, "GET / HTTP/1.1\r\n\r\n")
+			if err := <-handshakeErr; !errors.Is(err, ErrTLSHandshake) {
+				panic(fmt.Sprintf("expected '%v', got '%v'", ErrTLSHandshake, err))
+			}
+			raw.Close()
+
+			// an outbound TLS connection to the server
+			_, err = srv.Dial("tcp", "127.0.0.1"+addr, nil)
+			must(err)
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if c.TLS() != nil {
+			panic("expected no TLS state before the handshake")
+		}
+		if c.Outbound() {
+			opts.TLSConfig = clientConfig
+			c.SetContext(new(bytes.Buffer))
+			c.Write([]byte("ping\n"))
+			return
+		}
+		opts.TLSConfig = serverConfig
+		return []byte("hello\n"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		st := c.TLS()
+		if st == nil || !st.HandshakeComplete {
+			panic("expected TLS state")
+		}
+		if c.Outbound() {
+			buf := c.Context().(*bytes.Buffer)
+			buf.Write(in)
+			if buf.String() == "hello\nping\n" {
+				return nil, Shutdown
+			}
+			return
+		}
+		if string(in) == "detach\n" {
+			return []byte("ok\n"), Detach
+		}
+		if string(in) == "close\n" {
+			return nil, Close
+		}
+		if string(in) == "info\n" {
+			return []byte(fmt.Sprintf("%s %s %d\n", st.ServerName,
+				st.NegotiatedProtocol, len(st.PeerCertificates))), None
+		}
+		return in, None
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		go func() {
+			defer rwc.Close()
+			line, err := bufio.NewReader(rwc).ReadString('\n')
+			must(err)
+			fmt.Fprintf(rwc, "detached %s", line)
+		}()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if errors.Is(err, ErrTLSHandshake) {
+			handshakeErr <- err
+		}
+		return
+	}
+	must(Serve(network+"://"+addr, events))
+}
@@ -5,40 +5,21 @@
 package main
 
 import (
-	"bytes"
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"strconv"
 	"strings"
-	"time"
 
-	"github.com/tidwall/evio"
+	"evio"
+	"evio/http1"
 )
 
-var res string
-
-type request struct {
-	proto, method string
-	path, query   string
-	head, body    string
-	remoteAddr    string
-}
-
-type conn struct {
-	info evio.Info
-	is   evio.InputStream
-}
-
 func main() {
 	var port int
 	var tlsport int
 	var tlspem string
 	var aaaa bool
-	var noparse bool
 	var unixsocket string
 	var stdlib bool
 	flag.StringVar(&unixsocket, "unixsocket", "", "unix socket")
@@ -46,24 +27,24 @@ func main() {
 	flag.IntVar(&tlsport, "tlsport", 4443, "tls port")
 	flag.StringVar(&tlspem, "tlscert", "", "tls pem cert/key file")
 	flag.BoolVar(&aaaa, "aaaa", false, "aaaaa....")
-	flag.BoolVar(&noparse, "noparse", true, "do not parse requests")
 	flag.BoolVar(&stdlib, "stdlib", false, "use stdlib")
 	flag.Parse()
 
-	if os.Getenv("NOPARSE") == "1" {
-		noparse = true
-	}
-
+	var res string
 	if aaaa {
 		res = strings.Repeat("a", 1024)
 	} else {
 		res = "Hello World!\r\n"
 	}
 
-	var events evio.Events
-	var conns = make(map[int]*conn)
+	var server http1.Server
+	server.Handler = func(w *http1.ResponseWriter, r *http1.Request) {
+		w.AddHeader("Server", "evio")
+		w.WriteString(res)
+	}
+	events := server.Events()
 
-	events.Serving = func(server evio.Server) (action evio.Action) {
+	events.Serving = func(srv evio.Server) (action evio.Action) {
 		log.Printf("http server started on port %d", port)
 		if tlspem != "" {
 			log.Printf("https server started on port %d", tlsport)
@@ -77,55 +58,6 @@ func main() {
 		return
 	}
 
-	events.Opened = func(id int, info evio.Info) (out []byte, opts evio.Options, action evio.Action) {
-		conns[id] = &conn{info: info}
-		log.Printf("opened: %d: laddr: %v: raddr: %v", id, info.LocalAddr, info.RemoteAddr)
-
-		// println(info.LocalAddr.(*net.TCPAddr).Zone)
-		// fmt.Printf("%#v\n", info.LocalAddr)
-		// fmt.Printf("%#v\n", (&net.TCPAddr{IP: make([]byte, 16)}))
-		return
-	}
-
-	events.Closed = func(id int, err error) (action evio.Action) {
-		c := conns[id]
-		log.Printf("closed: %d: %s: %s", id, c.info.LocalAddr.String(), c.info.RemoteAddr.String())
-		delete(conns, id)
-		return
-	}
-
-	events.Data = func(id int, in []byte) (out []byte, action evio.Action) {
-		if in == nil {
-			return
-		}
-		c := conns[id]
-		data := c.is.Begin(in)
-		if noparse && bytes.Contains(data, []byte("\r\n\r\n")) {
-			// for testing minimal single packet request -> response.
-			out = appendresp(nil, "200 OK", "", res)
-			return
-		}
-		// process the pipeline
-		var req request
-		for {
-			leftover, err := parsereq(data, &req)
-			if err != nil {
-				// bad thing happened
-				out = appendresp(out, "500 Error", "", err.Error()+"\n")
-				action = evio.Close
-				break
-			} else if len(leftover) == len(data) {
-				// request not ready, yet
-				break
-			}
-			// handle the request
-			req.remoteAddr = c.info.RemoteAddr.String()
-			out = appendhandle(out, &req)
-			data = leftover
-		}
-		c.is.End(data)
-		return
-	}
 	var ssuf string
 	if stdlib {
 		ssuf = "-net"
@@ -142,123 +74,19 @@ func main() {
 		// Update the address list to include https.
 		addrs = append(addrs, fmt.Sprintf("tcp"+ssuf+"://:%d", tlsport))
 
-		// TLS translate the events
-		events = evio.Translate(events,
-			func(id int, info evio.Info) bool {
-				// only translate for the second address.
-				return info.AddrIndex == 1
-			},
-			func(id int, rw io.ReadWriter) io.ReadWriter {
-				// Use the standard Go crypto/tls package and create a tls.Conn
-				// from the provided io.ReadWriter. Here we use the handy
-				// evio.NopConn utility to create a barebone net.Conn in order
-				// for the tls.Server to accept the connection.
-				return tls.Server(evio.NopConn(rw), config)
-			},
-		)
+		// TLS is only for the connections of the second address.
+		opened := events.Opened
+		events.Opened = func(c evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
+			out, opts, action = opened(c)
+			if c.AddrIndex() == 1 {
+				opts.TLSConfig = config
+			}
+			return
+		}
 	}
 	if unixsocket != "" {
 		addrs = append(addrs, fmt.Sprintf("unix"+ssuf+"://%s", unixsocket))
 	}
 	// Start serving!
-	log.Fatal(evio.Serve(events, addrs...))
-}
-
-// appendhandle handles the incoming request and appends the response to
-// the provided bytes, which is then returned to the caller.
-func appendhandle(b []byte, req *request) []byte {
-	return appendresp(b, "200 OK", "", res)
-}
-
-// appendresp will append a valid http response to the provide bytes.
-// The status param should be the code plus text such as "200 OK".
-// The head parameter should be a series of lines ending with "\r\n" or empty.
-func appendresp(b []byte, status, head, body string) []byte {
-	b = append(b, "HTTP/1.1"...)
-	b = append(b, ' ')
-	b = append(b, status...)
-	b = append(b, '\r', '\n')
-	b = append(b, "Server: evio\r\n"...)
-	b = append(b, "Date: "...)
-	b = time.Now().AppendFormat(b, "Mon, 02 Jan 2006 15:04:05 GMT")
-	b = append(b, '\r', '\n')
-	if len(body) > 0 {
-		b = append(b, "Content-Length: "...)
-		b = strconv.AppendInt(b, int64(len(body)), 10)
-		b = append(b, '\r', '\n')
-	}
-	b = append(b, head...)
-	b = append(b, '\r', '\n')
-	if len(body) > 0 {
-		b = append(b, body...)
-	}
-	return b
-}
-
-// parsereq is a very simple http request parser. This operation
-// waits for the entire payload to be buffered before returning a
-// valid request.
-func parsereq(data []byte, req *request) (leftover []byte, err error) {
-	sdata := string(data)
-	var i, s int
-	var top string
-	var clen int
-	var q = -1
-	// method, path, proto line
-	for ; i < len(sdata); i++ {
-		if sdata[i] == ' ' {
-			req.method = sdata[s:i]
-			for i, s = i+1, i+1; i < len(sdata); i++ {
-				if sdata[i] == '?' && q == -1 {
-					q = i - s
-				} else if sdata[i] == ' ' {
-					if q != -1 {
-						req.path = sdata[s:q]
-						req.query = req.path[q+1 : i]
-					} else {
-						req.path = sdata[s:i]
-					}
-					for i, s = i+1, i+1; i < len(sdata); i++ {
-						if sdata[i] == '\n' && sdata[i-1] == '\r' {
-							req.proto = sdata[s:i]
-							i, s = i+1, i+1
-							break
-						}
-					}
-					break
-				}
-			}
-			break
-		}
-	}
-	if req.proto == "" {
-		return data, fmt.Errorf("malformed request")
-	}
-	top = sdata[:s]
-	for ; i < len(sdata); i++ {
-		if i > 1 && sdata[i] == '\n' && sdata[i-1] == '\r' {
-			line := sdata[s : i-1]
-			s = i + 1
-			if line == "" {
-				req.head = sdata[len(top)+2 : i+1]
-				i++
-				if clen > 0 {
-					if len(sdata[i:]) < clen {
-						break
-					}
-					req.body = sdata[i : i+clen]
-					i += clen
-				}
-				return data[i:], nil
-			}
-			if strings.HasPrefix(line, "Content-Length:") {
-				n, err := strconv.ParseInt(strings.TrimSpace(line[len("Content-Length:"):]), 10, 64)
-				if err == nil {
-					clen = int(n)
-				}
-			}
-		}
-	}
-	// not enough data
-	return data, nil
+	log.Fatal(evio.ServeAddrs(events, addrs...))
 }
@@ -8,19 +8,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"strings"
 	"sync"
 
 	"evio"
-
-	"github.com/tidwall/redcon"
+	"evio/resp"
 )
 
-type conn struct {
-	is   evio.InputStream
-	addr string
-}
-
 func main() {
 	var port int
 	var unixsocket string
@@ -36,7 +29,65 @@ func main() {
 
 	var mu sync.RWMutex
 	var keys = make(map[string]string)
-	var events evio.Events
+	var router resp.Router
+	router.Handle("ping", -1, func(c *resp.Conn, args [][]byte) {
+		switch len(args) {
+		case 1:
+			c.WriteString("PONG")
+		case 2:
+			c.WriteBulk(args[1])
+		default:
+			c.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		}
+	})
+	router.Handle("echo", 2, func(c *resp.Conn, args [][]byte) {
+		c.WriteBulk(args[1])
+	})
+	router.Handle("shutdown", -1, func(c *resp.Conn, args [][]byte) {
+		c.WriteString("OK")
+		c.Action = evio.Shutdown
+	})
+	router.Handle("quit", 1, func(c *resp.Conn, args [][]byte) {
+		c.WriteString("OK")
+		c.Action = evio.Close
+	})
+	router.Handle("get", 2, func(c *resp.Conn, args [][]byte) {
+		mu.RLock()
+		val, ok := keys[string(args[1])]
+		mu.RUnlock()
+		if !ok {
+			c.WriteNull()
+		} else {
+			c.WriteBulkString(val)
+		}
+	})
+	router.Handle("set", 3, func(c *resp.Conn, args [][]byte) {
+		key, val := string(args[1]), string(args[2])
+		mu.Lock()
+		keys[key] = val
+		mu.Unlock()
+		c.WriteString("OK")
+	})
+	router.Handle("del", -2, func(c *resp.Conn, args [][]byte) {
+		var n int
+		mu.Lock()
+		for i := 1; i < len(args); i++ {
+			if _, ok := keys[string(args[i])]; ok {
+				n++
+				delete(keys, string(args[i]))
+			}
+		}
+		mu.Unlock()
+		c.WriteInt(int64(n))
+	})
+	router.Handle("flushdb", 1, func(c *resp.Conn, args [][]byte) {
+		mu.Lock()
+		keys = make(map[string]string)
+		mu.Unlock()
+		c.WriteString("OK")
+	})
+
+	events := router.Events()
 	switch balance {
 	default:
 		log.Fatalf("invalid -balance flag: '%v'", balance)
@@ -58,112 +109,6 @@ func main() {
 		}
 		return
 	}
-	events.Opened = func(ec evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
-		//fmt.Printf("opened: %v\n", ec.RemoteAddr())
-		ec.SetContext(&conn{})
-		return
-	}
-	events.Closed = func(ec evio.Conn, err error) (action evio.Action) {
-		// fmt.Printf("closed: %v\n", ec.RemoteAddr())
-		return
-	}
-
-	events.Data = func(ec evio.Conn, in []byte) (out []byte, action evio.Action) {
-		if in == nil {
-			log.Printf("wake from %s\n", ec.RemoteAddr())
-			return nil, evio.Close
-		}
-		c := ec.Context().(*conn)
-		data := c.is.Begin(in)
-		var n int
-		var complete bool
-		var err error
-		var args [][]byte
-		for action == evio.None {
-			complete, args, _, data, err = redcon.ReadNextCommand(data, args[:0])
-			if err != nil {
-				action = evio.Close
-				out = redcon.AppendError(out, err.Error())
-				break
-			}
-			if !complete {
-				break
-			}
-			if len(args) > 0 {
-				n++
-				switch strings.ToUpper(string(args[0])) {
-				default:
-					out = redcon.AppendError(out, "ERR unknown command '"+string(args[0])+"'")
-				case "PING":
-					if len(args) > 2 {
-						out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command")
-					} else if len(args) == 2 {
-						out = redcon.AppendBulk(out, args[1])
-					} else {
-						out = redcon.AppendString(out, "PONG")
-					}
-				case "ECHO":
-					if len(args) != 2 {
-						out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command")
-					} else {
-						out = redcon.AppendBulk(out, args[1])
-					}
-				case "SHUTDOWN":
-					out = redcon.AppendString(out, "OK")
-					action = evio.Shutdown
-				case "QUIT":
-					out = redcon.AppendString(out, "OK")
-					action = evio.Close
-				case "GET":
-					if len(args) != 2 {
-						out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command")
-					} else {
-						key := string(args[1])
-						mu.Lock()
-						val, ok := keys[key]
-						mu.Unlock()
-						if !ok {
-							out = redcon.AppendNull(out)
-						} else {
-							out = redcon.AppendBulkString(out, val)
-						}
-					}
-				case "SET":
-					if len(args) != 3 {
-						out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command")
-					} else {
-						key, val := string(args[1]), string(args[2])
-						mu.Lock()
-						keys[key] = val
-						mu.Unlock()
-						out = redcon.AppendString(out, "OK")
-					}
-				case "DEL":
-					if len(args) < 2 {
-						out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command")
-					} else {
-						var n int
-						mu.Lock()
-						for i := 1; i < len(args); i++ {
-							if _, ok := keys[string(args[i])]; ok {
-								n++
-								delete(keys, string(args[i]))
-							}
-						}
-						mu.Unlock()
-						out = redcon.AppendInt(out, int64(n))
-					}
-				case "FLUSHDB":
-					mu.Lock()
-					keys = make(map[string]string)
-					mu.Unlock()
-					out = redcon.AppendString(out, "OK")
-				}
-			}
-		}
-		c.is.End(data)
-		return
-	}
 	var ssuf string
 	if stdlib {
 		ssuf = "-net"
@@ -0,0 +1,120 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package http1 implements HTTP/1.1 servers on evio.
+//
+// A Server produces the evio events that parse the pipelined requests of
+// the connections and append the responses of its handler to the output:
+//
+//	var s http1.Server
+//	s.Handler = func(w *http1.ResponseWriter, r *http1.Request) {
+//		w.AddHeader("Content-Type", "text/plain")
+//		w.WriteString("Hello World!\r\n")
+//	}
+//	evio.Serve("tcp://:8080", s.Events())
+//
+// The Parser and the ResponseWriter can also be used on their own, as the
+// codec of other servers.
+package http1
+
+import "evio"
+
+// Server is an HTTP/1.1 server. Its fields are set before calling Events.
+type Server struct {
+	// Options are the options of every connection, such as the timeouts
+	// and the TLSConfig.
+	Options evio.Options
+	// MaxHeaderSize limits the size of the request line and header
+	// fields, with the empty lines before the request line. Zero means
+	// DefaultMaxHeaderSize.
+	MaxHeaderSize int
+	// MaxBodySize limits the size of request bodies. Zero means
+	// DefaultMaxBodySize.
+	MaxBodySize int
+	// Handler writes the response to a request. It runs on the loop of
+	// the connection, in the order of the requests, and the request and
+	// the writer are only valid until it returns.
+	Handler func(w *ResponseWriter, r *Request)
+}
+
+// conn is the state of a connection, which is its context.
+type conn struct {
+	is      evio.InputStream
+	p       Parser
+	req     Request
+	w       ResponseWriter
+	out     []byte
+	closing bool // the input is ignored
+}
+
+// continueResponse is the interim response to a request that expects it.
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// Events returns the evio events of the server. The other events, such as
+// Serving and NumLoops, may be set on the result.
+func (s *Server) Events() evio.Events {
+	var events evio.Events
+	events.Opened = func(ec evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
+		c := &conn{}
+		c.p.MaxHeaderSize = s.MaxHeaderSize
+		c.p.MaxBodySize = s.MaxBodySize
+		ec.SetContext(c)
+		return nil, s.Options, evio.None
+	}
+	events.Data = func(ec evio.Conn, in []byte) (out []byte, action evio.Action) {
+		c, _ := ec.Context().(*conn)
+		if c == nil || c.closing || in == nil {
+			return nil, evio.None
+		}
+		// the output buffer is reused, since evio copies it
+		out = c.out[:0]
+		data := c.is.Begin(in)
+		for {
+			n, err := c.p.Parse(data, &c.req)
+			if err != nil {
+				c.w.Reset(out, nil)
+				c.w.WriteHeader(errorStatus(err))
+				out = c.w.End()
+				action = evio.Close
+				break
+			}
+			if n == 0 {
+				if c.p.Continue() {
+					out = append(out, continueResponse...)
+				}
+				break
+			}
+			data = data[n:]
+			c.req.Conn = ec
+			c.w.Reset(out, &c.req)
+			s.Handler(&c.w, &c.req)
+			out = c.w.End()
+			if !c.w.KeepAlive() {
+				action = evio.Close
+				break
+			}
+		}
+		if action != evio.None {
+			c.closing = true
+			data = nil
+		}
+		c.is.End(data)
+		c.out = out
+		return out, action
+	}
+	return events
+}
+
+// errorStatus returns the status code of a parser error.
+func errorStatus(err error) int {
+	switch err {
+	case ErrHeaderTooLarge:
+		return 431
+	case ErrBodyTooLarge:
+		return 413
+	case ErrUnsupportedEncoding:
+		return 501
+	}
+	return 400
+}
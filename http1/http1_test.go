@@ -0,0 +1,307 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package http1
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"evio"
+)
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	input := "GET /a?x=1 HTTP/1.1\r\nHost: example.com\r\nX-Empty:\r\n\r\n" +
+		"\r\nPOST /b HTTP/1.1\r\ncontent-length: 5\r\n\r\nhello" +
+		"POST /c HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3;ext=1\r\nabc\r\n10\r\n0123456789abcdef\r\n0\r\nX-Trailer: 1\r\n\r\n" +
+		"GET /d HTTP/1.0\r\nConnection: keep-alive\r\n\r\n" +
+		"GET /e HTTP/1.1\r\nConnection: close\r\n\r\n"
+	expect := []string{
+		"GET /a?x=1 HTTP/1.1 keepalive=true host=example.com body=",
+		"POST /b HTTP/1.1 keepalive=true host= body=hello",
+		"POST /c HTTP/1.1 keepalive=true host= body=abc0123456789abcdef",
+		"GET /d HTTP/1.0 keepalive=true host= body=",
+		"GET /e HTTP/1.1 keepalive=false host= body=",
+	}
+	format := func(r *Request) string {
+		return fmt.Sprintf("%s %s %s keepalive=%t host=%s body=%s",
+			r.Method, r.URI, r.Proto, r.KeepAlive, r.Get("HOST"), r.Body)
+	}
+	// all at once, and then a byte at a time like an InputStream
+	var p Parser
+	var req Request
+	data := []byte(input)
+	for _, s := range expect {
+		n, err := p.Parse(data, &req)
+		must(err)
+		if got := format(&req); n == 0 || got != s {
+			t.Fatalf("expected '%s', got '%s'", s, got)
+		}
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		t.Fatalf("expected no input, got %q", data)
+	}
+	var got []string
+	data = nil
+	for i := 0; i < len(input); i++ {
+		data = append(data, input[i])
+		n, err := p.Parse(data, &req)
+		must(err)
+		if n > 0 {
+			got = append(got, format(&req))
+			data = append([]byte(nil), data[n:]...)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expected %q, got %q", expect, got)
+	}
+	if string(req.Path()) != "/e" || req.Query() != nil {
+		t.Fatal("unexpected path")
+	}
+
+	for _, bad := range []struct {
+		input string
+		err   error
+	}{
+		{"GET / HTTP/2.0\r\n\r\n", ErrMalformed},
+		{"GET  HTTP/1.1\r\n\r\n", ErrMalformed},
+		{"G(T / HTTP/1.1\r\n\r\n", ErrMalformed},
+		{"GET / HTTP/1.1\r\nNo-Colon\r\n\r\n", ErrMalformed},
+		{"GET / HTTP/1.1\r\nA: 1\r\n folded\r\n\r\n", ErrMalformed},
+		{"GET / HTTP/1.1\r\nBad Name: 1\r\n\r\n", ErrMalformed},
+		{"POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", ErrMalformed},
+		{"POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n", ErrMalformed},
+		{"POST / HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n", ErrMalformed},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", ErrUnsupportedEncoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nx\r\n", ErrMalformed},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nab\r\n", ErrMalformed},
+		{"POST / HTTP/1.1\r\nContent-Length: 101\r\n\r\n", ErrBodyTooLarge},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n50\r\n" +
+			strings.Repeat("x", 80) + "\r\n50\r\n", ErrBodyTooLarge},
+		{"GET /" + strings.Repeat("x", 200) + " HTTP/1.1\r\n\r\n", ErrHeaderTooLarge},
+		{"GET /" + strings.Repeat("x", 200), ErrHeaderTooLarge},
+		{strings.Repeat("\r\n", 101), ErrHeaderTooLarge},
+		{strings.Repeat("\r\n", 95) + "GET / HTTP/1.1\r\n\r\n", ErrHeaderTooLarge},
+	} {
+		p := Parser{MaxHeaderSize: 200, MaxBodySize: 100}
+		if _, err := p.Parse([]byte(bad.input), &req); err != bad.err {
+			t.Fatalf("expected '%v' for %q, got '%v'", bad.err, bad.input, err)
+		}
+	}
+
+	p = Parser{}
+	head := []byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\n")
+	if n, _ := p.Parse(head, &req); n != 0 || !p.Continue() || p.Continue() {
+		t.Fatal("expected continue once")
+	}
+	if n, _ := p.Parse(append(head, "ok"...), &req); n != len(head)+2 || string(req.Body) != "ok" {
+		t.Fatal("expected body")
+	}
+}
+
+func TestResponseWriter(t *testing.T) {
+	var p Parser
+	var req Request
+	var w ResponseWriter
+	respond := func(request string, handler func(w *ResponseWriter)) string {
+		_, err := p.Parse([]byte(request), &req)
+		must(err)
+		w.Reset(nil, &req)
+		handler(&w)
+		out := string(w.End())
+		// without the date
+		i := strings.Index(out, "Date: ")
+		j := strings.Index(out[i:], "\r\n")
+		return out[:i] + out[i+j+2:]
+	}
+	for _, expect := range []struct {
+		request  string
+		handler  func(w *ResponseWriter)
+		response string
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", func(w *ResponseWriter) {
+			w.AddHeader("Content-Type", "text/plain")
+			w.WriteString("hello")
+		}, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello"},
+		{"HEAD / HTTP/1.1\r\n\r\n", func(w *ResponseWriter) {
+			w.WriteString("hello")
+		}, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"},
+		{"GET / HTTP/1.1\r\n\r\n", func(w *ResponseWriter) {
+			w.WriteHeader(204)
+			w.AddHeader("Connection", "close")
+		}, "HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n"},
+		{"GET / HTTP/1.1\r\n\r\n", func(w *ResponseWriter) {
+			w.WriteString("hello")
+			w.Flush()
+			w.Flush()
+			w.WriteString(strings.Repeat("x", 20))
+		}, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n14\r\n" +
+			strings.Repeat("x", 20) + "\r\n0\r\n\r\n"},
+		{"GET / HTTP/1.0\r\n\r\n", func(w *ResponseWriter) {
+			w.WriteString("a")
+			w.Flush()
+			w.WriteString("b")
+		}, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nab"},
+		{"GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", func(w *ResponseWriter) {
+			w.WriteHeader(404)
+		}, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n"},
+	} {
+		if got := respond(expect.request, expect.handler); got != expect.response {
+			t.Fatalf("expected %q, got %q", expect.response, got)
+		}
+	}
+
+	// no allocations once the buffers have grown
+	out := make([]byte, 0, 4096)
+	data := []byte("GET /index.html HTTP/1.1\r\nHost: localhost\r\nAccept: */*\r\n\r\n")
+	allocs := testing.AllocsPerRun(100, func() {
+		p.Parse(data, &req)
+		w.Reset(out, &req)
+		w.AddHeader("Content-Type", "text/html")
+		w.WriteString("Hello World!\r\n")
+		w.End()
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestServer(t *testing.T) {
+	testServer(t, "tcp://127.0.0.1:20058")
+	testServer(t, "tcp-net://127.0.0.1:20059")
+}
+
+func testServer(t *testing.T, addr string) {
+	var s Server
+	s.MaxBodySize = 1 << 20
+	s.Handler = func(w *ResponseWriter, r *Request) {
+		switch string(r.Path()) {
+		case "/echo":
+			w.Write(r.Body)
+		case "/stream":
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(w, "part %d\n", i)
+				w.Flush()
+			}
+		default:
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.URI, r.Conn.LocalAddr())
+		}
+	}
+	events := s.Events()
+	var done int32
+	events.Serving = func(srv evio.Server) (action evio.Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			testClient(srv.Addrs[0].String())
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action evio.Action) {
+		if atomic.LoadInt32(&done) != 0 {
+			action = evio.Shutdown
+		}
+		return 10 * time.Millisecond, action
+	}
+	must(evio.Serve(addr, events))
+}
+
+func testClient(addr string) {
+	// keep-alive, chunked bodies and 100-continue with net/http
+	var opened int32
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, a string) (net.Conn, error) {
+			atomic.AddInt32(&opened, 1)
+			return net.Dial(network, a)
+		},
+		ExpectContinueTimeout: 5 * time.Second,
+	}}
+	get := func(path string) string {
+		resp, err := client.Get("http://" + addr + path)
+		must(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		must(err)
+		return string(body)
+	}
+	if got, expect := get("/a?b=c"), "GET /a?b=c "+addr; got != expect {
+		panic(fmt.Sprintf("expected '%s', got '%s'", expect, got))
+	}
+	if got := get("/stream"); got != "part 0\npart 1\npart 2\n" {
+		panic(fmt.Sprintf("unexpected body %q", got))
+	}
+	big := strings.Repeat("0123456789", 50000)
+	req, err := http.NewRequest("POST", "http://"+addr+"/echo",
+		io.MultiReader(strings.NewReader(big))) // no length, so chunked
+	must(err)
+	req.Header.Set("Expect", "100-continue")
+	resp, err := client.Do(req)
+	must(err)
+	body, err := io.ReadAll(resp.Body)
+	must(err)
+	resp.Body.Close()
+	if string(body) != big || resp.ContentLength != int64(len(big)) {
+		panic("unexpected echo")
+	}
+	if n := atomic.LoadInt32(&opened); n != 1 {
+		panic(fmt.Sprintf("expected one connection, got %d", n))
+	}
+
+	// pipelining and errors
+	conn, err := net.Dial("tcp", addr)
+	must(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /1 HTTP/1.1\r\n\r\nPOST /echo HTTP/1.1\r\nContent-Length: 2\r\n\r\nhiGET /3 HTTP/1.1\r\n")
+	time.Sleep(50 * time.Millisecond)
+	fmt.Fprintf(conn, "\r\nGET /4 HTTP/1.1\r\nConnection: close\r\n\r\nGET /ignored HTTP/1.1\r\n\r\n")
+	rd := bufio.NewReader(conn)
+	for _, expect := range []string{"GET /1 ", "hi", "GET /3 ", "GET /4 "} {
+		resp, err := http.ReadResponse(rd, nil)
+		must(err)
+		body, err := io.ReadAll(resp.Body)
+		must(err)
+		if !bytes.HasPrefix(body, []byte(expect)) {
+			panic(fmt.Sprintf("expected '%s', got '%s'", expect, body))
+		}
+	}
+	if _, err := rd.ReadByte(); err != io.EOF {
+		panic(fmt.Sprintf("expected EOF, got %v", err))
+	}
+	for _, expect := range []struct {
+		request string
+		status  int
+	}{
+		{"GET / HTTP/1.1\r\nBad Name: 1\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", 501},
+		{"POST / HTTP/1.1\r\nContent-Length: 2000000\r\nExpect: 100-continue\r\n\r\n", 413},
+		{"GET / HTTP/1.1\r\nX: " + strings.Repeat("x", 70000) + "\r\n\r\n", 431},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		must(err)
+		_, err = conn.Write([]byte(expect.request))
+		must(err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		must(err)
+		if resp.StatusCode != expect.status || !resp.Close {
+			panic(fmt.Sprintf("expected status %d, got %d", expect.status, resp.StatusCode))
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package http1
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"evio"
+)
+
+// Defaults of the limits of a Parser or a Server.
+const (
+	DefaultMaxHeaderSize = 64 << 10
+	DefaultMaxBodySize   = 4 << 20
+)
+
+// maxChunkLine limits the size line of a chunk, with its extensions.
+const maxChunkLine = 4 << 10
+
+// Errors of the parser, which are answered with 400 Bad Request, 431
+// Request Header Fields Too Large, 413 Content Too Large and 501 Not
+// Implemented by the server.
+var (
+	ErrMalformed           = errors.New("http1: malformed request")
+	ErrHeaderTooLarge      = errors.New("http1: request header too large")
+	ErrBodyTooLarge        = errors.New("http1: request body too large")
+	ErrUnsupportedEncoding = errors.New("http1: unsupported transfer encoding")
+)
+
+// Field is a header field.
+type Field struct {
+	Name  []byte
+	Value []byte
+}
+
+// Request is a parsed request. Its byte slices point into the input of the
+// parser, so they're only valid until the next request is parsed and must
+// be copied to be kept.
+type Request struct {
+	// Method is the method, such as "GET".
+	Method []byte
+	// URI is the request target, such as "/search?q=evio".
+	URI []byte
+	// Proto is "HTTP/1.1" or "HTTP/1.0".
+	Proto []byte
+	// Header is the header fields, in order.
+	Header []Field
+	// Body is the body, with the chunked transfer encoding removed.
+	Body []byte
+	// KeepAlive is true when the connection is kept open after the
+	// response, which is the default for HTTP/1.1.
+	KeepAlive bool
+	// Conn is the connection of a request of the Server.
+	Conn evio.Conn
+
+	http10 bool
+}
+
+// Path returns the path of the URI.
+func (r *Request) Path() []byte {
+	if i := bytes.IndexByte(r.URI, '?'); i != -1 {
+		return r.URI[:i]
+	}
+	return r.URI
+}
+
+// Query returns the query of the URI, without the '?'.
+func (r *Request) Query() []byte {
+	if i := bytes.IndexByte(r.URI, '?'); i != -1 {
+		return r.URI[i+1:]
+	}
+	return nil
+}
+
+// Get returns the value of the first header field with the name, which is
+// matched without case, or nil.
+func (r *Request) Get(name string) []byte {
+	for _, f := range r.Header {
+		if equalFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return nil
+}
+
+// Parser is an incremental request parser. It's fed the unprocessed input
+// of a connection, such as the data of an evio.InputStream, and keeps the
+// progress of a partial request between calls.
+type Parser struct {
+	// MaxHeaderSize limits the size of the request line and header
+	// fields, with the empty lines before the request line. Zero means
+	// DefaultMaxHeaderSize.
+	MaxHeaderSize int
+	// MaxBodySize limits the size of the body. Zero means
+	// DefaultMaxBodySize.
+	MaxBodySize int
+
+	scanned int    // input that was searched for the end of the header
+	hlen    int    // length of the header, once complete
+	clen    int    // content length, or -1 for a chunked body
+	off     int    // offset of the next chunk
+	body    []byte // decoded chunks
+	expect  bool   // the client expects 100 Continue
+	cont    bool   // Continue was reported
+}
+
+// Parse parses the request at the start of data into req, and returns its
+// length. It returns zero and no error when the request is incomplete, and
+// it's then called again with the same input and more. After an error the
+// connection can't be parsed any further.
+func (p *Parser) Parse(data []byte, req *Request) (n int, err error) {
+	// empty lines before a request are ignored, but they count toward the
+	// size of the header, so that a stream of them isn't buffered forever
+	var skip int
+	for skip <= p.maxHeaderSize() && bytes.HasPrefix(data[skip:], crlf) {
+		skip += 2
+	}
+	if p.hlen == 0 {
+		start := p.scanned - 3
+		if start < skip {
+			start = skip
+		}
+		i := bytes.Index(data[start:], []byte("\r\n\r\n"))
+		if i == -1 {
+			if len(data) > p.maxHeaderSize() {
+				return 0, ErrHeaderTooLarge
+			}
+			p.scanned = len(data)
+			return 0, nil
+		}
+		p.hlen = start + i + 4
+		if p.hlen > p.maxHeaderSize() {
+			return 0, ErrHeaderTooLarge
+		}
+	}
+	// the header is parsed again with each part of the body, since the
+	// input may have moved
+	if err := p.parseHeader(data[skip:p.hlen], req); err != nil {
+		return 0, err
+	}
+	if p.clen >= 0 {
+		if len(data) < p.hlen+p.clen {
+			return 0, nil
+		}
+		n = p.hlen + p.clen
+		req.Body = data[p.hlen:n]
+	} else {
+		if n, err = p.parseChunks(data); n == 0 {
+			return 0, err
+		}
+		req.Body = p.body
+	}
+	p.scanned, p.hlen, p.off = 0, 0, 0
+	p.expect, p.cont = false, false
+	return n, nil
+}
+
+// Continue returns true, once for each request, when the client expects a
+// 100 Continue response before sending the body.
+func (p *Parser) Continue() bool {
+	if p.expect && !p.cont {
+		p.cont = true
+		return true
+	}
+	return false
+}
+
+func (p *Parser) maxHeaderSize() int {
+	if p.MaxHeaderSize > 0 {
+		return p.MaxHeaderSize
+	}
+	return DefaultMaxHeaderSize
+}
+
+func (p *Parser) maxBodySize() int {
+	if p.MaxBodySize > 0 {
+		return p.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+var crlf = []byte("\r\n")
+
+// parseHeader parses the request line and header fields, with the final
+// empty line, and the framing of the body.
+func (p *Parser) parseHeader(head []byte, req *Request) error {
+	i := bytes.Index(head, crlf)
+	line := head[:i]
+	head = head[i+2:]
+	sp1 := bytes.IndexByte(line, ' ')
+	sp2 := bytes.LastIndexByte(line, ' ')
+	if sp1 <= 0 || sp2 == sp1 || !isToken(line[:sp1]) {
+		return ErrMalformed
+	}
+	req.Method = line[:sp1]
+	req.URI = line[sp1+1 : sp2]
+	req.Proto = line[sp2+1:]
+	if len(req.URI) == 0 || bytes.IndexByte(req.URI, ' ') != -1 {
+		return ErrMalformed
+	}
+	switch string(req.Proto) {
+	case "HTTP/1.1":
+		req.http10 = false
+	case "HTTP/1.0":
+		req.http10 = true
+	default:
+		return ErrMalformed
+	}
+	req.Header = req.Header[:0]
+	req.Body = nil
+	for len(head) > 2 {
+		i := bytes.Index(head, crlf)
+		line := head[:i]
+		head = head[i+2:]
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || !isToken(line[:colon]) {
+			// obsolete line folding is malformed too
+			return ErrMalformed
+		}
+		req.Header = append(req.Header, Field{
+			Name:  line[:colon],
+			Value: bytes.Trim(line[colon+1:], " \t"),
+		})
+	}
+	conn := req.Get("Connection")
+	if req.http10 {
+		req.KeepAlive = hasToken(conn, "keep-alive")
+	} else {
+		req.KeepAlive = !hasToken(conn, "close")
+	}
+	return p.parseFraming(req)
+}
+
+// parseFraming sets the length of the body from the Content-Length and
+// Transfer-Encoding fields. Requests with both are refused, because they're
+// a way to smuggle requests past proxies.
+func (p *Parser) parseFraming(req *Request) error {
+	p.clen = 0
+	var te, cl []byte
+	for _, f := range req.Header {
+		switch {
+		case equalFold(f.Name, "Transfer-Encoding"):
+			if te != nil {
+				return ErrUnsupportedEncoding
+			}
+			te = f.Value
+		case equalFold(f.Name, "Content-Length"):
+			if cl != nil && !bytes.Equal(cl, f.Value) {
+				return ErrMalformed
+			}
+			cl = f.Value
+		}
+	}
+	switch {
+	case te != nil:
+		if cl != nil {
+			return ErrMalformed
+		}
+		if !equalFold(te, "chunked") {
+			return ErrUnsupportedEncoding
+		}
+		p.clen = -1
+		if p.off == 0 {
+			p.off = p.hlen
+			p.body = p.body[:0]
+		}
+	case cl != nil:
+		if len(cl) == 0 || len(cl) > 18 {
+			return ErrMalformed
+		}
+		for _, c := range cl {
+			if c < '0' || c > '9' {
+				return ErrMalformed
+			}
+			p.clen = p.clen*10 + int(c-'0')
+		}
+		if p.clen > p.maxBodySize() {
+			return ErrBodyTooLarge
+		}
+	}
+	p.expect = !req.http10 && equalFold(req.Get("Expect"), "100-continue")
+	return nil
+}
+
+// parseChunks decodes the chunks of data that follow the last decoded
+// chunk, and returns the length of the request once the last chunk and the
+// trailer fields are complete.
+func (p *Parser) parseChunks(data []byte) (int, error) {
+	for {
+		i := bytes.Index(data[p.off:], crlf)
+		if i == -1 {
+			if len(data)-p.off > maxChunkLine {
+				return 0, ErrMalformed
+			}
+			return 0, nil
+		}
+		line := data[p.off : p.off+i]
+		if j := bytes.IndexByte(line, ';'); j != -1 {
+			line = line[:j] // chunk extensions are ignored
+		}
+		size, ok := parseHex(bytes.TrimRight(line, " \t"))
+		if !ok {
+			return 0, ErrMalformed
+		}
+		start := p.off + i + 2
+		if size == 0 {
+			// the trailer fields are ignored
+			if bytes.HasPrefix(data[start:], crlf) {
+				return start + 2, nil
+			}
+			end := bytes.Index(data[start:], []byte("\r\n\r\n"))
+			if end == -1 {
+				if len(data)-start > p.maxHeaderSize() {
+					return 0, ErrHeaderTooLarge
+				}
+				return 0, nil
+			}
+			return start + end + 4, nil
+		}
+		if p.maxBodySize()-len(p.body) < size {
+			return 0, ErrBodyTooLarge
+		}
+		end := start + size
+		if len(data) < end+2 {
+			return 0, nil
+		}
+		if data[end] != '\r' || data[end+1] != '\n' {
+			return 0, ErrMalformed
+		}
+		p.body = append(p.body, data[start:end]...)
+		p.off = end + 2
+	}
+}
+
+// parseHex parses the size of a chunk.
+func parseHex(b []byte) (n int, ok bool) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, false
+	}
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c -= 'a' - 10
+		case c >= 'A' && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | int(c)
+	}
+	return n, true
+}
+
+// isToken returns true for a token of RFC 9110, such as a method or a field
+// name.
+func isToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c <= ' ' || c >= 0x7F || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// equalFold is bytes.EqualFold for ASCII, without allocating.
+func equalFold[T []byte | string](b T, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		if lower(b[i]) != lower(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// hasToken returns true when the comma-separated value has the token, which
+// is matched without case.
+func hasToken(value []byte, token string) bool {
+	for len(value) > 0 {
+		var t []byte
+		if i := bytes.IndexByte(value, ','); i != -1 {
+			t, value = value[:i], value[i+1:]
+		} else {
+			t, value = value, nil
+		}
+		if equalFold(bytes.Trim(t, " \t"), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package http1
+
+import (
+	"strconv"
+	"time"
+)
+
+// ResponseWriter appends a response to the output of a connection. Its
+// buffers are reused from one response to the next, so writing a response
+// doesn't allocate once they have grown.
+//
+// The body is buffered, and written with a Content-Length once the handler
+// returns, unless Flush is called to stream it with the chunked transfer
+// encoding. The Date, Content-Length, Transfer-Encoding and Connection
+// fields are set by the writer.
+type ResponseWriter struct {
+	out     []byte
+	req     *Request
+	status  int
+	head    []byte // header fields
+	body    []byte // buffered body
+	started bool   // the header was written by Flush
+	chunked bool
+	close   bool // the connection closes after the response
+}
+
+// Reset starts a response to the request, which is appended to out.
+func (w *ResponseWriter) Reset(out []byte, req *Request) {
+	w.out = out
+	w.req = req
+	w.status = 200
+	w.head = w.head[:0]
+	w.body = w.body[:0]
+	w.started = false
+	w.chunked = false
+	w.close = req == nil || !req.KeepAlive
+}
+
+// WriteHeader sets the status code, which is 200 by default. It has no
+// effect once the header has been flushed.
+func (w *ResponseWriter) WriteHeader(status int) {
+	if !w.started {
+		w.status = status
+	}
+}
+
+// AddHeader adds a header field. Adding "Connection: close" closes the
+// connection after the response. It has no effect once the header has been
+// flushed.
+func (w *ResponseWriter) AddHeader(name, value string) {
+	if w.started {
+		return
+	}
+	if equalFold(name, "Connection") {
+		if equalFold(value, "close") {
+			w.close = true
+		}
+		return
+	}
+	w.head = append(w.head, name...)
+	w.head = append(w.head, ": "...)
+	w.head = append(w.head, value...)
+	w.head = append(w.head, "\r\n"...)
+}
+
+// Write appends to the body.
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
+
+// WriteString appends to the body.
+func (w *ResponseWriter) WriteString(s string) (int, error) {
+	w.body = append(w.body, s...)
+	return len(s), nil
+}
+
+// Flush writes the header, if it hasn't been, and the body that was
+// written since the last flush as a chunk. An HTTP/1.0 client doesn't
+// support chunks, so its body is written as is and the connection closes
+// after the response.
+func (w *ResponseWriter) Flush() {
+	if !w.started {
+		w.started = true
+		if w.req != nil && w.req.http10 {
+			w.close = true
+		} else {
+			w.chunked = true
+		}
+		w.appendHead(-1)
+	}
+	w.appendBody()
+}
+
+// End writes the rest of the response, and returns the output.
+func (w *ResponseWriter) End() []byte {
+	if !w.started {
+		w.appendHead(len(w.body))
+		w.appendBody()
+	} else {
+		w.appendBody()
+		if w.chunked && w.hasBody() {
+			w.out = append(w.out, "0\r\n\r\n"...)
+		}
+	}
+	return w.out
+}
+
+// KeepAlive returns true when the connection stays open after the
+// response.
+func (w *ResponseWriter) KeepAlive() bool {
+	return !w.close
+}
+
+// hasBody returns false for the responses that never have a body, and for
+// the responses to HEAD requests.
+func (w *ResponseWriter) hasBody() bool {
+	if w.status < 200 || w.status == 204 || w.status == 304 {
+		return false
+	}
+	return w.req == nil || string(w.req.Method) != "HEAD"
+}
+
+// appendHead appends the status line and the header, with the length of the
+// body, or -1 for a streamed body.
+func (w *ResponseWriter) appendHead(clen int) {
+	w.out = append(w.out, "HTTP/1.1 "...)
+	w.out = strconv.AppendInt(w.out, int64(w.status), 10)
+	w.out = append(w.out, ' ')
+	w.out = append(w.out, statusText(w.status)...)
+	w.out = append(w.out, "\r\nDate: "...)
+	w.out = time.Now().UTC().AppendFormat(w.out, "Mon, 02 Jan 2006 15:04:05 GMT")
+	w.out = append(w.out, "\r\n"...)
+	w.out = append(w.out, w.head...)
+	if w.status >= 200 && w.status != 204 && w.status != 304 {
+		switch {
+		case clen >= 0:
+			w.out = append(w.out, "Content-Length: "...)
+			w.out = strconv.AppendInt(w.out, int64(clen), 10)
+			w.out = append(w.out, "\r\n"...)
+		case w.chunked:
+			w.out = append(w.out, "Transfer-Encoding: chunked\r\n"...)
+		}
+	}
+	switch {
+	case w.close:
+		w.out = append(w.out, "Connection: close\r\n"...)
+	case w.req != nil && w.req.http10:
+		w.out = append(w.out, "Connection: keep-alive\r\n"...)
+	}
+	w.out = append(w.out, "\r\n"...)
+}
+
+// appendBody appends the buffered body, as a chunk for a chunked body.
+func (w *ResponseWriter) appendBody() {
+	if len(w.body) > 0 && w.hasBody() {
+		if w.chunked {
+			w.out = strconv.AppendInt(w.out, int64(len(w.body)), 16)
+			w.out = append(w.out, "\r\n"...)
+			w.out = append(w.out, w.body...)
+			w.out = append(w.out, "\r\n"...)
+		} else {
+			w.out = append(w.out, w.body...)
+		}
+	}
+	w.body = w.body[:0]
+}
+
+// statusText returns the reason phrase of a status code.
+func statusText(status int) string {
+	switch status {
+	case 100:
+		return "Continue"
+	case 101:
+		return "Switching Protocols"
+	case 200:
+		return "OK"
+	case 201:
+		return "Created"
+	case 202:
+		return "Accepted"
+	case 204:
+		return "No Content"
+	case 206:
+		return "Partial Content"
+	case 301:
+		return "Moved Permanently"
+	case 302:
+		return "Found"
+	case 303:
+		return "See Other"
+	case 304:
+		return "Not Modified"
+	case 307:
+		return "Temporary Redirect"
+	case 308:
+		return "Permanent Redirect"
+	case 400:
+		return "Bad Request"
+	case 401:
+		return "Unauthorized"
+	case 403:
+		return "Forbidden"
+	case 404:
+		return "Not Found"
+	case 405:
+		return "Method Not Allowed"
+	case 408:
+		return "Request Timeout"
+	case 409:
+		return "Conflict"
+	case 411:
+		return "Length Required"
+	case 413:
+		return "Content Too Large"
+	case 414:
+		return "URI Too Long"
+	case 415:
+		return "Unsupported Media Type"
+	case 417:
+		return "Expectation Failed"
+	case 429:
+		return "Too Many Requests"
+	case 431:
+		return "Request Header Fields Too Large"
+	case 500:
+		return "Internal Server Error"
+	case 501:
+		return "Not Implemented"
+	case 502:
+		return "Bad Gateway"
+	case 503:
+		return "Service Unavailable"
+	case 504:
+		return "Gateway Timeout"
+	case 505:
+		return "HTTP Version Not Supported"
+	}
+	return "Status"
+}
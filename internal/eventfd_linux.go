@@ -1,7 +1,6 @@
 package internal
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"syscall"
@@ -14,13 +13,25 @@ var (
 	errWrite = errors.New("failed to write event")
 )
 
+// one is the counter value written by Notify. It's read-only, so it's
+// shared by all callers.
+var one = func() (b [eventBytes]byte) {
+	binary.NativeEndian.PutUint64(b[:], 1)
+	return b
+}()
+
+// EventFd is an eventfd counter that's used as a wakeup doorbell. The
+// kernel adds up the notifications until the counter is drained, so the
+// counter does not carry any information other than having been notified.
 type EventFd struct {
 	fd    int
 	valid bool
+	buf   [eventBytes]byte // read buffer, only used by Drain
 }
 
 func newEventFd() (*EventFd, error) {
-	fd, _, err := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	fd, _, err := syscall.Syscall(syscall.SYS_EVENTFD2, 0,
+		syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
 	if err != 0 {
 		return nil, err
 	}
@@ -44,26 +55,28 @@ func (e *EventFd) Fd() int {
 	return e.fd
 }
 
-func (e *EventFd) ReadEvent() (uint64, error) {
-	buf := make([]byte, eventBytes)
-	if n, err := syscall.Read(e.fd, buf[:]); err != nil {
+// Drain resets the counter and returns the number of notifications since
+// the last drain. It returns zero when there are no notifications.
+func (e *EventFd) Drain() (uint64, error) {
+	n, err := syscall.Read(e.fd, e.buf[:])
+	if err != nil {
+		if err == syscall.EAGAIN {
+			return 0, nil
+		}
 		return 0, err
 	} else if n != eventBytes {
 		return 0, errRead
-	} else {
-		return binary.ReadUvarint(bytes.NewBuffer(buf))
 	}
+	return binary.NativeEndian.Uint64(e.buf[:]), nil
 }
 
-func (e *EventFd) WriteEvent(val uint64) error {
-	buf := make([]byte, eventBytes)
-	binary.PutUvarint(buf, val)
-
-	if n, err := syscall.Write(e.fd, buf[:]); err != nil {
+// Notify increments the counter, which makes the eventfd readable. It's
+// safe to call from any goroutine.
+func (e *EventFd) Notify() error {
+	if n, err := syscall.Write(e.fd, one[:]); err != nil {
 		return err
 	} else if n != eventBytes {
 		return errWrite
-	} else {
-		return nil
 	}
+	return nil
 }
@@ -18,41 +18,46 @@ func TestNew(t *testing.T) {
 	}
 }
 
-func TestReadWriteEvent(t *testing.T) {
+func TestNotifyDrain(t *testing.T) {
 	efd, err := newEventFd()
 	if err != nil {
 		t.Error(err)
 	}
 	defer efd.Close()
 
-	var good uint64 = 0x78
-	if err := efd.WriteEvent(good); err != nil {
+	if n, err := efd.Drain(); err != nil {
 		t.Error(err)
+	} else if n != 0 {
+		t.Errorf("expected 0 notifications, got %d", n)
 	}
-
-	if actual, err := efd.ReadEvent(); err != nil {
+	for i := 0; i < 3; i++ {
+		if err := efd.Notify(); err != nil {
+			t.Error(err)
+		}
+	}
+	if n, err := efd.Drain(); err != nil {
 		t.Error(err)
-	} else if actual != good {
-		t.Errorf("error reading from eventfd, expected: %q, actual: %q", good, actual)
+	} else if n != 3 {
+		t.Errorf("expected 3 notifications, got %d", n)
 	}
 }
 
-func BenchmarkReadWriteEvent(b *testing.B) {
-	const event = 15
+func BenchmarkNotifyDrain(b *testing.B) {
 	efd, err := newEventFd()
 	if err != nil {
 		b.Fatal(err)
 	}
 	defer efd.Close()
 
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		if err := efd.WriteEvent(event); err != nil {
+		if err := efd.Notify(); err != nil {
 			b.Fatal(err)
 		}
-		val, err := efd.ReadEvent()
+		n, err := efd.Drain()
 		if err != nil {
 			b.Fatal(err)
-		} else if val != event {
+		} else if n != 1 {
 			b.Fail()
 		}
 	}
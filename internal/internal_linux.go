@@ -4,24 +4,32 @@
 
 package internal
 
-import "syscall"
-
-const (
-	EventClose uint64 = 1
-	EventTick  uint64 = 2
-	EventWrite uint64 = 3
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// ErrClosed is returned by Trigger once the poll is closed.
+var ErrClosed = errors.New("poll closed")
+
 type (
+	// EventHandler handles the fd events of Wait. The events are the
+	// epoll flags that are set for the fd.
 	EventHandler interface {
-		OnEvent(event uint64) error
-		OnFdEvent(fd int) error
+		OnFdEvent(fd int, events uint32) error
 	}
 
 	// Poll ...
 	Poll struct {
 		fd      int // epoll fd
 		eventFd *EventFd
+		mu      sync.Mutex     // guards tasks and closed
+		closed  bool           // closed, no more tasks
+		tasks   []func() error // queued by Trigger
+		running []func() error // run by Wait, swapped with tasks
+		timers  *TimerWheel    // advanced by Wait
 	}
 )
 
@@ -38,99 +46,159 @@ func OpenPoll() *Poll {
 		panic(err)
 	}
 	l.eventFd = eventFd
-	l.AddRead(l.eventFd.Fd())
+	if err := l.AddRead(l.eventFd.Fd()); err != nil {
+		panic(err)
+	}
+	l.timers = NewTimerWheel(time.Millisecond, nil)
 	return l
 }
 
 // Close ...
 func (p *Poll) Close() error {
-	if err := p.eventFd.Close(); err != nil {
+	p.mu.Lock()
+	p.closed = true
+	p.tasks = nil
+	err := p.eventFd.Close()
+	p.mu.Unlock()
+	if err != nil {
 		return err
 	}
 
 	return syscall.Close(p.fd)
 }
 
-func (p *Poll) FireEvent(event uint64) error {
-	return p.eventFd.WriteEvent(event)
+// Trigger queues the task to run on the goroutine that's calling Wait.
+// It's safe to call from any goroutine, and tasks run in the order they
+// were queued. A task that returns an error stops Wait, and the tasks
+// that were queued after it do not run.
+func (p *Poll) Trigger(task func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.tasks = append(p.tasks, task)
+	if len(p.tasks) == 1 {
+		// the eventfd is only a doorbell. once it's drained, Wait runs
+		// every queued task, so only the first task needs to ring it.
+		return p.eventFd.Notify()
+	}
+	return nil
+}
+
+// runTasks drains the eventfd and runs the queued tasks.
+func (p *Poll) runTasks() error {
+	if _, err := p.eventFd.Drain(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.tasks, p.running = p.running[:0], p.tasks
+	p.mu.Unlock()
+	for i, task := range p.running {
+		p.running[i] = nil
+		if err := task(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AfterFunc schedules fn to run on the goroutine that's calling Wait once
+// the duration has elapsed. It must be called from that goroutine, as must
+// the Stop and Reset methods of the timer. A function that returns an
+// error stops Wait.
+func (p *Poll) AfterFunc(d time.Duration, fn func() error) *Timer {
+	return p.timers.AfterFunc(d, fn)
 }
 
 // Wait ...
 func (p *Poll) Wait(handler EventHandler) error {
 	events := make([]syscall.EpollEvent, 64)
 	for {
-		n, err := syscall.EpollWait(p.fd, events, -1)
+		timeout := -1
+		if d := p.timers.Timeout(); d >= 0 {
+			timeout = int((d + time.Millisecond - 1) / time.Millisecond)
+		}
+		n, err := syscall.EpollWait(p.fd, events, timeout)
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
 
 		for i := 0; i < n; i++ {
 			if fd := int(events[i].Fd); fd == p.eventFd.Fd() {
-				if event, err := p.eventFd.ReadEvent(); err != nil {
-					return err
-				} else if err := handler.OnEvent(event); err != nil {
+				if err := p.runTasks(); err != nil {
 					return err
 				}
-			} else if err := handler.OnFdEvent(fd); err != nil {
+			} else if err := handler.OnFdEvent(fd, events[i].Events); err != nil {
 				return err
 			}
 		}
+		if err := p.timers.Advance(); err != nil {
+			return err
+		}
 	}
 }
 
 // AddReadWrite ...
-func (p *Poll) AddReadWrite(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
+func (p *Poll) AddReadWrite(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
 		},
-	); err != nil {
-		panic(err)
-	}
+	)
 }
 
 // AddRead ...
-func (p *Poll) AddRead(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
+func (p *Poll) AddRead(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN,
 		},
-	); err != nil {
-		panic(err)
-	}
+	)
 }
 
 // ModRead ...
-func (p *Poll) ModRead(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+func (p *Poll) ModRead(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN,
 		},
-	); err != nil {
-		panic(err)
-	}
+	)
 }
 
 // ModReadWrite ...
-func (p *Poll) ModReadWrite(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+func (p *Poll) ModReadWrite(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
 		},
-	); err != nil {
-		panic(err)
-	}
+	)
+}
+
+// ModWrite ...
+func (p *Poll) ModWrite(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+		&syscall.EpollEvent{Fd: int32(fd),
+			Events: syscall.EPOLLOUT,
+		},
+	)
+}
+
+// ModNone waits for neither reads nor writes. Errors and hangups are
+// still reported.
+func (p *Poll) ModNone(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+		&syscall.EpollEvent{Fd: int32(fd)},
+	)
 }
 
 // ModDetach ...
-func (p *Poll) ModDetach(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd,
+func (p *Poll) ModDetach(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
 		},
-	); err != nil {
-		panic(err)
-	}
+	)
 }
 
 func SetKeepAlive(fd, secs int) error {
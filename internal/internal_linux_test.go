@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type nopHandler struct{}
+
+func (nopHandler) OnFdEvent(fd int, events uint32) error { return nil }
+
+func TestTrigger(t *testing.T) {
+	p := OpenPoll()
+	defer p.Close()
+
+	const producers, tasks = 8, 5000
+	// only accessed by the tasks, which run on the Wait goroutine.
+	var next [producers]int
+	var ticks, writes, nested int
+
+	done := make(chan error)
+	go func() { done <- p.Wait(nopHandler{}) }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < tasks; n++ {
+				n := n
+				err := p.Trigger(func() error {
+					if next[i] != n {
+						return fmt.Errorf("producer %d: expected task %d, got %d", i, next[i], n)
+					}
+					next[i]++
+					switch n % 3 {
+					case 0:
+						ticks++
+					case 1:
+						writes++
+					case 2:
+						// tasks may queue more tasks
+						return p.Trigger(func() error {
+							nested++
+							return nil
+						})
+					}
+					return nil
+				})
+				if err != nil {
+					panic(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// nested tasks may be queued after the stop task, which requeues
+	// itself until they're done.
+	errStop := errors.New("stop")
+	var stop func() error
+	stop = func() error {
+		if ticks+writes+nested < producers*tasks {
+			return p.Trigger(stop)
+		}
+		return errStop
+	}
+	p.Trigger(stop)
+	if err := <-done; err != errStop {
+		t.Fatalf("expected '%v', got '%v'", errStop, err)
+	}
+	for i := 0; i < producers; i++ {
+		if next[i] != tasks {
+			t.Fatalf("producer %d: expected %d tasks, got %d", i, tasks, next[i])
+		}
+	}
+	if nested != producers*(tasks/3) {
+		t.Fatalf("expected %d nested tasks, got %d", producers*(tasks/3), nested)
+	}
+}
+
+func TestTriggerClosed(t *testing.T) {
+	p := OpenPoll()
+	p.Close()
+	if err := p.Trigger(func() error { return nil }); err != ErrClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrClosed, err)
+	}
+}
+
+func BenchmarkTrigger(b *testing.B) {
+	p := OpenPoll()
+	defer p.Close()
+
+	done := make(chan error)
+	go func() { done <- p.Wait(nopHandler{}) }()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.Trigger(func() error { return nil })
+		}
+	})
+	errStop := errors.New("stop")
+	p.Trigger(func() error { return errStop })
+	<-done
+}
@@ -9,31 +9,31 @@ import (
 	"syscall"
 )
 
-// SockaddrToAddr returns a go/net friendly address
-func SockaddrToAddr(sa syscall.Sockaddr) net.Addr {
-	var a net.Addr
+// SockaddrToAddr returns a go/net friendly address. The udp parameter
+// requests a *net.UDPAddr, rather than a *net.TCPAddr, for inet addresses.
+func SockaddrToAddr(sa syscall.Sockaddr, udp bool) net.Addr {
+	var ip net.IP
+	var port int
+	var zone string
 	switch sa := sa.(type) {
 	case *syscall.SockaddrInet4:
-		a = &net.TCPAddr{
-			IP:   append([]byte{}, sa.Addr[:]...),
-			Port: sa.Port,
-		}
+		ip = append([]byte{}, sa.Addr[:]...)
+		port = sa.Port
 	case *syscall.SockaddrInet6:
-		var zone string
 		if sa.ZoneId != 0 {
 			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
 				zone = ifi.Name
 			}
 		}
-		if zone == "" && sa.ZoneId != 0 {
-		}
-		a = &net.TCPAddr{
-			IP:   append([]byte{}, sa.Addr[:]...),
-			Port: sa.Port,
-			Zone: zone,
-		}
+		ip = append([]byte{}, sa.Addr[:]...)
+		port = sa.Port
 	case *syscall.SockaddrUnix:
-		a = &net.UnixAddr{Net: "unix", Name: sa.Name}
+		return &net.UnixAddr{Net: "unix", Name: sa.Name}
+	default:
+		return nil
+	}
+	if udp {
+		return &net.UDPAddr{IP: ip, Port: port, Zone: zone}
 	}
-	return a
+	return &net.TCPAddr{IP: ip, Port: port, Zone: zone}
 }
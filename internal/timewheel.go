@@ -0,0 +1,245 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import "time"
+
+const (
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits
+	wheelMask   = wheelSize - 1
+	wheelLevels = 5
+	// wheelSpan is the number of ticks covered by all levels.
+	wheelSpan = 1 << (wheelBits * wheelLevels)
+)
+
+// TimerWheel is a hierarchical timing wheel. Each level has 64 slots and
+// each slot of a level covers all the slots of the level below, so the
+// wheel covers 64^5 ticks with constant time adds and stops. Timers in
+// the upper levels cascade down to the lower levels as the wheel turns.
+//
+// A TimerWheel is not safe for concurrent use. It's owned by the
+// goroutine that advances it.
+type TimerWheel struct {
+	tick  time.Duration    // duration of a tick
+	clock func() time.Time // current time
+	start time.Time        // time of tick zero
+	now   uint64           // last processed tick
+	count int              // number of scheduled timers
+	slots [wheelLevels][wheelSize]*Timer
+	sizes [wheelLevels]int // number of timers per level
+}
+
+// Timer is a timer of a TimerWheel.
+type Timer struct {
+	w          *TimerWheel
+	fn         func() error
+	when       uint64 // expiration tick
+	level      int
+	slot       int
+	prev, next *Timer
+	scheduled  bool
+}
+
+// NewTimerWheel returns a wheel with the tick resolution. The clock
+// returns the current time, and defaults to time.Now when nil.
+func NewTimerWheel(tick time.Duration, clock func() time.Time) *TimerWheel {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &TimerWheel{tick: tick, clock: clock, start: clock()}
+}
+
+// ticks returns the tick of the time t. The tick is rounded up for
+// expirations so that timers never fire early.
+func (w *TimerWheel) ticks(t time.Time, up bool) uint64 {
+	d := t.Sub(w.start)
+	if d <= 0 {
+		return 0
+	}
+	if up {
+		d += w.tick - 1
+	}
+	return uint64(d / w.tick)
+}
+
+// Len returns the number of scheduled timers.
+func (w *TimerWheel) Len() int {
+	return w.count
+}
+
+// AfterFunc schedules fn to be called by Advance once the duration has
+// elapsed.
+func (w *TimerWheel) AfterFunc(d time.Duration, fn func() error) *Timer {
+	t := &Timer{w: w, fn: fn}
+	t.Reset(d)
+	return t
+}
+
+// Stop prevents the timer from firing. It returns false if the timer has
+// already fired or been stopped.
+func (t *Timer) Stop() bool {
+	if !t.scheduled {
+		return false
+	}
+	t.w.remove(t)
+	return true
+}
+
+// Reset changes the timer to fire once the duration has elapsed. It
+// returns true if the timer had been scheduled.
+func (t *Timer) Reset(d time.Duration) bool {
+	scheduled := t.Stop()
+	w := t.w
+	if w.count == 0 {
+		// nothing to fire, fast forward.
+		w.now = w.ticks(w.clock(), false)
+	}
+	t.when = w.ticks(w.clock().Add(d), true)
+	w.add(t, false)
+	return scheduled
+}
+
+// add schedules the timer. Timers that cascade may land in the current
+// slot, which Advance runs right after cascading.
+func (w *TimerWheel) add(t *Timer, cascading bool) {
+	if t.when < w.now || (t.when == w.now && !cascading) {
+		// expired timers fire on the next tick.
+		t.when = w.now + 1
+	}
+	delta := t.when - w.now
+	when := t.when
+	if delta >= wheelSpan {
+		// beyond the wheel, park in the last level until it cascades.
+		when = w.now + wheelSpan - 1
+		delta = wheelSpan - 1
+	}
+	level := 0
+	for delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	t.level = level
+	t.slot = int(when>>(wheelBits*level)) & wheelMask
+	t.prev = nil
+	t.next = w.slots[level][t.slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	w.slots[level][t.slot] = t
+	t.scheduled = true
+	w.sizes[level]++
+	w.count++
+}
+
+func (w *TimerWheel) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		w.slots[t.level][t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.prev, t.next = nil, nil
+	t.scheduled = false
+	w.sizes[t.level]--
+	w.count--
+}
+
+// cascade moves the timers of the current slot of the level to the lower
+// levels.
+func (w *TimerWheel) cascade(level int) {
+	slot := int(w.now>>(wheelBits*level)) & wheelMask
+	t := w.slots[level][slot]
+	w.slots[level][slot] = nil
+	for t != nil {
+		next := t.next
+		t.prev, t.next = nil, nil
+		w.sizes[level]--
+		w.count--
+		w.add(t, true)
+		t = next
+	}
+}
+
+// Advance turns the wheel to the current time and calls the functions of
+// the expired timers. It stops and returns the error of a function that
+// fails.
+func (w *TimerWheel) Advance() error {
+	if w.count == 0 {
+		// Reset fast forwards an empty wheel.
+		return nil
+	}
+	target := w.ticks(w.clock(), false)
+	for w.now < target && w.count > 0 {
+		// skip to the last tick before the next cascade of the lowest
+		// level that has timers.
+		level := 0
+		for w.sizes[level] == 0 {
+			level++
+		}
+		if skip := w.now | (1<<(wheelBits*level) - 1); skip > w.now {
+			if skip >= target {
+				break
+			}
+			w.now = skip
+		}
+		w.now++
+		for level := 1; level < wheelLevels; level++ {
+			if w.now&(1<<(wheelBits*level)-1) != 0 {
+				break
+			}
+			w.cascade(level)
+		}
+		slot := int(w.now) & wheelMask
+		for {
+			t := w.slots[0][slot]
+			if t == nil {
+				break
+			}
+			w.remove(t)
+			if err := t.fn(); err != nil {
+				return err
+			}
+		}
+	}
+	if w.now < target {
+		w.now = target
+	}
+	return nil
+}
+
+// Timeout returns the duration until the wheel needs to be advanced, or
+// -1 when no timers are scheduled. It may be less than the duration until
+// the next timer expires, when the timer needs to cascade first.
+func (w *TimerWheel) Timeout() time.Duration {
+	if w.count == 0 {
+		return -1
+	}
+	next := uint64(0)
+	for level := 0; level < wheelLevels; level++ {
+		shift := uint(wheelBits * level)
+		base := w.now >> shift
+		for k := uint64(1); k <= wheelSize; k++ {
+			if w.slots[level][int(base+k)&wheelMask] == nil {
+				continue
+			}
+			tick := (base + k) << shift
+			if next == 0 || tick < next {
+				next = tick
+			}
+			break
+		}
+		if next != 0 && level == 0 {
+			// the lower level always expires first.
+			break
+		}
+	}
+	d := w.start.Add(time.Duration(next) * w.tick).Sub(w.clock())
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestTimerWheel(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	w := NewTimerWheel(time.Millisecond, clock.Now)
+	if w.Timeout() != -1 {
+		t.Fatalf("expected no timeout")
+	}
+	rand.Seed(time.Now().UnixNano())
+	const n = 5000
+	type fired struct {
+		due time.Time
+		at  time.Time
+	}
+	var results []fired
+	var stopped []*Timer
+	for i := 0; i < n; i++ {
+		var d time.Duration
+		switch i % 4 {
+		case 0:
+			d = time.Duration(rand.Intn(100)) * time.Millisecond
+		case 1:
+			d = time.Duration(rand.Intn(10000)) * time.Millisecond
+		case 2:
+			d = time.Duration(rand.Intn(3600000)) * time.Millisecond
+		case 3:
+			d = time.Duration(rand.Int63n(int64(time.Hour)))
+		}
+		due := clock.now.Add(d)
+		tm := w.AfterFunc(d, func() error {
+			results = append(results, fired{due, clock.now})
+			return nil
+		})
+		if i%10 == 0 {
+			stopped = append(stopped, tm)
+		}
+	}
+	for _, tm := range stopped {
+		if !tm.Stop() {
+			t.Fatalf("expected stop")
+		}
+		if tm.Stop() {
+			t.Fatalf("expected no stop")
+		}
+	}
+	// step the clock by the timeout, like Wait does.
+	for w.Len() > 0 {
+		d := w.Timeout()
+		if d < 0 {
+			t.Fatalf("expected timeout")
+		}
+		clock.now = clock.now.Add(d)
+		if err := w.Advance(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(results) != n-len(stopped) {
+		t.Fatalf("expected %d, got %d", n-len(stopped), len(results))
+	}
+	for _, r := range results {
+		if r.at.Before(r.due) {
+			t.Fatalf("fired early by %s", r.due.Sub(r.at))
+		}
+		if r.at.Sub(r.due) > time.Millisecond {
+			t.Fatalf("fired late by %s", r.at.Sub(r.due))
+		}
+	}
+	if w.Timeout() != -1 {
+		t.Fatalf("expected no timeout")
+	}
+}
+
+func TestTimerWheelReset(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	w := NewTimerWheel(time.Millisecond, clock.Now)
+	var count int
+	tm := w.AfterFunc(time.Second, func() error { count++; return nil })
+	clock.now = clock.now.Add(time.Second / 2)
+	w.Advance()
+	if !tm.Reset(time.Second) {
+		t.Fatalf("expected reset of scheduled timer")
+	}
+	clock.now = clock.now.Add(time.Second * 3 / 4)
+	w.Advance()
+	if count != 0 {
+		t.Fatalf("expected 0, got %d", count)
+	}
+	clock.now = clock.now.Add(time.Second / 4)
+	w.Advance()
+	if count != 1 {
+		t.Fatalf("expected 1, got %d", count)
+	}
+	if tm.Reset(0) {
+		t.Fatalf("expected reset of fired timer")
+	}
+	w.Advance()
+	if count != 1 {
+		t.Fatalf("expected 1, got %d", count)
+	}
+	clock.now = clock.now.Add(time.Millisecond)
+	w.Advance()
+	if count != 2 {
+		t.Fatalf("expected 2, got %d", count)
+	}
+
+	// beyond the span of the wheel.
+	w.AfterFunc(time.Hour*24*30, func() error { count++; return nil })
+	for i := 0; i < 30*24; i++ {
+		clock.now = clock.now.Add(time.Hour)
+		w.Advance()
+	}
+	if count != 3 {
+		t.Fatalf("expected 3, got %d", count)
+	}
+
+	// errors stop the wheel.
+	errStop := errors.New("stop")
+	w.AfterFunc(0, func() error { return errStop })
+	clock.now = clock.now.Add(time.Millisecond)
+	if err := w.Advance(); err != errStop {
+		t.Fatalf("expected '%v', got '%v'", errStop, err)
+	}
+}
+
+func BenchmarkTimerWheel(b *testing.B) {
+	w := NewTimerWheel(time.Millisecond, nil)
+	tm := w.AfterFunc(time.Second, func() error { return nil })
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tm.Reset(time.Duration(i%60000) * time.Millisecond)
+	}
+}
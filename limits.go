@@ -0,0 +1,170 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reasons passed to the Rejected event.
+var (
+	// ErrMaxConns is for connections over the MaxConns limit.
+	ErrMaxConns = errors.New("too many connections")
+	// ErrMaxConnsPerIP is for connections over the MaxConnsPerIP limit.
+	ErrMaxConnsPerIP = errors.New("too many connections from the address")
+	// ErrAcceptRate is for connections over the AcceptRatePerIP limit.
+	ErrAcceptRate = errors.New("too many new connections from the address")
+)
+
+// connLimiter counts the inbound connections of all the loops for the
+// MaxConns and MaxConnsPerIP limits, and the new connections for the
+// AcceptRatePerIP limit.
+type connLimiter struct {
+	maxConns int
+	maxPerIP int
+	rate     int // AcceptRatePerIP
+	mu       sync.Mutex
+	total    int
+	perIP    map[string]int
+	buckets  map[string]*tokenBucket // accept rates by IP
+	accepts  int                     // accepts since the last sweep
+}
+
+// newConnLimiter returns a limiter for the events, or nil when there are
+// no limits.
+func newConnLimiter(events Events) *connLimiter {
+	if events.MaxConns <= 0 && events.MaxConnsPerIP <= 0 &&
+		events.AcceptRatePerIP <= 0 {
+		return nil
+	}
+	return &connLimiter{
+		maxConns: events.MaxConns,
+		maxPerIP: events.MaxConnsPerIP,
+		rate:     events.AcceptRatePerIP,
+		perIP:    make(map[string]int),
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// ipKey returns the IP of the address, or an empty string for addresses
+// without one, such as unix sockets.
+func ipKey(addr net.Addr) string {
+	return string(addrIP(addr).To16())
+}
+
+// acquire counts a new connection from the remote address. It returns the
+// key for release, or the reason the connection is over a limit.
+func (lim *connLimiter) acquire(remote net.Addr) (key string, err error) {
+	ip := ipKey(remote)
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.maxConns > 0 && lim.total >= lim.maxConns {
+		return "", ErrMaxConns
+	}
+	if lim.maxPerIP > 0 && ip != "" && lim.perIP[ip] >= lim.maxPerIP {
+		return "", ErrMaxConnsPerIP
+	}
+	if lim.rate > 0 && ip != "" {
+		now := time.Now()
+		b := lim.buckets[ip]
+		if b == nil {
+			b = newTokenBucket(lim.rate, now)
+			lim.buckets[ip] = b
+		}
+		b.refill(now)
+		if b.available() == 0 {
+			return "", ErrAcceptRate
+		}
+		b.take(1)
+		if lim.accepts++; lim.accepts >= 1024 {
+			// forget the addresses that are back to a full bucket
+			lim.accepts = 0
+			for ip, b := range lim.buckets {
+				if b.refill(now); b.full() {
+					delete(lim.buckets, ip)
+				}
+			}
+		}
+	}
+	if lim.maxPerIP > 0 && ip != "" {
+		key = ip
+		lim.perIP[key]++
+	}
+	lim.total++
+	return key, nil
+}
+
+// release uncounts a connection that was acquired with the key.
+func (lim *connLimiter) release(key string) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	lim.total--
+	if key != "" {
+		if lim.perIP[key] <= 1 {
+			delete(lim.perIP, key)
+		} else {
+			lim.perIP[key]--
+		}
+	}
+}
+
+// tokenBucket is a token bucket that holds up to a second of tokens, and
+// at least one token.
+type tokenBucket struct {
+	rate   float64   // tokens per second
+	burst  float64   // most tokens
+	tokens float64   // may be below zero after a take
+	last   time.Time // last refill
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	burst := float64(rate)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: now}
+}
+
+// refill adds the tokens for the time since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// available returns the number of whole tokens.
+func (b *tokenBucket) available() int {
+	if b.tokens < 1 {
+		return 0
+	}
+	return int(b.tokens)
+}
+
+// take removes n tokens.
+func (b *tokenBucket) take(n int) {
+	b.tokens -= float64(n)
+}
+
+// full returns true when the bucket holds all the tokens it can.
+func (b *tokenBucket) full() bool {
+	return b.tokens >= b.burst
+}
+
+// wait returns the time until there's a whole token, or zero when there
+// is one.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second)))
+}
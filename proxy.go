@@ -0,0 +1,238 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrProxyHeader is passed to the Rejected event for connections of a
+// proxy_protocol listener that sent a malformed PROXY protocol header, or
+// that were closed or timed out before sending one. It wraps the cause,
+// which is ErrTimeout for a timeout.
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyHeaderTimeout is how long a connection of a proxy_protocol listener
+// has to send the header. It holds a connection slot until then, without
+// the timeouts of the Opened event.
+var proxyHeaderTimeout = 10 * time.Second
+
+// PROXY protocol versions of the proxy_protocol listener option
+const (
+	proxyV1 = 1 << iota
+	proxyV2
+)
+
+const (
+	proxyV1Max = 107 // longest v1 header, with the CRLF
+	proxyV2Len = 16  // v2 header without the addresses and TLVs
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyHeader is the PROXY protocol header that was sent by a proxy for a
+// connection of a listener with the proxy_protocol option.
+type ProxyHeader struct {
+	// Version is 1 or 2.
+	Version int
+	// Local is true for health checks and other connections of the proxy
+	// itself, which have the LOCAL command or the UNKNOWN protocol. The
+	// addresses of these connections are not replaced.
+	Local bool
+	// Source and Destination are the addresses of the client connection
+	// that the proxy accepted. They're nil when Local is true.
+	Source      net.Addr
+	Destination net.Addr
+	// TLVs are the type-length-value fields of a version 2 header.
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a type-length-value field of a version 2 PROXY protocol
+// header, such as the ALPN (0x01) or the authority (0x02) of the client.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// parseProxyVersions parses the value of the proxy_protocol listener
+// option, such as "v1,v2".
+func parseProxyVersions(s string) int {
+	var versions int
+	for _, v := range strings.Split(s, ",") {
+		switch strings.ToLower(v) {
+		case "v1", "1":
+			versions |= proxyV1
+		case "v2", "2":
+			versions |= proxyV2
+		}
+	}
+	return versions
+}
+
+// parseProxyHeader parses the PROXY protocol header at the start of buf,
+// for one of the versions. It returns the header and its length, or a nil
+// header and no error when buf is too short to tell.
+func parseProxyHeader(buf []byte, versions int) (*ProxyHeader, int, error) {
+	if versions&proxyV2 != 0 && hasPrefix(buf, proxyV2Sig) {
+		if len(buf) < len(proxyV2Sig) {
+			return nil, 0, nil
+		}
+		return parseProxyV2(buf)
+	}
+	if versions&proxyV1 != 0 && hasPrefix(buf, []byte("PROXY ")) {
+		if len(buf) < len("PROXY ") {
+			return nil, 0, nil
+		}
+		return parseProxyV1(buf)
+	}
+	return nil, 0, errors.New("missing header")
+}
+
+// hasPrefix returns true when buf and prefix match up to the shorter of
+// the two.
+func hasPrefix(buf, prefix []byte) bool {
+	if len(buf) < len(prefix) {
+		return bytes.HasPrefix(prefix, buf)
+	}
+	return bytes.HasPrefix(buf, prefix)
+}
+
+func parseProxyV1(buf []byte) (*ProxyHeader, int, error) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end == -1 || end+2 > proxyV1Max {
+		if len(buf) >= proxyV1Max {
+			return nil, 0, errors.New("header too long")
+		}
+		return nil, 0, nil
+	}
+	h := &ProxyHeader{Version: 1}
+	fields := strings.Split(string(buf[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+		return h, end + 2, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, fmt.Errorf("malformed header %q", buf[:end])
+	}
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, 0, err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, 0, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, end + 2, nil
+}
+
+func parseProxyV1Addr(proto, ip, port string) (net.Addr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || (addr.IP.To4() != nil) != (proto == "TCP4") {
+		return nil, fmt.Errorf("invalid %s address %q", proto, ip)
+	}
+	var err error
+	addr.Port, err = strconv.Atoi(port)
+	if err != nil || addr.Port < 0 || addr.Port > 0xFFFF || port != strconv.Itoa(addr.Port) {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return addr, nil
+}
+
+func parseProxyV2(buf []byte) (*ProxyHeader, int, error) {
+	if len(buf) < proxyV2Len {
+		return nil, 0, nil
+	}
+	n := proxyV2Len + int(binary.BigEndian.Uint16(buf[14:16]))
+	if len(buf) < n {
+		return nil, 0, nil
+	}
+	h := &ProxyHeader{Version: 2}
+	if buf[12]>>4 != 2 {
+		return nil, 0, fmt.Errorf("unsupported version %d", buf[12]>>4)
+	}
+	switch buf[12] & 0xF {
+	case 0: // LOCAL
+		h.Local = true
+	case 1: // PROXY
+	default:
+		return nil, 0, fmt.Errorf("unsupported command %d", buf[12]&0xF)
+	}
+	body := buf[proxyV2Len:n]
+	var alen int
+	switch fam := buf[13]; fam >> 4 {
+	case 0: // AF_UNSPEC
+		h.Local = true
+	case 1, 2: // AF_INET, AF_INET6
+		iplen := net.IPv4len
+		if fam>>4 == 2 {
+			iplen = net.IPv6len
+		}
+		alen = 2*iplen + 4
+		if len(body) < alen {
+			return nil, 0, errors.New("short address")
+		}
+		srcIP := net.IP(append([]byte(nil), body[:iplen]...))
+		dstIP := net.IP(append([]byte(nil), body[iplen:2*iplen]...))
+		srcPort := int(binary.BigEndian.Uint16(body[2*iplen:]))
+		dstPort := int(binary.BigEndian.Uint16(body[2*iplen+2:]))
+		switch fam & 0xF {
+		case 1: // STREAM
+			h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+			h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+		case 2: // DGRAM
+			h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+			h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+		default:
+			return nil, 0, fmt.Errorf("unsupported protocol %d", fam&0xF)
+		}
+	case 3: // AF_UNIX
+		alen = 216
+		if len(body) < alen {
+			return nil, 0, errors.New("short address")
+		}
+		network := "unix"
+		if fam&0xF == 2 {
+			network = "unixgram"
+		}
+		h.Source = &net.UnixAddr{Name: unixName(body[:108]), Net: network}
+		h.Destination = &net.UnixAddr{Name: unixName(body[108:216]), Net: network}
+	default:
+		return nil, 0, fmt.Errorf("unsupported family %d", fam>>4)
+	}
+	if h.Local {
+		h.Source, h.Destination = nil, nil
+	}
+	for tlvs := body[alen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, 0, errors.New("short TLV")
+		}
+		vlen := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+vlen {
+			return nil, 0, errors.New("short TLV")
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{
+			Type:  tlvs[0],
+			Value: append([]byte(nil), tlvs[3:3+vlen]...),
+		})
+		tlvs = tlvs[3+vlen:]
+	}
+	return h, n, nil
+}
+
+// unixName returns the NUL terminated path of a unix address.
+func unixName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package resp
+
+import (
+	"math"
+	"strconv"
+)
+
+// AppendString appends a simple string. Line breaks are replaced with
+// spaces, because they end the string.
+func AppendString(b []byte, s string) []byte {
+	b = append(b, '+')
+	return appendLine(b, s)
+}
+
+// AppendError appends an error, such as "ERR unknown command". Line breaks
+// are replaced with spaces.
+func AppendError(b []byte, s string) []byte {
+	b = append(b, '-')
+	return appendLine(b, s)
+}
+
+func appendLine(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\r' || s[i] == '\n' {
+			b = append(b, ' ')
+		} else {
+			b = append(b, s[i])
+		}
+	}
+	return append(b, '\r', '\n')
+}
+
+// AppendInt appends an integer.
+func AppendInt(b []byte, n int64) []byte {
+	return appendPrefix(b, ':', n)
+}
+
+// AppendBulk appends a bulk string.
+func AppendBulk(b []byte, p []byte) []byte {
+	b = appendPrefix(b, '$', int64(len(p)))
+	b = append(b, p...)
+	return append(b, '\r', '\n')
+}
+
+// AppendBulkString appends a bulk string.
+func AppendBulkString(b []byte, s string) []byte {
+	b = appendPrefix(b, '$', int64(len(s)))
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendArray appends the header of an array of n elements, which are
+// appended next.
+func AppendArray(b []byte, n int) []byte {
+	return appendPrefix(b, '*', int64(n))
+}
+
+// AppendNullBulk appends the null bulk string of RESP2.
+func AppendNullBulk(b []byte) []byte {
+	return append(b, "$-1\r\n"...)
+}
+
+// AppendNullArray appends the null array of RESP2.
+func AppendNullArray(b []byte) []byte {
+	return append(b, "*-1\r\n"...)
+}
+
+// AppendNull appends the null of RESP3.
+func AppendNull(b []byte) []byte {
+	return append(b, "_\r\n"...)
+}
+
+// AppendBool appends a boolean.
+func AppendBool(b []byte, t bool) []byte {
+	if t {
+		return append(b, "#t\r\n"...)
+	}
+	return append(b, "#f\r\n"...)
+}
+
+// AppendDouble appends a double.
+func AppendDouble(b []byte, f float64) []byte {
+	b = append(b, ',')
+	return append(appendFloat(b, f), '\r', '\n')
+}
+
+// appendFloat appends a float in the format of RESP3, with "inf", "-inf"
+// and "nan" for the special values.
+func appendFloat(b []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(b, "inf"...)
+	case math.IsInf(f, -1):
+		return append(b, "-inf"...)
+	case math.IsNaN(f):
+		return append(b, "nan"...)
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, 64)
+}
+
+// AppendBigNumber appends a big number, whose digits are in s.
+func AppendBigNumber(b []byte, s string) []byte {
+	b = append(b, '(')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendBulkError appends a bulk error, which may have line breaks.
+func AppendBulkError(b []byte, s string) []byte {
+	b = appendPrefix(b, '!', int64(len(s)))
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendVerbatim appends a verbatim string with a format of three letters,
+// such as "txt" or "mkd".
+func AppendVerbatim(b []byte, format, s string) []byte {
+	b = appendPrefix(b, '=', int64(len(format)+1+len(s)))
+	b = append(b, format...)
+	b = append(b, ':')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendMap appends the header of a map of n pairs, whose keys and values
+// are appended next.
+func AppendMap(b []byte, n int) []byte {
+	return appendPrefix(b, '%', int64(n))
+}
+
+// AppendSet appends the header of a set of n elements.
+func AppendSet(b []byte, n int) []byte {
+	return appendPrefix(b, '~', int64(n))
+}
+
+// AppendPush appends the header of a push message of n elements.
+func AppendPush(b []byte, n int) []byte {
+	return appendPrefix(b, '>', int64(n))
+}
+
+// AppendAttribute appends the header of the n attributes of the value that
+// follows them.
+func AppendAttribute(b []byte, n int) []byte {
+	return appendPrefix(b, '|', int64(n))
+}
+
+// AppendValue appends a value, such as a value that was parsed.
+func AppendValue(b []byte, v Value) []byte {
+	switch v.Type {
+	case SimpleString, Error, Integer, Boolean, Double, BigNumber:
+		b = append(b, byte(v.Type))
+		b = append(b, v.Data...)
+		return append(b, '\r', '\n')
+	case BulkString, BulkError, Verbatim:
+		b = appendPrefix(b, byte(v.Type), int64(len(v.Data)))
+		b = append(b, v.Data...)
+		return append(b, '\r', '\n')
+	case Array, Set, Push:
+		b = appendPrefix(b, byte(v.Type), int64(len(v.Elems)))
+	case Map, Attribute:
+		b = appendPrefix(b, byte(v.Type), int64(len(v.Elems)/2))
+	default:
+		return AppendNull(b)
+	}
+	for _, e := range v.Elems {
+		b = AppendValue(b, e)
+	}
+	return b
+}
+
+// AppendCommand appends a command, as an array of bulk strings.
+func AppendCommand(b []byte, args ...[]byte) []byte {
+	b = AppendArray(b, len(args))
+	for _, arg := range args {
+		b = AppendBulk(b, arg)
+	}
+	return b
+}
+
+// AppendCommandString appends a command, as an array of bulk strings.
+func AppendCommandString(b []byte, args ...string) []byte {
+	b = AppendArray(b, len(args))
+	for _, arg := range args {
+		b = AppendBulkString(b, arg)
+	}
+	return b
+}
+
+func appendPrefix(b []byte, c byte, n int64) []byte {
+	b = append(b, c)
+	b = strconv.AppendInt(b, n, 10)
+	return append(b, '\r', '\n')
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"evio"
+)
+
+// ErrClosed is passed to the replies of commands whose connection closed
+// before they were answered, wrapping the error of the Closed event, and is
+// returned for commands that are sent after it closed.
+var ErrClosed = errors.New("resp: connection closed")
+
+// Client sends commands to a Redis server on an outbound connection of an
+// evio server, and calls the reply functions of the commands in order.
+//
+// The client is the context of its connection, and the Data and Closed
+// events of the connection must call its Data and Closed methods. The
+// events of a Router already do.
+type Client struct {
+	// Push is called with the push messages of RESP3, such as the
+	// messages of subscribed channels, which aren't replies. Commands
+	// that are answered with push messages, such as SUBSCRIBE in RESP3,
+	// are sent with Send.
+	Push func(v Value)
+
+	mu      sync.Mutex
+	conn    evio.Conn
+	replies []func(v Value, err error)
+	closed  bool
+	wbuf    []byte
+	is      evio.InputStream
+}
+
+// Dial connects to a Redis server with the Dial method of the evio server.
+func Dial(srv evio.Server, network, addr string) (*Client, error) {
+	c := &Client{}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, err := srv.Dial(network, addr, c)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	return c, nil
+}
+
+// Conn returns the evio connection.
+func (c *Client) Conn() evio.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Do sends a command, and calls reply with its reply, or with an error when
+// the connection closes first. The value of the reply is only valid until
+// reply returns. A nil reply ignores the reply. It's safe to call from any
+// goroutine, including from reply functions.
+func (c *Client) Do(reply func(v Value, err error), args ...string) error {
+	if reply == nil {
+		reply = func(Value, error) {}
+	}
+	return c.send(reply, args)
+}
+
+// Send sends a command that isn't answered with a reply, such as SUBSCRIBE
+// in RESP3.
+func (c *Client) Send(args ...string) error {
+	return c.send(nil, args)
+}
+
+func (c *Client) send(reply func(v Value, err error), args []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.wbuf = AppendCommandString(c.wbuf[:0], args...)
+	if err := c.conn.Write(c.wbuf); err != nil {
+		return err
+	}
+	if reply != nil {
+		c.replies = append(c.replies, reply)
+	}
+	return nil
+}
+
+// Data processes the input of the connection, and returns the action of
+// the Data event, which closes the connection after a protocol error.
+func (c *Client) Data(in []byte) evio.Action {
+	if in == nil {
+		return evio.None
+	}
+	data := c.is.Begin(in)
+	var action evio.Action
+	for {
+		v, n, err := ParseValue(data)
+		if err != nil {
+			action = evio.Close
+			break
+		}
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+		if v.Type == Push {
+			if c.Push != nil {
+				c.Push(v)
+			}
+			continue
+		}
+		c.mu.Lock()
+		if len(c.replies) == 0 {
+			c.mu.Unlock()
+			action = evio.Close
+			break
+		}
+		reply := c.replies[0]
+		c.replies[0] = nil
+		c.replies = c.replies[1:]
+		c.mu.Unlock()
+		reply(v, nil)
+	}
+	if action != evio.None {
+		data = nil
+	}
+	c.is.End(data)
+	return action
+}
+
+// Closed fails the commands that weren't answered, and is called from the
+// Closed event of the connection.
+func (c *Client) Closed(err error) {
+	c.mu.Lock()
+	replies := c.replies
+	c.replies = nil
+	c.closed = true
+	c.mu.Unlock()
+	if err == nil {
+		err = ErrClosed
+	} else {
+		err = fmt.Errorf("%w: %w", ErrClosed, err)
+	}
+	for _, reply := range replies {
+		reply(Value{}, err)
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package resp implements the Redis serialization protocol, RESP2 and
+// RESP3, for evio servers and clients.
+//
+// ReadCommand and ParseValue parse the input of a connection incrementally
+// and without copying, and the Append functions append replies and commands
+// to the output. A Router produces the evio events of a server that
+// dispatches commands to handlers, and a Client sends commands on a
+// connection that was dialed by an evio server:
+//
+//	var r resp.Router
+//	r.Handle("ping", -1, func(c *resp.Conn, args [][]byte) {
+//		c.WriteString("PONG")
+//	})
+//	evio.Serve("tcp://:6380", r.Events())
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Type is the type of a value, which is the first byte of its encoding.
+type Type byte
+
+// Types of RESP2, and then the types that were added by RESP3.
+const (
+	SimpleString Type = '+'
+	Error        Type = '-'
+	Integer      Type = ':'
+	BulkString   Type = '$'
+	Array        Type = '*'
+	Null         Type = '_'
+	Boolean      Type = '#'
+	Double       Type = ','
+	BigNumber    Type = '('
+	BulkError    Type = '!'
+	Verbatim     Type = '='
+	Map          Type = '%'
+	Set          Type = '~'
+	Attribute    Type = '|'
+	Push         Type = '>'
+)
+
+// Limits of the parser, which are the defaults of Redis.
+const (
+	maxInline    = 64 << 10  // inline command
+	maxBulk      = 512 << 20 // bulk string
+	maxMultiBulk = 1 << 20   // elements of an aggregate
+	maxDepth     = 64        // nesting of aggregates
+)
+
+// ErrProtocol is the error of malformed input. The parser errors wrap it,
+// and their text is the text of the errors of Redis.
+var ErrProtocol = errors.New("Protocol error")
+
+var (
+	errInlineTooBig     = protocolError("too big inline request")
+	errUnbalancedQuotes = protocolError("unbalanced quotes in request")
+	errMultiBulkLength  = protocolError("invalid multibulk length")
+	errBulkLength       = protocolError("invalid bulk length")
+	errExpectedBulk     = protocolError("expected '$'")
+	errExpectedCRLF     = protocolError("expected CRLF")
+	errInvalidType      = protocolError("invalid type")
+	errInvalidValue     = protocolError("invalid value")
+	errTooDeep          = protocolError("too deeply nested")
+	errLineTooLong      = protocolError("too big line")
+)
+
+type protoError struct {
+	msg string
+}
+
+func (e *protoError) Error() string { return ErrProtocol.Error() + ": " + e.msg }
+func (e *protoError) Unwrap() error { return ErrProtocol }
+
+func protocolError(msg string) error { return &protoError{msg} }
+
+// Value is a parsed value. Its byte slices point into the input of the
+// parser, so they're only valid as long as the input is.
+type Value struct {
+	Type Type
+	// Data is the payload of the scalar types: the text of strings,
+	// errors and verbatim strings, which start with their format such as
+	// "txt:", the digits of integers, doubles and big numbers, and "t" or
+	// "f" for booleans. It's nil for nulls.
+	Data []byte
+	// Elems are the elements of arrays, sets and pushes, and the keys and
+	// values of maps, which alternate.
+	Elems []Value
+}
+
+// Int returns the value of an integer.
+func (v Value) Int() (int64, error) {
+	return strconv.ParseInt(string(v.Data), 10, 64)
+}
+
+// Float returns the value of a double, including "inf", "-inf" and "nan",
+// or of another number.
+func (v Value) Float() (float64, error) {
+	return strconv.ParseFloat(string(v.Data), 64)
+}
+
+// Bool returns the value of a boolean, or true for a non-zero integer.
+func (v Value) Bool() bool {
+	if v.Type == Integer {
+		return string(v.Data) != "0"
+	}
+	return string(v.Data) == "t"
+}
+
+// Err returns the error of an error value, and nil for other types.
+func (v Value) Err() error {
+	if v.Type == Error || v.Type == BulkError {
+		return errors.New(string(v.Data))
+	}
+	return nil
+}
+
+// String returns the payload of a scalar value.
+func (v Value) String() string {
+	return string(v.Data)
+}
+
+// ParseValue parses the value at the start of data, and returns it with
+// its length. It returns a zero length and no error when the value is
+// incomplete. Attributes are skipped, and the null bulk strings and null
+// arrays of RESP2 are returned as nulls.
+func ParseValue(data []byte) (v Value, n int, err error) {
+	return parseValue(data, 0)
+}
+
+func parseValue(data []byte, depth int) (v Value, n int, err error) {
+	line, n, err := readLine(data, maxInline)
+	if n == 0 {
+		return v, 0, err
+	}
+	if len(line) == 0 {
+		return v, 0, errInvalidType
+	}
+	v.Type = Type(line[0])
+	line = line[1:]
+	switch v.Type {
+	case SimpleString, Error, Double, BigNumber:
+		v.Data = line
+	case Integer:
+		if _, ok := parseInt(line); !ok {
+			return v, 0, errInvalidValue
+		}
+		v.Data = line
+	case Null:
+		if len(line) != 0 {
+			return v, 0, errInvalidValue
+		}
+	case Boolean:
+		if len(line) != 1 || (line[0] != 't' && line[0] != 'f') {
+			return v, 0, errInvalidValue
+		}
+		v.Data = line
+	case BulkString, BulkError, Verbatim:
+		size, ok := parseInt(line)
+		if size == -1 && v.Type == BulkString {
+			v.Type = Null
+			return v, n, nil
+		}
+		if !ok || size < 0 || size > maxBulk {
+			return v, 0, errBulkLength
+		}
+		end := n + int(size)
+		if len(data) < end+2 {
+			return v, 0, nil
+		}
+		if data[end] != '\r' || data[end+1] != '\n' {
+			return v, 0, errExpectedCRLF
+		}
+		v.Data = data[n:end]
+		n = end + 2
+	case Array, Set, Push, Map, Attribute:
+		count, ok := parseInt(line)
+		if count == -1 && v.Type == Array {
+			v.Type = Null
+			return v, n, nil
+		}
+		if !ok || count < 0 || count > maxMultiBulk {
+			return v, 0, errMultiBulkLength
+		}
+		if depth == maxDepth {
+			return v, 0, errTooDeep
+		}
+		if v.Type == Map || v.Type == Attribute {
+			count *= 2
+		}
+		if count > 0 {
+			v.Elems = make([]Value, 0, min(int(count), 16))
+		}
+		for i := 0; i < int(count); i++ {
+			e, m, err := parseValue(data[n:], depth+1)
+			if m == 0 {
+				return v, 0, err
+			}
+			v.Elems = append(v.Elems, e)
+			n += m
+		}
+		if v.Type == Attribute {
+			// the attributes of the value that follows them
+			v, m, err := parseValue(data[n:], depth)
+			if m == 0 {
+				return v, 0, err
+			}
+			return v, n + m, nil
+		}
+	default:
+		return v, 0, errInvalidType
+	}
+	return v, n, nil
+}
+
+// ReadCommand reads the command at the start of data, which is an array of
+// bulk strings or an inline command, and returns its length and arguments,
+// which are appended to args. It returns a zero length and no error when
+// the command is incomplete. The arguments point into data, and the quoted
+// arguments of an inline command are unescaped in place. An empty command
+// has no arguments.
+func ReadCommand(data []byte, args [][]byte) (n int, _ [][]byte, err error) {
+	if len(data) == 0 {
+		return 0, args, nil
+	}
+	if data[0] != '*' {
+		// inline commands may end with a bare LF
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 || i > maxInline {
+			if len(data) > maxInline {
+				return 0, args, errInlineTooBig
+			}
+			return 0, args, nil
+		}
+		args, err = splitInline(data[:i], args)
+		return i + 1, args, err
+	}
+	line, n, err := readLine(data, maxInline)
+	if n == 0 {
+		return 0, args, err
+	}
+	count, ok := parseInt(line[1:])
+	if !ok || count > maxMultiBulk {
+		return 0, args, errMultiBulkLength
+	}
+	start := len(args)
+	for i := 0; i < int(count); i++ {
+		line, m, err := readLine(data[n:], maxInline)
+		if m == 0 {
+			return 0, args[:start], err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return 0, args[:start], errExpectedBulk
+		}
+		size, ok := parseInt(line[1:])
+		if !ok || size < 0 || size > maxBulk {
+			return 0, args[:start], errBulkLength
+		}
+		n += m
+		end := n + int(size)
+		if len(data) < end+2 {
+			return 0, args[:start], nil
+		}
+		if data[end] != '\r' || data[end+1] != '\n' {
+			return 0, args[:start], errExpectedCRLF
+		}
+		args = append(args, data[n:end])
+		n = end + 2
+	}
+	return n, args, nil
+}
+
+// readLine returns the line at the start of data without its CRLF, and the
+// length of the line with the CRLF, or zero when it's incomplete.
+func readLine(data []byte, max int) (line []byte, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i == -1 {
+		if len(data) > max {
+			return nil, 0, errLineTooLong
+		}
+		return nil, 0, nil
+	}
+	if i == 0 || data[i-1] != '\r' {
+		return nil, 0, errExpectedCRLF
+	}
+	return data[:i-1], i + 1, nil
+}
+
+// parseInt parses a decimal integer, which may be negative, and fails when
+// it overflows an int64.
+func parseInt(b []byte) (int64, bool) {
+	neg := len(b) > 0 && b[0] == '-'
+	if neg {
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > 19 {
+		return 0, false
+	}
+	max := uint64(math.MaxInt64)
+	if neg {
+		max++
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		// at most 19 digits, so n*10 doesn't overflow the uint64
+		n = n*10 + uint64(c-'0')
+		if n > max {
+			return 0, false
+		}
+	}
+	if neg {
+		return -int64(n), true
+	}
+	return int64(n), true
+}
+
+// splitInline splits an inline command into arguments like Redis does,
+// with double quoted arguments that have escapes such as \n and \x41, and
+// single quoted arguments that only escape the quote.
+func splitInline(line []byte, args [][]byte) ([][]byte, error) {
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		q := line[i]
+		if q != '"' && q != '\'' {
+			start := i
+			for i < len(line) && !isSpace(line[i]) {
+				i++
+			}
+			args = append(args, line[start:i])
+			continue
+		}
+		// unquote in place, since the result is shorter
+		start := i
+		w := i
+		for i++; ; {
+			if i == len(line) {
+				return args, errUnbalancedQuotes
+			}
+			c := line[i]
+			if c == q {
+				if i+1 < len(line) && !isSpace(line[i+1]) {
+					return args, errUnbalancedQuotes
+				}
+				i++
+				break
+			}
+			switch {
+			case c != '\\' || i+1 == len(line):
+				i++
+			case q == '\'':
+				if line[i+1] == '\'' {
+					c = '\''
+					i++
+				}
+				i++
+			case i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+				c = unhex(line[i+2])<<4 | unhex(line[i+3])
+				i += 4
+			default:
+				switch c = line[i+1]; c {
+				case 'n':
+					c = '\n'
+				case 'r':
+					c = '\r'
+				case 't':
+					c = '\t'
+				case 'b':
+					c = '\b'
+				case 'a':
+					c = '\a'
+				}
+				i += 2
+			}
+			line[w] = c
+			w++
+		}
+		args = append(args, line[start:w])
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
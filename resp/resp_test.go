@@ -0,0 +1,363 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"evio"
+)
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// format formats a value like redis-cli.
+func format(v Value) string {
+	switch v.Type {
+	case Null:
+		return "(nil)"
+	case Error, BulkError:
+		return "(error) " + v.String()
+	case Integer:
+		return "(integer) " + v.String()
+	case Boolean:
+		return fmt.Sprintf("(boolean) %t", v.Bool())
+	case Double:
+		return "(double) " + v.String()
+	case BigNumber:
+		return "(big number) " + v.String()
+	case Array, Set, Push, Map:
+		var elems []string
+		for _, e := range v.Elems {
+			elems = append(elems, format(e))
+		}
+		return fmt.Sprintf("%c[%s]", v.Type, strings.Join(elems, " "))
+	}
+	return fmt.Sprintf("%q", v.Data)
+}
+
+func TestParseValue(t *testing.T) {
+	for _, expect := range []struct {
+		input  string
+		output string
+	}{
+		{"+OK\r\n", `"OK"`},
+		{"-ERR bad\r\n", "(error) ERR bad"},
+		{":-42\r\n", "(integer) -42"},
+		{":9223372036854775807\r\n", "(integer) 9223372036854775807"},
+		{":-9223372036854775808\r\n", "(integer) -9223372036854775808"},
+		{"$5\r\nhe\r\no\r\n", `"he\r\no"`},
+		{"$0\r\n\r\n", `""`},
+		{"$-1\r\n", "(nil)"},
+		{"*-1\r\n", "(nil)"},
+		{"_\r\n", "(nil)"},
+		{"#t\r\n", "(boolean) true"},
+		{",1.5\r\n", "(double) 1.5"},
+		{"(3492890328409238509324850943850943825024385\r\n",
+			"(big number) 3492890328409238509324850943850943825024385"},
+		{"!9\r\nERR\r\nbad!\r\n", "(error) ERR\r\nbad!"},
+		{"=15\r\ntxt:Some string\r\n", `"txt:Some string"`},
+		{"*3\r\n:1\r\n*2\r\n+a\r\n$1\r\nb\r\n*0\r\n", `*[(integer) 1 *["a" "b"] *[]]`},
+		{"%2\r\n+k\r\n:1\r\n+j\r\n_\r\n", `%["k" (integer) 1 "j" (nil)]`},
+		{"~2\r\n#f\r\n,inf\r\n", "~[(boolean) false (double) inf]"},
+		{">2\r\n+message\r\n$2\r\nhi\r\n", `>["message" "hi"]`},
+		{"|1\r\n+ttl\r\n:3600\r\n+value\r\n", `"value"`},
+	} {
+		v, n, err := ParseValue([]byte(expect.input + "+next\r\n"))
+		must(err)
+		if n != len(expect.input) || format(v) != expect.output {
+			t.Fatalf("expected %s for %q, got %s", expect.output, expect.input, format(v))
+		}
+		// incomplete until the last byte
+		for i := 0; i < len(expect.input); i++ {
+			if _, n, err := ParseValue([]byte(expect.input[:i])); n != 0 || err != nil {
+				t.Fatalf("expected incomplete %q, got %d %v", expect.input[:i], n, err)
+			}
+		}
+		// the encoding of the value parses to the same value, except for
+		// the attributes and the nulls of RESP2
+		if b := AppendValue(nil, v); !strings.HasPrefix(expect.input, "|") &&
+			!strings.HasSuffix(expect.input, "-1\r\n") && string(b) != expect.input {
+			t.Fatalf("expected %q, got %q", expect.input, b)
+		}
+	}
+	for _, bad := range []string{
+		"?\r\n", "+OK\n", ":1x\r\n", "_x\r\n", "#x\r\n", "$2\r\nabc\r\n",
+		"$-2\r\n", "*-2\r\n", "%-1\r\n", "$x\r\n", strings.Repeat("*1\r\n", 100),
+		":9223372036854775808\r\n", ":-9223372036854775809\r\n", ":18446744073709551616\r\n",
+		":99999999999999999999\r\n", ":-\r\n", ":\r\n", "$9223372036854775807\r\n",
+		"+" + strings.Repeat("x", 70000),
+	} {
+		if _, _, err := ParseValue([]byte(bad)); !errors.Is(err, ErrProtocol) {
+			t.Fatalf("expected protocol error for %q, got %v", bad, err)
+		}
+	}
+	v, _, _ := ParseValue([]byte(":7\r\n"))
+	if n, err := v.Int(); n != 7 || err != nil || !v.Bool() {
+		t.Fatal("unexpected integer")
+	}
+	v, _, _ = ParseValue([]byte(":-9223372036854775808\r\n"))
+	if n, err := v.Int(); n != math.MinInt64 || err != nil {
+		t.Fatal("unexpected integer")
+	}
+	v, _, _ = ParseValue([]byte(",-inf\r\n"))
+	if f, err := v.Float(); !math.IsInf(f, -1) || err != nil {
+		t.Fatal("unexpected double")
+	}
+	v, _, _ = ParseValue([]byte("-ERR x\r\n"))
+	if v.Err() == nil || v.Err().Error() != "ERR x" {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nva\r\nl\r\n" +
+		"PING\n" +
+		"\r\n" +
+		"*0\r\n" +
+		`set "a b\x41\n\"" 'it\'s' "" x` + "\r\n"
+	expect := []string{`["SET" "key" "va\r\nl"]`, `["PING"]`, `[]`, `[]`, `["set" "a bA\n\"" "it's" "" "x"]`}
+	data := []byte(input)
+	var args [][]byte
+	for _, s := range expect {
+		// incomplete until the last byte, and parsed from a copy, since
+		// inline commands are unescaped in place
+		end, _, _ := ReadCommand(append([]byte(nil), data...), nil)
+		for j := 0; j < end; j++ {
+			if n, _, err := ReadCommand(data[:j], args[:0]); n != 0 || err != nil {
+				t.Fatalf("expected incomplete %q, got %d %v", data[:j], n, err)
+			}
+		}
+		n, a, err := ReadCommand(data, args[:0])
+		must(err)
+		args = a
+		if got := fmt.Sprintf("%q", args); n == 0 || got != s {
+			t.Fatalf("expected %s, got %s", s, got)
+		}
+		data = data[n:]
+	}
+	for _, bad := range []string{
+		"*x\r\n", "*1\r\n+x\r\n", "*1\r\n$x\r\n", "*1\r\n$1\r\nab\r\n",
+		"*1\n", `GET "a`, `GET "a"b`, `GET 'a`, strings.Repeat("x", 70000),
+	} {
+		if _, _, err := ReadCommand([]byte(bad+"\r\n"), nil); !errors.Is(err, ErrProtocol) {
+			t.Fatalf("expected protocol error for %q, got %v", bad, err)
+		}
+	}
+
+	// no allocations once the arguments have grown
+	data = []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")
+	var out []byte
+	allocs := testing.AllocsPerRun(100, func() {
+		_, args, _ = ReadCommand(data, args[:0])
+		out = AppendBulk(AppendArray(out[:0], 1), args[2])
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	testRouter(t, "tcp://127.0.0.1:20062")
+	testRouter(t, "tcp-net://127.0.0.1:20063")
+}
+
+func testRouter(t *testing.T, addr string) {
+	var r Router
+	keys := make(map[string]string)
+	r.Handle("GET", 2, func(c *Conn, args [][]byte) {
+		if v, ok := keys[string(args[1])]; ok {
+			c.WriteBulkString(v)
+		} else {
+			c.WriteNull()
+		}
+	})
+	r.Handle("set", 3, func(c *Conn, args [][]byte) {
+		keys[string(args[1])] = string(args[2])
+		c.WriteString("OK")
+	})
+	r.Handle("types", 1, func(c *Conn, args [][]byte) {
+		c.WriteArray(5)
+		c.WriteBool(true)
+		c.WriteDouble(1.5)
+		c.WriteNullArray()
+		c.WriteMap(1)
+		c.WriteBulkString("k")
+		c.WriteInt(1)
+		c.WriteSet(0)
+	})
+	r.Handle("publish", 3, func(c *Conn, args [][]byte) {
+		c.WriteInt(1)
+		c.WritePush(3)
+		c.WriteBulkString("message")
+		c.WriteBulk(args[1])
+		c.WriteBulk(args[2])
+	})
+	r.Handle("quit", 1, func(c *Conn, args [][]byte) {
+		c.WriteString("OK")
+		c.Action = evio.Close
+	})
+	events := r.Events()
+	var done int32
+	events.Serving = func(srv evio.Server) (action evio.Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			testRouterClient(srv.Addrs[0].String())
+			testClient(srv, srv.Addrs[0].String())
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action evio.Action) {
+		if atomic.LoadInt32(&done) != 0 {
+			action = evio.Shutdown
+		}
+		return 10 * time.Millisecond, action
+	}
+	must(evio.Serve(addr, events))
+}
+
+// testRouterClient sends commands with a net.Conn.
+func testRouterClient(addr string) {
+	conn, err := net.Dial("tcp", addr)
+	must(err)
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	var buf []byte
+	read := func(expect string) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			v, n, err := ParseValue(buf)
+			must(err)
+			if n > 0 {
+				if got := format(v); got != expect {
+					panic(fmt.Sprintf("expected %s, got %s", expect, got))
+				}
+				buf = buf[n:]
+				return
+			}
+			b, err := rd.ReadByte()
+			must(err)
+			buf = append(buf, b)
+		}
+	}
+	// pipelined, in parts and inline
+	cmds := string(AppendCommandString(nil, "SET", "a", "1")) +
+		string(AppendCommandString(nil, "gEt", "a")) +
+		"get b\r\n" + "GET\r\n" + "nope x\r\n" + "hello 4\r\n" +
+		string(AppendCommandString(nil, "types"))
+	for i := 0; i < len(cmds); i += 7 {
+		_, err := conn.Write([]byte(cmds[i:min(i+7, len(cmds))]))
+		must(err)
+		time.Sleep(time.Millisecond)
+	}
+	read(`"OK"`)
+	read(`"1"`)
+	read("(nil)")
+	read("(error) ERR wrong number of arguments for 'GET' command")
+	read("(error) ERR unknown command 'nope'")
+	read("(error) NOPROTO unsupported protocol version")
+	read(`*[(integer) 1 "1.5" (nil) *["k" (integer) 1] *[]]`)
+	// RESP3
+	fmt.Fprintf(conn, "HELLO 3\r\nget b\r\ntypes\r\npublish ch hi\r\n")
+	read(`%["server" "evio" "proto" (integer) 3 "mode" "standalone" "role" "master"]`)
+	read("(nil)")
+	read(`*[(boolean) true (double) 1.5 (nil) %["k" (integer) 1] ~[]]`)
+	read("(integer) 1")
+	read(`>["message" "ch" "hi"]`)
+	// closed after quit, and after a protocol error
+	fmt.Fprintf(conn, "quit\r\nget a\r\n")
+	read(`"OK"`)
+	if _, err := rd.ReadByte(); err != io.EOF {
+		panic(fmt.Sprintf("expected EOF, got %v", err))
+	}
+	conn2, err := net.Dial("tcp", addr)
+	must(err)
+	defer conn2.Close()
+	conn, rd, buf = conn2, bufio.NewReader(conn2), nil
+	fmt.Fprintf(conn, "*1\r\n$x\r\n")
+	read("(error) ERR Protocol error: invalid bulk length")
+	if _, err := rd.ReadByte(); err != io.EOF {
+		panic(fmt.Sprintf("expected EOF, got %v", err))
+	}
+}
+
+// testClient sends commands with a Client on a connection of the server.
+func testClient(srv evio.Server, addr string) {
+	c, err := Dial(srv, "tcp", addr)
+	must(err)
+	replies := make(chan string, 100)
+	reply := func(v Value, err error) {
+		if err != nil {
+			replies <- "err " + err.Error()
+		} else {
+			replies <- format(v)
+		}
+	}
+	expect := func(expect string) {
+		select {
+		case got := <-replies:
+			if got != expect {
+				panic(fmt.Sprintf("expected %s, got %s", expect, got))
+			}
+		case <-time.After(5 * time.Second):
+			panic("timeout")
+		}
+	}
+	pushes := make(chan string, 10)
+	c.Push = func(v Value) {
+		pushes <- format(v)
+	}
+	for i := 0; i < 50; i++ {
+		must(c.Do(reply, "SET", fmt.Sprint("k", i), fmt.Sprint(i)))
+	}
+	for i := 0; i < 50; i++ {
+		must(c.Do(reply, "GET", fmt.Sprint("k", i)))
+	}
+	for i := 0; i < 50; i++ {
+		expect(`"OK"`)
+	}
+	for i := 0; i < 50; i++ {
+		expect(fmt.Sprintf("%q", fmt.Sprint(i)))
+	}
+	must(c.Do(reply, "HELLO", "3"))
+	expect(`%["server" "evio" "proto" (integer) 3 "mode" "standalone" "role" "master"]`)
+	// a reply function sends the next command
+	must(c.Do(func(v Value, err error) {
+		reply(v, err)
+		must(c.Do(reply, "GET", "nope"))
+	}, "PUBLISH", "ch", "hi"))
+	expect("(integer) 1")
+	expect("(nil)")
+	if got := <-pushes; got != `>["message" "ch" "hi"]` {
+		panic(fmt.Sprintf("unexpected push %s", got))
+	}
+	// the commands after quit are failed
+	must(c.Do(reply, "QUIT"))
+	must(c.Do(reply, "GET", "k1"))
+	expect(`"OK"`)
+	select {
+	case got := <-replies:
+		if !strings.HasPrefix(got, "err "+ErrClosed.Error()) {
+			panic(fmt.Sprintf("expected closed, got %s", got))
+		}
+	case <-time.After(5 * time.Second):
+		panic("timeout")
+	}
+	for c.Do(nil, "PING") != ErrClosed {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package resp
+
+import (
+	"strings"
+
+	"evio"
+)
+
+// Handler handles a command, whose name is args[0], by writing its reply to
+// the connection. The arguments are only valid until it returns.
+type Handler func(c *Conn, args [][]byte)
+
+// Router is a server that dispatches the commands of its connections to
+// handlers by name. Its fields are set and its handlers are added before
+// calling Events.
+type Router struct {
+	// Options are the options of every inbound connection.
+	Options evio.Options
+	// NotFound handles the commands that have no handler. By default
+	// they get an "unknown command" error.
+	NotFound Handler
+
+	cmds map[string]command
+}
+
+type command struct {
+	arity   int
+	handler Handler
+}
+
+// maxName is the length of the longest name of a command.
+const maxName = 64
+
+// Handle adds the handler of a command, whose name is matched without case.
+// The arity is the number of arguments with the name, like in the command
+// table of Redis: a positive arity is exact, a negative arity is a minimum,
+// and zero is any number. The other commands get a "wrong number of
+// arguments" error.
+//
+// The HELLO command is handled by the router, unless it has a handler, and
+// switches the connection to RESP3 for "HELLO 3".
+func (r *Router) Handle(name string, arity int, handler Handler) {
+	if len(name) > maxName {
+		panic("resp: command name too long")
+	}
+	if r.cmds == nil {
+		r.cmds = make(map[string]command)
+	}
+	r.cmds[strings.ToLower(name)] = command{arity, handler}
+}
+
+// lookup returns the command of a name, without allocating.
+func (r *Router) lookup(name []byte) (command, bool) {
+	if len(name) > maxName {
+		return command{}, false
+	}
+	var buf [maxName]byte
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		buf[i] = c
+	}
+	cmd, ok := r.cmds[string(buf[:len(name)])]
+	return cmd, ok
+}
+
+// Conn is a connection of a Router. Its Write methods append replies to the
+// output of the current command, encoding the types of RESP3 as their
+// RESP2 equivalents until the client switches to RESP3 with HELLO. They
+// must only be called from handlers, and other goroutines should use the
+// Write method of the evio connection instead.
+type Conn struct {
+	// Action is the action of the Data event, which handlers set to close
+	// the connection or shut down the server after the reply. The rest of
+	// the pipelined commands are ignored.
+	Action evio.Action
+
+	conn  evio.Conn
+	ctx   interface{}
+	proto int
+	is    evio.InputStream
+	args  [][]byte
+	out   []byte
+}
+
+// Conn returns the evio connection.
+func (c *Conn) Conn() evio.Conn { return c.conn }
+
+// Context returns a user-defined context.
+func (c *Conn) Context() interface{} { return c.ctx }
+
+// SetContext sets a user-defined context.
+func (c *Conn) SetContext(ctx interface{}) { c.ctx = ctx }
+
+// Proto returns the protocol version of the connection, which is 2 or 3.
+func (c *Conn) Proto() int { return c.proto }
+
+// SetProto sets the protocol version of the connection, for handlers of
+// HELLO.
+func (c *Conn) SetProto(proto int) { c.proto = proto }
+
+// WriteString writes a simple string.
+func (c *Conn) WriteString(s string) { c.out = AppendString(c.out, s) }
+
+// WriteError writes an error, such as "ERR invalid key".
+func (c *Conn) WriteError(s string) { c.out = AppendError(c.out, s) }
+
+// WriteInt writes an integer.
+func (c *Conn) WriteInt(n int64) { c.out = AppendInt(c.out, n) }
+
+// WriteBulk writes a bulk string.
+func (c *Conn) WriteBulk(p []byte) { c.out = AppendBulk(c.out, p) }
+
+// WriteBulkString writes a bulk string.
+func (c *Conn) WriteBulkString(s string) { c.out = AppendBulkString(c.out, s) }
+
+// WriteArray writes the header of an array of n elements.
+func (c *Conn) WriteArray(n int) { c.out = AppendArray(c.out, n) }
+
+// WriteNull writes a null, which is a null bulk string in RESP2.
+func (c *Conn) WriteNull() {
+	if c.proto < 3 {
+		c.out = AppendNullBulk(c.out)
+	} else {
+		c.out = AppendNull(c.out)
+	}
+}
+
+// WriteNullArray writes a null, which is a null array in RESP2.
+func (c *Conn) WriteNullArray() {
+	if c.proto < 3 {
+		c.out = AppendNullArray(c.out)
+	} else {
+		c.out = AppendNull(c.out)
+	}
+}
+
+// WriteBool writes a boolean, which is the integer 1 or 0 in RESP2.
+func (c *Conn) WriteBool(t bool) {
+	switch {
+	case c.proto >= 3:
+		c.out = AppendBool(c.out, t)
+	case t:
+		c.out = AppendInt(c.out, 1)
+	default:
+		c.out = AppendInt(c.out, 0)
+	}
+}
+
+// WriteDouble writes a double, which is a bulk string in RESP2.
+func (c *Conn) WriteDouble(f float64) {
+	if c.proto >= 3 {
+		c.out = AppendDouble(c.out, f)
+		return
+	}
+	var buf [32]byte
+	c.out = AppendBulk(c.out, appendFloat(buf[:0], f))
+}
+
+// WriteMap writes the header of a map of n pairs, which is an array of 2n
+// elements in RESP2.
+func (c *Conn) WriteMap(n int) {
+	if c.proto < 3 {
+		c.out = AppendArray(c.out, 2*n)
+	} else {
+		c.out = AppendMap(c.out, n)
+	}
+}
+
+// WriteSet writes the header of a set of n elements, which is an array in
+// RESP2.
+func (c *Conn) WriteSet(n int) {
+	if c.proto < 3 {
+		c.out = AppendArray(c.out, n)
+	} else {
+		c.out = AppendSet(c.out, n)
+	}
+}
+
+// WritePush writes the header of a push message of n elements, which is an
+// array in RESP2.
+func (c *Conn) WritePush(n int) {
+	if c.proto < 3 {
+		c.out = AppendArray(c.out, n)
+	} else {
+		c.out = AppendPush(c.out, n)
+	}
+}
+
+// WriteRaw writes an encoded reply.
+func (c *Conn) WriteRaw(b []byte) { c.out = append(c.out, b...) }
+
+// Events returns the evio events of the router. The other events, such as
+// Serving and NumLoops, may be set on the result.
+//
+// Outbound connections that have a Client as their context are handled by
+// the client, so the router and its clients can share a server.
+func (r *Router) Events() evio.Events {
+	var events evio.Events
+	events.Opened = func(ec evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
+		if _, ok := ec.Context().(*Client); ok {
+			return nil, opts, evio.None
+		}
+		ec.SetContext(&Conn{conn: ec, proto: 2})
+		return nil, r.Options, evio.None
+	}
+	events.Data = func(ec evio.Conn, in []byte) (out []byte, action evio.Action) {
+		switch c := ec.Context().(type) {
+		case *Client:
+			return nil, c.Data(in)
+		case *Conn:
+			if in != nil {
+				return r.serve(c, in)
+			}
+		}
+		return nil, evio.None
+	}
+	events.Closed = func(ec evio.Conn, err error) (action evio.Action) {
+		if c, ok := ec.Context().(*Client); ok {
+			c.Closed(err)
+		}
+		return evio.None
+	}
+	return events
+}
+
+// serve runs the pipelined commands of the input.
+func (r *Router) serve(c *Conn, in []byte) (out []byte, action evio.Action) {
+	if c.Action != evio.None {
+		// the input after a close is ignored
+		return nil, evio.None
+	}
+	// the output buffer is reused, since evio copies it
+	c.out = c.out[:0]
+	data := c.is.Begin(in)
+	for c.Action == evio.None {
+		n, args, err := ReadCommand(data, c.args[:0])
+		c.args = args
+		if err != nil {
+			c.WriteError("ERR " + err.Error())
+			c.Action = evio.Close
+			break
+		}
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+		if len(args) > 0 {
+			r.dispatch(c, args)
+		}
+	}
+	if c.Action != evio.None {
+		data = nil
+	}
+	c.is.End(data)
+	return c.out, c.Action
+}
+
+func (r *Router) dispatch(c *Conn, args [][]byte) {
+	cmd, ok := r.lookup(args[0])
+	if !ok {
+		switch {
+		case equalFold(args[0], "hello"):
+			hello(c, args)
+		case r.NotFound != nil:
+			r.NotFound(c, args)
+		default:
+			c.WriteError("ERR unknown command '" + string(args[0]) + "'")
+		}
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return
+	}
+	cmd.handler(c, args)
+}
+
+// hello handles "HELLO [protover]", without authentication.
+func hello(c *Conn, args [][]byte) {
+	if len(args) > 2 {
+		c.WriteError("ERR syntax error in HELLO option '" + string(args[2]) + "'")
+		return
+	}
+	if len(args) == 2 {
+		switch string(args[1]) {
+		case "2":
+			c.proto = 2
+		case "3":
+			c.proto = 3
+		default:
+			c.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+	c.WriteMap(4)
+	c.WriteBulkString("server")
+	c.WriteBulkString("evio")
+	c.WriteBulkString("proto")
+	c.WriteInt(int64(c.proto))
+	c.WriteBulkString("mode")
+	c.WriteBulkString("standalone")
+	c.WriteBulkString("role")
+	c.WriteBulkString("master")
+}
+
+// equalFold is bytes.EqualFold for ASCII, without allocating.
+func equalFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != s[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// LoopStats are the counters of an event loop, or of all the loops.
+type LoopStats struct {
+	// Accepted is the number of inbound connections that were accepted.
+	Accepted uint64
+	// Closed is the number of connections that were closed or detached.
+	Closed uint64
+	// Active is the number of open connections, including outbound ones.
+	Active int64
+	// BytesIn and BytesOut are the number of bytes read and written.
+	BytesIn  uint64
+	BytesOut uint64
+	// Reads and Writes are the number of reads and writes that moved
+	// data.
+	Reads  uint64
+	Writes uint64
+	// EAGAIN is the number of reads and writes that would have blocked.
+	// It's always zero for the "-net" schemes, which block in goroutines.
+	EAGAIN uint64
+	// QueuedBytes is the number of bytes of output that are waiting to be
+	// written.
+	QueuedBytes int64
+	// Wakeups is the number of Conn.Wake calls that fired a Data event.
+	Wakeups uint64
+	// Events is the number of events and timer functions that were
+	// called, and EventTime is the total time that was spent in them.
+	// They're only counted with the EventStats option of the events.
+	Events    uint64
+	EventTime time.Duration
+}
+
+// Stats are the counters of a server.
+type Stats struct {
+	// LoopStats are the totals of all the loops.
+	LoopStats
+	// Loops are the counters of each loop, by loop index.
+	Loops []LoopStats
+}
+
+// Stats returns the counters of the server. It's safe to call from any
+// goroutine, and keeps working once the server has shut down. The
+// counters are read one at a time, so they may be slightly out of sync
+// with each other while the server is busy.
+func (s Server) Stats() Stats {
+	var stats Stats
+	for _, st := range s.stats {
+		ls := st.load()
+		stats.Loops = append(stats.Loops, ls)
+		stats.Accepted += ls.Accepted
+		stats.Closed += ls.Closed
+		stats.Active += ls.Active
+		stats.BytesIn += ls.BytesIn
+		stats.BytesOut += ls.BytesOut
+		stats.Reads += ls.Reads
+		stats.Writes += ls.Writes
+		stats.EAGAIN += ls.EAGAIN
+		stats.QueuedBytes += ls.QueuedBytes
+		stats.Wakeups += ls.Wakeups
+		stats.Events += ls.Events
+		stats.EventTime += ls.EventTime
+	}
+	return stats
+}
+
+// WritePrometheus writes the counters of each loop in the Prometheus text
+// exposition format, with the loop index as the "loop" label.
+func (s Stats) WritePrometheus(w io.Writer) error {
+	metrics := []struct {
+		name, typ, help string
+		value           func(ls *LoopStats) interface{}
+	}{
+		{"evio_connections_accepted_total", "counter", "Inbound connections accepted.",
+			func(ls *LoopStats) interface{} { return ls.Accepted }},
+		{"evio_connections_closed_total", "counter", "Connections closed or detached.",
+			func(ls *LoopStats) interface{} { return ls.Closed }},
+		{"evio_connections_active", "gauge", "Open connections.",
+			func(ls *LoopStats) interface{} { return ls.Active }},
+		{"evio_read_bytes_total", "counter", "Bytes read.",
+			func(ls *LoopStats) interface{} { return ls.BytesIn }},
+		{"evio_written_bytes_total", "counter", "Bytes written.",
+			func(ls *LoopStats) interface{} { return ls.BytesOut }},
+		{"evio_reads_total", "counter", "Reads that moved data.",
+			func(ls *LoopStats) interface{} { return ls.Reads }},
+		{"evio_writes_total", "counter", "Writes that moved data.",
+			func(ls *LoopStats) interface{} { return ls.Writes }},
+		{"evio_eagain_total", "counter", "Reads and writes that would have blocked.",
+			func(ls *LoopStats) interface{} { return ls.EAGAIN }},
+		{"evio_queued_bytes", "gauge", "Bytes of output waiting to be written.",
+			func(ls *LoopStats) interface{} { return ls.QueuedBytes }},
+		{"evio_wakeups_total", "counter", "Wake calls that fired a Data event.",
+			func(ls *LoopStats) interface{} { return ls.Wakeups }},
+		{"evio_events_total", "counter", "Events and timer functions called.",
+			func(ls *LoopStats) interface{} { return ls.Events }},
+		{"evio_event_seconds_total", "counter", "Time spent in events and timer functions.",
+			func(ls *LoopStats) interface{} { return ls.EventTime.Seconds() }},
+	}
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i := range s.Loops {
+			fmt.Fprintf(bw, "%s{loop=\"%d\"} %v\n", m.name, i, m.value(&s.Loops[i]))
+		}
+	}
+	return bw.Flush()
+}
+
+// loopStats are the counters of a loop. They're updated atomically, by
+// the loop and by the goroutines of its connections.
+type loopStats struct {
+	accepted  uint64
+	closed    uint64
+	active    int64
+	bytesIn   uint64
+	bytesOut  uint64
+	reads     uint64
+	writes    uint64
+	eagain    uint64
+	queued    int64
+	wakeups   uint64
+	events    uint64
+	eventTime int64
+}
+
+func newLoopStats(numLoops int) []*loopStats {
+	stats := make([]*loopStats, numLoops)
+	for i := range stats {
+		stats[i] = new(loopStats)
+	}
+	return stats
+}
+
+func (st *loopStats) load() LoopStats {
+	return LoopStats{
+		Accepted:    atomic.LoadUint64(&st.accepted),
+		Closed:      atomic.LoadUint64(&st.closed),
+		Active:      atomic.LoadInt64(&st.active),
+		BytesIn:     atomic.LoadUint64(&st.bytesIn),
+		BytesOut:    atomic.LoadUint64(&st.bytesOut),
+		Reads:       atomic.LoadUint64(&st.reads),
+		Writes:      atomic.LoadUint64(&st.writes),
+		EAGAIN:      atomic.LoadUint64(&st.eagain),
+		QueuedBytes: atomic.LoadInt64(&st.queued),
+		Wakeups:     atomic.LoadUint64(&st.wakeups),
+		Events:      atomic.LoadUint64(&st.events),
+		EventTime:   time.Duration(atomic.LoadInt64(&st.eventTime)),
+	}
+}
+
+// opened counts a new connection, which was accepted when it's inbound.
+func (st *loopStats) opened(inbound bool) {
+	if inbound {
+		atomic.AddUint64(&st.accepted, 1)
+	}
+	atomic.AddInt64(&st.active, 1)
+}
+
+// close counts a closed or detached connection.
+func (st *loopStats) close() {
+	atomic.AddUint64(&st.closed, 1)
+	atomic.AddInt64(&st.active, -1)
+}
+
+func (st *loopStats) read(n int) {
+	atomic.AddUint64(&st.reads, 1)
+	atomic.AddUint64(&st.bytesIn, uint64(n))
+}
+
+func (st *loopStats) write(n int) {
+	atomic.AddUint64(&st.writes, 1)
+	atomic.AddUint64(&st.bytesOut, uint64(n))
+}
+
+// queue adds n bytes, which may be negative, to the queued output.
+func (st *loopStats) queue(n int) {
+	atomic.AddInt64(&st.queued, int64(n))
+}
+
+// event counts an event that started at the time.
+func (st *loopStats) event(start time.Time) {
+	atomic.AddUint64(&st.events, 1)
+	atomic.AddInt64(&st.eventTime, int64(time.Since(start)))
+}
@@ -0,0 +1,283 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tlsConn is the TLS engine of a connection on the event loop. It runs a
+// crypto/tls connection on its own goroutine, over buffers instead of the
+// socket, and the loop drives it by feeding it the ciphertext that was
+// read. The goroutine wakes the loop once it has processed the input and
+// needs more, or has exited, so the engine never blocks on the network and
+// the loop never waits for the handshake or the certificate callbacks of
+// the config.
+//
+// Once detached, the engine is the io.ReadWriteCloser of the Detached
+// event, and reads and writes the socket directly.
+type tlsConn struct {
+	tc       *tls.Conn
+	wake     func() // wakes the loop, from the goroutine
+	mu       sync.Mutex
+	cond     *sync.Cond
+	woken    bool                 // the loop was woken and hasn't read yet
+	done     bool                 // the goroutine has exited
+	in       []byte               // ciphertext input
+	out      []byte               // ciphertext output
+	plain    []byte               // plaintext input
+	pending  []byte               // plaintext output held until the handshake
+	state    *tls.ConnectionState // set once the handshake is complete
+	err      error                // why the goroutine exited
+	closed   bool                 // closed with the connection
+	eof      bool                 // the peer shut down the socket
+	notified bool                 // a close_notify alert was sent
+	stop     bool                 // the goroutine should exit for a detach
+	rw       io.ReadWriteCloser   // socket of a detached connection
+}
+
+// errTLSEOF is the error of an engine whose peer shut down the socket
+// without a close_notify alert, which may be a half-close.
+var errTLSEOF = errors.New("evio: tls socket shut down")
+
+// tlsDetached is the temporary error that stops the goroutine of a
+// detached engine. It's temporary so that crypto/tls can keep reading.
+type tlsDetached struct{}
+
+func (tlsDetached) Error() string   { return "evio: tls engine detached" }
+func (tlsDetached) Timeout() bool   { return false }
+func (tlsDetached) Temporary() bool { return true }
+
+// newTLSConn starts the engine of a server connection, or of a client
+// connection for outbound connections. The engine calls wake whenever the
+// loop should read its output.
+func newTLSConn(config *tls.Config, client bool, wake func()) *tlsConn {
+	t := &tlsConn{wake: wake}
+	t.cond = sync.NewCond(&t.mu)
+	if client {
+		t.tc = tls.Client(tlsTransport{t}, config)
+	} else {
+		t.tc = tls.Server(tlsTransport{t}, config)
+	}
+	go t.run()
+	return t
+}
+
+// run handshakes and then decrypts the input until the connection fails,
+// closes or detaches.
+func (t *tlsConn) run() {
+	err := t.tc.Handshake()
+	if err != nil {
+		err = closeErr(ErrTLSHandshake, err)
+	} else {
+		state := t.tc.ConnectionState()
+		t.mu.Lock()
+		t.state = &state
+		t.mu.Unlock()
+		buf := make([]byte, 0x4000)
+		for err == nil {
+			var n int
+			n, err = t.tc.Read(buf)
+			t.mu.Lock()
+			t.plain = append(t.plain, buf[:n]...)
+			t.mu.Unlock()
+		}
+	}
+	t.mu.Lock()
+	t.err = err
+	t.done = true
+	t.notify()
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// notify wakes the loop, unless it already was, and is called by the
+// goroutine with the lock held.
+func (t *tlsConn) notify() {
+	if !t.woken && !t.closed {
+		t.woken = true
+		t.wake()
+	}
+}
+
+// feed passes ciphertext that was read from the socket to the engine,
+// which wakes the loop once it has been processed.
+func (t *tlsConn) feed(data []byte) {
+	t.mu.Lock()
+	t.in = append(t.in, data...)
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// feedEOF tells the engine that the peer shut down the socket, which it
+// reports with errTLSEOF once it has processed the input.
+func (t *tlsConn) feedEOF() {
+	t.mu.Lock()
+	t.eof = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// write encrypts plaintext output, or holds it until the handshake is
+// complete. The held output is written first once it is.
+func (t *tlsConn) write(data []byte) {
+	if len(data) == 0 && len(t.pending) == 0 {
+		return
+	}
+	if t.connState() == nil {
+		t.pending = append(t.pending, data...)
+		return
+	}
+	if len(t.pending) > 0 {
+		t.tc.Write(t.pending)
+		t.pending = nil
+	}
+	if len(data) > 0 {
+		t.tc.Write(data)
+	}
+}
+
+// closeNotify encrypts a close_notify alert once, and returns false when
+// there is none to write because the handshake isn't complete or it was
+// already written.
+func (t *tlsConn) closeNotify() bool {
+	if t.notified || t.connState() == nil {
+		return false
+	}
+	t.notified = true
+	return t.tc.CloseWrite() == nil
+}
+
+// appendOut moves the ciphertext output to b.
+func (t *tlsConn) appendOut(b []byte) []byte {
+	t.mu.Lock()
+	b = append(b, t.out...)
+	t.out = t.out[:0]
+	t.mu.Unlock()
+	return b
+}
+
+// read takes the plaintext input once the loop was woken, and returns the
+// error that stopped the engine, which is io.EOF when the peer sent a
+// close_notify alert.
+func (t *tlsConn) read() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.woken = false
+	in := t.plain
+	t.plain = nil
+	return in, t.err
+}
+
+// connState returns the state of the connection once the handshake is
+// complete, and nil before.
+func (t *tlsConn) connState() *tls.ConnectionState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// close stops the engine of a closed connection.
+func (t *tlsConn) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// detach stops the goroutine, and switches the engine to the socket.
+func (t *tlsConn) detach(rw io.ReadWriteCloser) {
+	t.mu.Lock()
+	t.rw = rw
+	t.stop = true
+	t.cond.Broadcast()
+	for !t.done {
+		t.cond.Wait()
+	}
+	t.stop = false
+	t.mu.Unlock()
+}
+
+// Read, Write and Close are for detached connections. Read returns the
+// plaintext that the loop didn't take first.
+func (t *tlsConn) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	if len(t.plain) > 0 {
+		n := copy(p, t.plain)
+		t.plain = t.plain[n:]
+		t.mu.Unlock()
+		return n, nil
+	}
+	t.mu.Unlock()
+	return t.tc.Read(p)
+}
+
+func (t *tlsConn) Write(p []byte) (int, error) {
+	return t.tc.Write(p)
+}
+
+func (t *tlsConn) Close() error {
+	return t.rw.Close()
+}
+
+// tlsTransport is the net.Conn of a crypto/tls connection that reads and
+// writes the buffers of its engine, or the socket once detached.
+type tlsTransport struct{ t *tlsConn }
+
+func (tr tlsTransport) Read(p []byte) (int, error) {
+	t := tr.t
+	t.mu.Lock()
+	for len(t.in) == 0 && !t.closed && !t.eof && !t.stop && t.rw == nil {
+		// processed all of the input
+		t.notify()
+		t.cond.Wait()
+	}
+	if len(t.in) > 0 {
+		n := copy(p, t.in)
+		t.in = t.in[n:]
+		t.mu.Unlock()
+		return n, nil
+	}
+	if t.closed {
+		t.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	if t.eof {
+		t.mu.Unlock()
+		return 0, errTLSEOF
+	}
+	if t.stop {
+		t.mu.Unlock()
+		return 0, tlsDetached{}
+	}
+	rw := t.rw
+	t.mu.Unlock()
+	return rw.Read(p)
+}
+
+func (tr tlsTransport) Write(p []byte) (int, error) {
+	t := tr.t
+	t.mu.Lock()
+	rw := t.rw
+	if rw == nil {
+		t.out = append(t.out, p...)
+		t.mu.Unlock()
+		return len(p), nil
+	}
+	t.mu.Unlock()
+	return rw.Write(p)
+}
+
+func (tr tlsTransport) Close() error                       { return nil }
+func (tr tlsTransport) LocalAddr() net.Addr                { return nil }
+func (tr tlsTransport) RemoteAddr() net.Addr               { return nil }
+func (tr tlsTransport) SetDeadline(t time.Time) error      { return nil }
+func (tr tlsTransport) SetReadDeadline(t time.Time) error  { return nil }
+func (tr tlsTransport) SetWriteDeadline(t time.Time) error { return nil }
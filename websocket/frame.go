@@ -0,0 +1,187 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+)
+
+// Opcode is the type of a frame or message.
+type Opcode byte
+
+// Opcodes of RFC 6455. OnMessage only receives text and binary messages,
+// and the control frames are handled by the connection.
+const (
+	opContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// control returns true for close, ping and pong frames.
+func (op Opcode) control() bool { return op&0x8 != 0 }
+
+// Close codes of RFC 6455.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // no code in the close frame
+	CloseAbnormal        = 1006 // closed without a close frame
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// validCloseCode returns true for the codes that may be sent in a close
+// frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40 // compressed message
+	rsvBits = 0x70
+	maskBit = 0x80
+)
+
+// frame is a frame of a client, with the payload unmasked in place.
+type frame struct {
+	fin     bool
+	rsv     byte
+	op      Opcode
+	masked  bool
+	payload []byte
+}
+
+// parseFrameHeader returns the length of the frame header at the start of
+// data and the length of its payload, or a zero header length when data
+// is too short to tell.
+func parseFrameHeader(data []byte) (hlen int, plen uint64) {
+	if len(data) < 2 {
+		return 0, 0
+	}
+	hlen = 2
+	plen = uint64(data[1] & 0x7F)
+	switch plen {
+	case 126:
+		hlen += 2
+		if len(data) < hlen {
+			return 0, 0
+		}
+		plen = uint64(binary.BigEndian.Uint16(data[2:]))
+	case 127:
+		hlen += 8
+		if len(data) < hlen {
+			return 0, 0
+		}
+		plen = binary.BigEndian.Uint64(data[2:])
+	}
+	if data[1]&maskBit != 0 {
+		hlen += 4
+		if len(data) < hlen {
+			return 0, 0
+		}
+	}
+	return hlen, plen
+}
+
+// parseFrame parses the frame at the start of data, whose header has the
+// lengths of parseFrameHeader, and returns the length of the frame or zero
+// when the payload is incomplete.
+func parseFrame(data []byte, hlen int, plen uint64) (f frame, n int) {
+	if uint64(len(data)-hlen) < plen {
+		return f, 0
+	}
+	n = hlen + int(plen)
+	f.fin = data[0]&finBit != 0
+	f.rsv = data[0] & rsvBits
+	f.op = Opcode(data[0] & 0xF)
+	f.masked = data[1]&maskBit != 0
+	f.payload = data[hlen:n]
+	if f.masked {
+		mask := data[hlen-4 : hlen]
+		for i := range f.payload {
+			f.payload[i] ^= mask[i&3]
+		}
+	}
+	return f, n
+}
+
+// appendFrame appends an unmasked server frame.
+func appendFrame(b []byte, op Opcode, rsv byte, payload []byte) []byte {
+	b = append(b, finBit|rsv|byte(op))
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 126, byte(n>>8), byte(n))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	return append(b, payload...)
+}
+
+// deflateTail is the end of a flushed deflate block, which is stripped
+// from compressed messages by RFC 7692.
+var deflateTail = []byte{0x00, 0x00, 0xFF, 0xFF}
+
+// compressor compresses messages without context takeover.
+type compressor struct {
+	buf bytes.Buffer
+	fw  *flate.Writer
+}
+
+func (z *compressor) compress(payload []byte) []byte {
+	z.buf.Reset()
+	if z.fw == nil {
+		z.fw, _ = flate.NewWriter(&z.buf, flate.BestSpeed)
+	} else {
+		z.fw.Reset(&z.buf)
+	}
+	z.fw.Write(payload)
+	z.fw.Flush()
+	return bytes.TrimSuffix(z.buf.Bytes(), deflateTail)
+}
+
+// decompressor decompresses messages without context takeover.
+type decompressor struct {
+	in  []byte
+	src bytes.Reader
+	fr  io.ReadCloser
+}
+
+// decompress returns the decompressed message, or nil and false when it's
+// larger than max or malformed.
+func (z *decompressor) decompress(payload []byte, max int) ([]byte, bool) {
+	// payload may be followed by the next frame
+	z.in = append(append(z.in[:0], payload...), deflateTail...)
+	z.src.Reset(z.in)
+	if z.fr == nil {
+		z.fr = flate.NewReader(&z.src)
+	} else {
+		z.fr.(flate.Resetter).Reset(&z.src, nil)
+	}
+	msg, err := io.ReadAll(io.LimitReader(z.fr, int64(max)+1))
+	if (err != nil && err != io.ErrUnexpectedEOF) || len(msg) > max {
+		return nil, false
+	}
+	return msg, true
+}
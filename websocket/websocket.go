@@ -0,0 +1,549 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package websocket implements WebSocket servers on evio, with the
+// protocol of RFC 6455 and the permessage-deflate extension of RFC 7692.
+//
+// A Server produces the evio events that upgrade the connections, parse
+// the frames, answer pings and run the closing handshake, and it calls
+// OnMessage with each text or binary message:
+//
+//	var ws websocket.Server
+//	ws.OnMessage = func(c *websocket.Conn, op websocket.Opcode, payload []byte) {
+//		c.WriteMessage(op, payload)
+//	}
+//	evio.Serve("tcp://:8080", ws.Events())
+package websocket
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"evio"
+)
+
+// DefaultMaxMessageSize is the size limit of messages when the
+// MaxMessageSize of the server is zero.
+const DefaultMaxMessageSize = 16 << 20
+
+// DefaultCloseTimeout is the time that the client has to answer a close
+// frame of the server when the CloseTimeout of the server is zero.
+const DefaultCloseTimeout = 5 * time.Second
+
+// maxRequestSize limits the size of the handshake request.
+const maxRequestSize = 8 << 10
+
+// ErrClosed is returned for writes after the close frame was sent.
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Server is a WebSocket server. Its events are set before calling Events,
+// and they all run on the loop of the connection.
+type Server struct {
+	// Options are the options of every connection, such as the timeouts
+	// and the TLSConfig.
+	Options evio.Options
+	// Subprotocols are the subprotocols of the server, in order of
+	// preference. The first one that the client also offers is selected.
+	Subprotocols []string
+	// Compression enables the permessage-deflate extension for clients
+	// that offer it. Messages are compressed without context takeover.
+	Compression bool
+	// MaxMessageSize limits the size of messages, once decompressed, and
+	// the connection is closed with CloseMessageTooBig for larger ones.
+	// Zero means DefaultMaxMessageSize.
+	MaxMessageSize int
+	// CloseTimeout is the time that the client has to answer the close
+	// frame of Conn.Close before the connection is closed anyway. Zero
+	// means DefaultCloseTimeout.
+	CloseTimeout time.Duration
+	// Upgrade fires with the handshake request of a connection, and
+	// returning false refuses the connection with 403 Forbidden. It may
+	// set the context of the connection.
+	Upgrade func(c *Conn, r *Request) bool
+	// OnOpen fires once a connection has been upgraded.
+	OnOpen func(c *Conn)
+	// OnMessage fires with a text or binary message, whose fragments have
+	// been joined and decompressed. Text messages are valid UTF-8. The
+	// payload is only valid until OnMessage returns.
+	OnMessage func(c *Conn, opcode Opcode, payload []byte)
+	// OnClose fires once an upgraded connection is closed, with the code
+	// and reason of the close frame of the client, or the code that the
+	// server closed it with. The code is CloseAbnormal when the connection
+	// closed without a close frame.
+	OnClose func(c *Conn, code int, reason string)
+}
+
+// Request is the handshake request of a connection.
+type Request struct {
+	// URI is the request target, such as "/chat?room=1".
+	URI string
+	// Host is the Host header.
+	Host string
+	// Header is the request header, with canonical keys.
+	Header textproto.MIMEHeader
+}
+
+// Conn is a WebSocket connection. Its methods are safe to call from any
+// goroutine.
+type Conn struct {
+	conn        evio.Conn
+	s           *Server
+	ctx         interface{}
+	req         *Request
+	subprotocol string
+	is          evio.InputStream
+	upgraded    bool // the handshake is complete
+	deflate     bool // permessage-deflate was negotiated
+	msgOp       Opcode
+	msgDeflate  bool
+	msg         []byte // fragments of the message
+	closing     bool   // the input is ignored
+	code        int    // close code for OnClose
+	reason      string // close reason for OnClose
+	z           decompressor
+
+	mu        sync.Mutex // guards the writes
+	closeSent bool
+	zw        compressor
+	wbuf      []byte
+	inData    bool   // the output is appended to out
+	out       []byte // output of the Data event
+}
+
+// Conn returns the evio connection.
+func (c *Conn) Conn() evio.Conn { return c.conn }
+
+// Context returns a user-defined context.
+func (c *Conn) Context() interface{} { return c.ctx }
+
+// SetContext sets a user-defined context.
+func (c *Conn) SetContext(ctx interface{}) { c.ctx = ctx }
+
+// Request returns the handshake request.
+func (c *Conn) Request() *Request { return c.req }
+
+// Subprotocol returns the selected subprotocol, or an empty string.
+func (c *Conn) Subprotocol() string { return c.subprotocol }
+
+// LocalAddr is the local address of the connection.
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr is the remote address of the connection.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// WriteMessage writes a message of a single frame. The opcode is OpText,
+// OpBinary, OpPing or OpPong. Text and binary messages are compressed
+// when the connection negotiated permessage-deflate.
+func (c *Conn) WriteMessage(opcode Opcode, payload []byte) error {
+	switch opcode {
+	case OpText, OpBinary:
+	case OpPing, OpPong:
+		if len(payload) > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+	default:
+		return errors.New("websocket: invalid opcode")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeFrame(opcode, payload)
+}
+
+// Close starts the closing handshake by sending a close frame with the
+// code and reason. The connection is closed once the client answers with
+// its own close frame, or after the CloseTimeout of the server.
+func (c *Conn) Close(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writeClose(code, reason); err != nil {
+		return err
+	}
+	c.conn.AfterFunc(c.s.closeTimeout(), func() {
+		if !c.closing {
+			// the client never answered, so OnClose has the code
+			// that the server closed with
+			c.closing = true
+			c.code, c.reason = code, reason
+			c.conn.Close()
+		}
+	})
+	return nil
+}
+
+// write writes the data, and is called with the lock held. The output of
+// the Data event is appended to its out return value, which saves queueing
+// a write, and other goroutines write to the evio connection.
+func (c *Conn) write(data []byte) error {
+	if c.inData {
+		c.out = append(c.out, data...)
+		return nil
+	}
+	return c.conn.Write(data)
+}
+
+// writeFrame writes a frame, and is called with the lock held.
+func (c *Conn) writeFrame(op Opcode, payload []byte) error {
+	if c.closeSent {
+		return ErrClosed
+	}
+	var rsv byte
+	if c.deflate && !op.control() && len(payload) > 64 {
+		payload = c.zw.compress(payload)
+		rsv = rsv1Bit
+	}
+	if c.inData {
+		c.out = appendFrame(c.out, op, rsv, payload)
+		return nil
+	}
+	c.wbuf = appendFrame(c.wbuf[:0], op, rsv, payload)
+	return c.conn.Write(c.wbuf)
+}
+
+// writeClose writes a close frame once, and is called with the lock held.
+func (c *Conn) writeClose(code int, reason string) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	err := c.writeFrame(OpClose, payload)
+	c.closeSent = true
+	return err
+}
+
+// Events returns the evio events of the server. The other events, such as
+// Serving and NumLoops, may be set on the result.
+func (s *Server) Events() evio.Events {
+	var events evio.Events
+	events.Opened = func(ec evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
+		ec.SetContext(&Conn{conn: ec, s: s, code: CloseAbnormal})
+		return nil, s.Options, evio.None
+	}
+	events.Data = func(ec evio.Conn, in []byte) (out []byte, action evio.Action) {
+		c, _ := ec.Context().(*Conn)
+		if c == nil || c.closing || in == nil {
+			return nil, evio.None
+		}
+		// the output buffer is reused, since evio copies it
+		c.mu.Lock()
+		c.inData = true
+		c.out = c.out[:0]
+		c.mu.Unlock()
+		data := c.is.Begin(in)
+		if !c.upgraded {
+			data, action = c.handshake(data)
+		}
+		for action == evio.None && c.upgraded && len(data) > 0 {
+			var n int
+			n, action = c.readFrame(data)
+			if n == 0 {
+				break
+			}
+			data = data[n:]
+		}
+		if action != evio.None {
+			c.closing = true
+			data = nil
+		}
+		c.is.End(data)
+		c.mu.Lock()
+		c.inData = false
+		out = c.out
+		c.mu.Unlock()
+		return out, action
+	}
+	events.Closed = func(ec evio.Conn, err error) (action evio.Action) {
+		c, _ := ec.Context().(*Conn)
+		if c != nil && c.upgraded && s.OnClose != nil {
+			s.OnClose(c, c.code, c.reason)
+		}
+		return evio.None
+	}
+	return events
+}
+
+func (s *Server) maxMessageSize() int {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+func (s *Server) closeTimeout() time.Duration {
+	if s.CloseTimeout > 0 {
+		return s.CloseTimeout
+	}
+	return DefaultCloseTimeout
+}
+
+// fail closes the connection with a close frame for an error of the
+// client.
+func (c *Conn) fail(code int) evio.Action {
+	c.mu.Lock()
+	if !c.closeSent {
+		c.writeClose(code, "")
+	}
+	c.mu.Unlock()
+	c.code, c.reason = code, ""
+	return evio.Close
+}
+
+// readFrame processes the frame at the start of data, and returns its
+// length, or zero when it's incomplete.
+func (c *Conn) readFrame(data []byte) (int, evio.Action) {
+	hlen, plen := parseFrameHeader(data)
+	if hlen == 0 {
+		return 0, evio.None
+	}
+	if plen > uint64(c.s.maxMessageSize()-len(c.msg)) {
+		return 0, c.fail(CloseMessageTooBig)
+	}
+	f, n := parseFrame(data, hlen, plen)
+	if n == 0 {
+		return 0, evio.None
+	}
+	if !f.masked || f.rsv&^rsv1Bit != 0 {
+		return n, c.fail(CloseProtocolError)
+	}
+	if f.op.control() {
+		if !f.fin || len(f.payload) > 125 || f.rsv != 0 {
+			return n, c.fail(CloseProtocolError)
+		}
+		return n, c.control(f)
+	}
+	switch f.op {
+	case opContinuation:
+		if c.msgOp == 0 || f.rsv != 0 {
+			return n, c.fail(CloseProtocolError)
+		}
+	case OpText, OpBinary:
+		if c.msgOp != 0 || (f.rsv != 0 && !c.deflate) {
+			return n, c.fail(CloseProtocolError)
+		}
+		c.msgOp = f.op
+		c.msgDeflate = f.rsv != 0
+	default:
+		return n, c.fail(CloseProtocolError)
+	}
+	payload := f.payload
+	if !f.fin || len(c.msg) > 0 {
+		c.msg = append(c.msg, f.payload...)
+		payload = c.msg
+	}
+	if !f.fin {
+		return n, evio.None
+	}
+	op := c.msgOp
+	c.msgOp = 0
+	defer func() { c.msg = c.msg[:0] }()
+	if c.msgDeflate {
+		var ok bool
+		payload, ok = c.z.decompress(payload, c.s.maxMessageSize())
+		if !ok {
+			return n, c.fail(CloseMessageTooBig)
+		}
+	}
+	if op == OpText && !utf8.Valid(payload) {
+		return n, c.fail(CloseInvalidPayload)
+	}
+	if c.s.OnMessage != nil {
+		c.s.OnMessage(c, op, payload)
+	}
+	return n, evio.None
+}
+
+// control processes a control frame.
+func (c *Conn) control(f frame) evio.Action {
+	switch f.op {
+	case OpPing:
+		c.mu.Lock()
+		c.writeFrame(OpPong, f.payload)
+		c.mu.Unlock()
+	case OpPong:
+	case OpClose:
+		code, reason := CloseNoStatus, ""
+		if len(f.payload) == 1 {
+			return c.fail(CloseProtocolError)
+		}
+		if len(f.payload) >= 2 {
+			code = int(binary.BigEndian.Uint16(f.payload))
+			reason = string(f.payload[2:])
+			if !validCloseCode(code) {
+				return c.fail(CloseProtocolError)
+			}
+			if !utf8.ValidString(reason) {
+				return c.fail(CloseInvalidPayload)
+			}
+		}
+		c.mu.Lock()
+		if !c.closeSent {
+			if code == CloseNoStatus {
+				c.writeClose(CloseNormal, "")
+			} else {
+				c.writeClose(code, "")
+			}
+		}
+		c.mu.Unlock()
+		c.code, c.reason = code, reason
+		return evio.Close
+	default:
+		return c.fail(CloseProtocolError)
+	}
+	return evio.None
+}
+
+// handshake reads the handshake request at the start of data, and upgrades
+// the connection or refuses it. It returns the rest of data.
+func (c *Conn) handshake(data []byte) ([]byte, evio.Action) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(data) > maxRequestSize {
+			return nil, c.refuse("431 Request Header Fields Too Large", "")
+		}
+		return data, evio.None
+	}
+	req, key, ok := parseRequest(string(data[:end]))
+	data = data[end+4:]
+	if !ok {
+		return nil, c.refuse("400 Bad Request", "")
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		return nil, c.refuse("426 Upgrade Required", "Sec-WebSocket-Version: 13\r\n")
+	}
+	c.req = req
+	if c.s.Upgrade != nil && !c.s.Upgrade(c, req) {
+		return nil, c.refuse("403 Forbidden", "")
+	}
+	head := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	c.subprotocol = selectSubprotocol(c.s.Subprotocols, req.Header["Sec-Websocket-Protocol"])
+	if c.subprotocol != "" {
+		head += "Sec-WebSocket-Protocol: " + c.subprotocol + "\r\n"
+	}
+	if c.s.Compression && offersDeflate(req.Header["Sec-Websocket-Extensions"]) {
+		c.deflate = true
+		head += "Sec-WebSocket-Extensions: permessage-deflate; " +
+			"server_no_context_takeover; client_no_context_takeover\r\n"
+	}
+	// written before any message of OnOpen
+	c.mu.Lock()
+	c.write([]byte(head + "\r\n"))
+	c.mu.Unlock()
+	c.upgraded = true
+	if c.s.OnOpen != nil {
+		c.s.OnOpen(c)
+	}
+	return data, evio.None
+}
+
+// refuse writes an HTTP error response and closes the connection.
+func (c *Conn) refuse(status, head string) evio.Action {
+	c.mu.Lock()
+	c.write([]byte("HTTP/1.1 " + status + "\r\n" + head +
+		"Connection: close\r\nContent-Length: 0\r\n\r\n"))
+	c.mu.Unlock()
+	return evio.Close
+}
+
+// parseRequest parses the head of a handshake request, without the final
+// CRLF, and returns it with the key of the client.
+func parseRequest(head string) (req *Request, key string, ok bool) {
+	lines := strings.Split(head, "\r\n")
+	parts := strings.Split(lines[0], " ")
+	if len(parts) != 3 || parts[0] != "GET" || !strings.HasPrefix(parts[2], "HTTP/1.") ||
+		parts[2] == "HTTP/1.0" {
+		return nil, "", false
+	}
+	req = &Request{URI: parts[1], Header: make(textproto.MIMEHeader)}
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, "", false
+		}
+		req.Header.Add(textproto.CanonicalMIMEHeaderKey(line[:i]),
+			strings.TrimSpace(line[i+1:]))
+	}
+	req.Host = req.Header.Get("Host")
+	if !hasToken(req.Header["Upgrade"], "websocket") ||
+		!hasToken(req.Header["Connection"], "upgrade") {
+		return nil, "", false
+	}
+	key = req.Header.Get("Sec-Websocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return nil, "", false
+	}
+	return req, key, true
+}
+
+// hasToken returns true when the comma-separated values have the token,
+// which is matched without case.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptKey returns the Sec-WebSocket-Accept value for the key.
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// selectSubprotocol returns the first subprotocol of the server that the
+// client offers.
+func selectSubprotocol(server, offers []string) string {
+	for _, p := range server {
+		if hasToken(offers, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// offersDeflate returns true when the client offers permessage-deflate with
+// parameters that the server supports. The server can't limit its window,
+// so offers with a server_max_window_bits below 15 are declined.
+func offersDeflate(values []string) bool {
+	for _, v := range values {
+	offers:
+		for _, offer := range strings.Split(v, ",") {
+			params := strings.Split(offer, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			for _, param := range params[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				value = strings.Trim(value, `"`)
+				switch strings.TrimSpace(name) {
+				case "server_no_context_takeover", "client_no_context_takeover",
+					"client_max_window_bits":
+				case "server_max_window_bits":
+					if value != "15" {
+						continue offers
+					}
+				default:
+					continue offers
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,383 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"evio"
+)
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// testClient is a WebSocket client over a net.Conn.
+type testClient struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	resp *http.Response
+}
+
+// dial connects and sends the handshake request with the extra header
+// lines.
+func dial(addr, header string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	must(err)
+	key := make([]byte, 16)
+	rand.Read(key)
+	fmt.Fprintf(conn, "GET /chat?room=1 HTTP/1.1\r\nHost: %s\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n%s\r\n",
+		addr, base64.StdEncoding.EncodeToString(key), header)
+	c := &testClient{conn: conn, rd: bufio.NewReader(conn)}
+	c.resp, err = http.ReadResponse(c.rd, nil)
+	must(err)
+	if c.resp.StatusCode == 101 &&
+		c.resp.Header.Get("Sec-Websocket-Accept") != acceptKey(base64.StdEncoding.EncodeToString(key)) {
+		panic("invalid Sec-WebSocket-Accept")
+	}
+	return c
+}
+
+// write writes a masked frame. Errors are ignored, because the server may
+// close the connection before reading all of a frame that's too big.
+func (c *testClient) write(b0 byte, payload []byte) {
+	b := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xFFFF:
+		b = append(b, maskBit|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	b = append(b, mask...)
+	for i, x := range payload {
+		b = append(b, x^mask[i&3])
+	}
+	c.conn.Write(b)
+}
+
+// read reads a frame, and decompresses it when RSV1 is set.
+func (c *testClient) read() (op Opcode, payload []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	head := make([]byte, 2)
+	_, err := io.ReadFull(c.rd, head)
+	must(err)
+	if head[1]&maskBit != 0 {
+		panic("masked server frame")
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(c.rd, ext)
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(c.rd, ext)
+		n = binary.BigEndian.Uint64(ext)
+	}
+	must(err)
+	payload = make([]byte, n)
+	_, err = io.ReadFull(c.rd, payload)
+	must(err)
+	if head[0]&rsv1Bit != 0 {
+		fr := flate.NewReader(io.MultiReader(bytes.NewReader(payload),
+			bytes.NewReader(deflateTail)))
+		payload, err = io.ReadAll(fr)
+		if err != io.ErrUnexpectedEOF {
+			must(err)
+		}
+	}
+	return Opcode(head[0] & 0xF), payload
+}
+
+// expectClose reads a close frame with the code, and then the end of the
+// connection, which is reset when the server closed it with unread input.
+func (c *testClient) expectClose(code int) {
+	op, payload := c.read()
+	if op != OpClose || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		panic(fmt.Sprintf("expected close %d, got %d %q", code, op, payload))
+	}
+	if _, err := c.rd.ReadByte(); err != io.EOF && !errors.Is(err, syscall.ECONNRESET) {
+		panic(fmt.Sprintf("expected EOF, got %v", err))
+	}
+	c.conn.Close()
+}
+
+// testServe serves the websocket server until the client function returns.
+func testServe(t *testing.T, s *Server, addr string, client func(addr string)) {
+	events := s.Events()
+	var done int32
+	events.Serving = func(srv evio.Server) (action evio.Action) {
+		go func() {
+			defer atomic.StoreInt32(&done, 1)
+			client(srv.Addrs[0].String())
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action evio.Action) {
+		if atomic.LoadInt32(&done) != 0 {
+			action = evio.Shutdown
+		}
+		return 10 * time.Millisecond, action
+	}
+	must(evio.Serve(addr, events))
+}
+
+func TestWebSocket(t *testing.T) {
+	testWebSocket(t, "tcp://127.0.0.1:20054")
+	testWebSocket(t, "tcp-net://127.0.0.1:20055")
+}
+
+func testWebSocket(t *testing.T, addr string) {
+	var s Server
+	closed := make(chan string, 10)
+	s.Subprotocols = []string{"chat", "superchat"}
+	s.Upgrade = func(c *Conn, r *Request) bool {
+		if r.URI != "/chat?room=1" || r.Header.Get("Origin") == "evil" {
+			return false
+		}
+		c.SetContext(r.Header.Get("Origin"))
+		return true
+	}
+	s.OnOpen = func(c *Conn) {
+		c.WriteMessage(OpText, []byte("welcome "+c.Context().(string)))
+	}
+	s.OnMessage = func(c *Conn, op Opcode, payload []byte) {
+		switch string(payload) {
+		case "bye":
+			c.Close(CloseGoingAway, "bye")
+		default:
+			c.WriteMessage(op, payload)
+		}
+	}
+	s.OnClose = func(c *Conn, code int, reason string) {
+		closed <- fmt.Sprintf("%d %s", code, reason)
+	}
+	s.MaxMessageSize = 1 << 20
+	s.CloseTimeout = 200 * time.Millisecond
+	expectClosed := func(expect string) {
+		if got := <-closed; got != expect {
+			panic(fmt.Sprintf("expected closed '%s', got '%s'", expect, got))
+		}
+	}
+	testServe(t, &s, addr, func(addr string) {
+		// echo, fragments and closing handshake of the client
+		c := dial(addr, "Origin: home\r\nSec-WebSocket-Protocol: superchat, chat\r\n")
+		if c.resp.StatusCode != 101 || c.resp.Header.Get("Sec-Websocket-Protocol") != "chat" {
+			panic(fmt.Sprintf("unexpected response %v", c.resp))
+		}
+		if op, payload := c.read(); op != OpText || string(payload) != "welcome home" {
+			panic(fmt.Sprintf("unexpected message %q", payload))
+		}
+		c.write(finBit|byte(OpText), []byte("hello"))
+		if op, payload := c.read(); op != OpText || string(payload) != "hello" {
+			panic(fmt.Sprintf("unexpected message %q", payload))
+		}
+		big := bytes.Repeat([]byte{0, 1, 2, 3}, 50000)
+		c.write(finBit|byte(OpBinary), big)
+		if op, payload := c.read(); op != OpBinary || !bytes.Equal(payload, big) {
+			panic("unexpected binary message")
+		}
+		c.write(byte(OpText), []byte("frag"))
+		c.write(finBit|byte(OpPing), []byte("ping"))
+		c.write(byte(opContinuation), []byte("men"))
+		c.write(finBit|byte(opContinuation), []byte("ted"))
+		if op, payload := c.read(); op != OpPong || string(payload) != "ping" {
+			panic(fmt.Sprintf("unexpected pong %q", payload))
+		}
+		if op, payload := c.read(); op != OpText || string(payload) != "fragmented" {
+			panic(fmt.Sprintf("unexpected message %q", payload))
+		}
+		c.write(finBit|byte(OpClose), []byte("\x03\xe8done"))
+		c.expectClose(CloseNormal)
+		expectClosed("1000 done")
+
+		// closing handshake of the server
+		c = dial(addr, "Origin: home\r\n")
+		if c.resp.Header.Get("Sec-Websocket-Protocol") != "" {
+			panic("unexpected subprotocol")
+		}
+		c.read()
+		c.write(finBit|byte(OpText), []byte("bye"))
+		if op, payload := c.read(); op != OpClose || string(payload) != "\x03\xe9bye" {
+			panic(fmt.Sprintf("unexpected close %q", payload))
+		}
+		c.write(finBit|byte(OpClose), []byte("\x03\xe9"))
+		if _, err := c.rd.ReadByte(); err != io.EOF {
+			panic(fmt.Sprintf("expected EOF, got %v", err))
+		}
+		c.conn.Close()
+		expectClosed("1001 ")
+
+		// the client never answers the close frame of the server
+		c = dial(addr, "Origin: home\r\n")
+		c.read()
+		c.write(finBit|byte(OpText), []byte("bye"))
+		start := time.Now()
+		if op, _ := c.read(); op != OpClose {
+			panic(fmt.Sprintf("unexpected opcode %d", op))
+		}
+		if _, err := c.rd.ReadByte(); err != io.EOF {
+			panic(fmt.Sprintf("expected EOF, got %v", err))
+		}
+		if d := time.Since(start); d < 150*time.Millisecond {
+			panic(fmt.Sprintf("expected a close timeout after 200ms, got %s", d))
+		}
+		c.conn.Close()
+		expectClosed("1001 bye")
+
+		// protocol errors
+		for _, frame := range []struct {
+			b0      byte
+			payload []byte
+			code    int
+			unmask  bool
+		}{
+			{finBit | byte(OpText), []byte("unmasked"), CloseProtocolError, true},
+			{finBit | byte(OpText), []byte("\xff\xfe"), CloseInvalidPayload, false},
+			{finBit | byte(OpBinary), make([]byte, 1<<20+1), CloseMessageTooBig, false},
+			{finBit | rsv1Bit | byte(OpText), []byte("x"), CloseProtocolError, false},
+			{finBit | 0x3, []byte("x"), CloseProtocolError, false},
+			{byte(OpPing), []byte("x"), CloseProtocolError, false},
+			{finBit | byte(opContinuation), []byte("x"), CloseProtocolError, false},
+			{finBit | byte(OpClose), []byte("\x03\xed"), CloseProtocolError, false},
+		} {
+			c = dial(addr, "Origin: home\r\n")
+			c.read()
+			if frame.unmask {
+				_, err := c.conn.Write(append([]byte{frame.b0, byte(len(frame.payload))},
+					frame.payload...))
+				must(err)
+			} else {
+				c.write(frame.b0, frame.payload)
+			}
+			c.expectClose(frame.code)
+			expectClosed(fmt.Sprintf("%d ", frame.code))
+		}
+
+		// refused handshakes
+		for _, expect := range []struct {
+			request string
+			status  int
+		}{
+			{"GET / HTTP/1.1\r\nHost: x\r\n\r\n", 400},
+			{"POST /chat?room=1 HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", 400},
+			{"GET /chat?room=1 HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Key: c2hvcnQ=\r\nSec-WebSocket-Version: 13\r\n\r\n", 400},
+			{"GET /chat?room=1 HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n\r\n", 426},
+			{"GET /chat?room=1 HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" +
+				"Origin: evil\r\n\r\n", 403},
+			{"GET / HTTP/1.1\r\n" + strings.Repeat("X-Long: header\r\n", 1000), 431},
+		} {
+			conn, err := net.Dial("tcp", addr)
+			must(err)
+			_, err = conn.Write([]byte(expect.request))
+			must(err)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			must(err)
+			if resp.StatusCode != expect.status {
+				panic(fmt.Sprintf("expected status %d, got %d", expect.status, resp.StatusCode))
+			}
+			if expect.status == 426 && resp.Header.Get("Sec-Websocket-Version") != "13" {
+				panic("expected Sec-WebSocket-Version")
+			}
+			conn.Close()
+		}
+
+		// connection closed without a close frame
+		c = dial(addr, "Origin: home\r\n")
+		c.read()
+		c.conn.Close()
+		expectClosed("1006 ")
+	})
+}
+
+func TestCompression(t *testing.T) {
+	testCompression(t, "tcp://127.0.0.1:20056")
+	testCompression(t, "tcp-net://127.0.0.1:20057")
+}
+
+func testCompression(t *testing.T, addr string) {
+	var s Server
+	s.Compression = true
+	s.MaxMessageSize = 1 << 20
+	s.OnMessage = func(c *Conn, op Opcode, payload []byte) {
+		c.WriteMessage(op, payload)
+	}
+	compress := func(payload []byte) []byte {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		fw.Write(payload)
+		fw.Flush()
+		return bytes.TrimSuffix(buf.Bytes(), deflateTail)
+	}
+	testServe(t, &s, addr, func(addr string) {
+		c := dial(addr, "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10, "+
+			"permessage-deflate; client_max_window_bits\r\n")
+		ext := c.resp.Header.Get("Sec-Websocket-Extensions")
+		if !strings.HasPrefix(ext, "permessage-deflate") || strings.Contains(ext, "server_max_window_bits") {
+			panic(fmt.Sprintf("unexpected extensions %q", ext))
+		}
+		msg := []byte(strings.Repeat("hello websocket ", 1000))
+		// compressed, then fragmented and compressed
+		c.write(finBit|rsv1Bit|byte(OpText), compress(msg))
+		if op, payload := c.read(); op != OpText || !bytes.Equal(payload, msg) {
+			panic("unexpected message")
+		}
+		z := compress(msg)
+		c.write(rsv1Bit|byte(OpText), z[:10])
+		c.write(finBit|byte(opContinuation), z[10:])
+		if op, payload := c.read(); op != OpText || !bytes.Equal(payload, msg) {
+			panic("unexpected message")
+		}
+		// uncompressed
+		c.write(finBit|byte(OpBinary), []byte("short"))
+		if op, payload := c.read(); op != OpBinary || string(payload) != "short" {
+			panic("unexpected message")
+		}
+		// too big once decompressed
+		c.write(finBit|rsv1Bit|byte(OpBinary), compress(make([]byte, 1<<20+1)))
+		c.expectClose(CloseMessageTooBig)
+
+		// without the extension
+		c = dial(addr, "Sec-WebSocket-Extensions: x-webkit-deflate-frame\r\n")
+		if c.resp.Header.Get("Sec-Websocket-Extensions") != "" {
+			panic("unexpected extensions")
+		}
+		c.write(finBit|byte(OpText), msg)
+		if op, payload := c.read(); op != OpText || !bytes.Equal(payload, msg) {
+			panic("unexpected message")
+		}
+		c.write(finBit|byte(OpClose), nil)
+		c.expectClose(CloseNormal)
+	})
+}